@@ -76,6 +76,13 @@ var (
 			" EDS pushes may be delayed, but there will be fewer pushes. By default this is enabled",
 	)
 
+	EnableEndpointSorting = env.RegisterBoolVar(
+		"PILOT_ENABLE_ENDPOINT_SORTING",
+		true,
+		"If enabled, endpoints built from the Kubernetes registry are sorted by IP and port, so that repeated builds "+
+			"produce the same EDS output regardless of informer iteration order.",
+	).Get()
+
 	// HTTP10 will add "accept_http_10" to http outbound listeners. Can also be set only for specific sidecars via meta.
 	//
 	// Alpha in 1.1, may become the default or be turned into a Sidecar API or mesh setting. Only applies to namespaces
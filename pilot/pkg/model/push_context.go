@@ -1617,7 +1617,7 @@ func (ps *PushContext) initMeshNetworks() {
 			gws := networkConf.Gateways
 			for _, gw := range gws {
 				if gwIP := net.ParseIP(gw.GetAddress()); gwIP != nil {
-					ps.networkGateways[network] = append(ps.networkGateways[network], &Gateway{gw.GetAddress(), gw.Port})
+					ps.networkGateways[network] = append(ps.networkGateways[network], &Gateway{Addr: gw.GetAddress(), Port: gw.Port})
 				}
 			}
 
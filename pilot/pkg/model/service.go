@@ -409,6 +409,14 @@ type IstioEndpoint struct {
 
 	// Name of the workload that this endpoint belongs to. This is for telemetry purpose.
 	WorkloadName string
+
+	// HostName is the hostname of the endpoint within a headless service, such as the stable
+	// network identity of a StatefulSet pod. Empty if the endpoint has no hostname.
+	HostName string
+
+	// SubDomain is the headless service the HostName is scoped to. The endpoint is resolvable
+	// by DNS as <HostName>.<SubDomain>.<Namespace>.svc.<domain>.
+	SubDomain string
 }
 
 // ServiceAttributes represents a group of custom attributes of the service.
@@ -447,6 +455,21 @@ type ServiceAttributes struct {
 	// The port that the user provides in the meshNetworks config is the service port.
 	// We translate that to the appropriate node port here.
 	ClusterExternalPorts map[string]map[uint32]uint32
+
+	// GatewayRouteReferenced is set when the service is referenced by a Gateway API route.
+	// This is a discovery hint used for scoping and does not affect routing.
+	GatewayRouteReferenced bool
+
+	// FromConfigCluster is set when the service was discovered by the registry of the config cluster,
+	// rather than a remote cluster.
+	FromConfigCluster bool
+
+	// ValidationError describes why the service failed strict validation by its registry, if it did.
+	ValidationError string
+
+	// Draining is set when the namespace of the service is being deleted, and the registry retains the service
+	// for a grace period before removing it.
+	Draining bool
 }
 
 // ServiceDiscovery enumerates Istio service instances.
@@ -36,6 +36,8 @@ import (
 	"github.com/golang/protobuf/ptypes"
 	"github.com/golang/protobuf/ptypes/wrappers"
 	"github.com/google/go-cmp/cmp"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	meshconfig "istio.io/api/mesh/v1alpha1"
 	networking "istio.io/api/networking/v1alpha3"
@@ -47,6 +49,7 @@ import (
 	"istio.io/istio/pilot/pkg/networking/plugin/registry"
 	"istio.io/istio/pilot/pkg/networking/util"
 	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
 	memregistry "istio.io/istio/pilot/pkg/serviceregistry/memory"
 	xdsfilters "istio.io/istio/pilot/pkg/xds/filters"
 	"istio.io/istio/pilot/test/xdstest"
@@ -513,6 +516,60 @@ func TestOutboundListenerForHeadlessServices(t *testing.T) {
 	}
 }
 
+func TestOutboundListenerForHeadlessAsEDSServices(t *testing.T) {
+	tests := []struct {
+		name                      string
+		portName                  string
+		numListenersOnServicePort int
+	}{
+		{
+			// HTTP ports are served by the wildcard listener, load balancing over the endpoints
+			name:                      "http port",
+			portName:                  "http",
+			numListenersOnServicePort: 1,
+		},
+		{
+			// the annotation is ignored, keeping a listener per endpoint
+			name:                      "tcp port",
+			portName:                  "tcp",
+			numListenersOnServicePort: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := kube.ConvertService(coreV1.Service{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name:        "headless",
+					Namespace:   "default",
+					Annotations: map[string]string{kube.HeadlessAsEDSAnnotation: "true"},
+				},
+				Spec: coreV1.ServiceSpec{
+					ClusterIP: coreV1.ClusterIPNone,
+					Ports:     []coreV1.ServicePort{{Name: tt.portName, Port: 9999, Protocol: coreV1.ProtocolTCP}},
+				},
+			}, "cluster.local", "Kubernetes")
+			cg := NewConfigGenTest(t, TestOptions{
+				Services: []*model.Service{svc},
+				Instances: []*model.ServiceInstance{
+					buildServiceInstance(svc, "10.10.10.10"),
+					buildServiceInstance(svc, "11.11.11.11"),
+				},
+			})
+
+			listeners := cg.ConfigGen.buildSidecarOutboundListeners(cg.SetupProxy(nil), cg.env.PushContext)
+			listenersToCheck := make([]string, 0)
+			for _, l := range listeners {
+				if l.Address.GetSocketAddress().GetPortValue() == 9999 {
+					listenersToCheck = append(listenersToCheck, l.Name)
+				}
+			}
+			if len(listenersToCheck) != tt.numListenersOnServicePort {
+				t.Errorf("Expected %d listeners on service port 9999, got %d (%v)", tt.numListenersOnServicePort, len(listenersToCheck), listenersToCheck)
+			}
+		})
+	}
+}
+
 func TestInboundListenerConfig_HTTP10(t *testing.T) {
 	for _, p := range []*model.Proxy{getProxy(), &proxyHTTP10} {
 		// Add a service and verify it's config
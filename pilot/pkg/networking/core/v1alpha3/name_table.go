@@ -66,14 +66,15 @@ func (configgen *ConfigGeneratorImpl) BuildNameTable(node *model.Proxy, push *mo
 
 		svcAddress := svc.GetServiceAddressForProxy(node, push)
 		var addressList []string
+		// hostname => IPs of the endpoints of a headless service with a stable network identity
+		var podHostnames map[string][]string
 
 		// The IP will be unspecified here if its headless service or if the auto
 		// IP allocation logic for service entry was unable to allocate an IP.
 		if svcAddress == constants.UnspecifiedIP {
 			// For all k8s headless services, populate the dns table with the endpoint IPs as k8s does.
-			// TODO: Need to have an entry per pod hostname of stateful set but for this, we need to parse
-			// the stateful set object, associate the object with the appropriate kubernetes headless service
-			// and then derive the stable network identities.
+			// Endpoints with a hostname, such as the pods of a stateful set, also get an entry for their
+			// stable network identity.
 			if svc.Attributes.ServiceRegistry == string(serviceregistry.Kubernetes) &&
 				svc.Resolution == model.Passthrough && len(svc.Ports) > 0 {
 				// TODO: this is used in two places now. Needs to be cached as part of the headless service
@@ -81,6 +82,13 @@ func (configgen *ConfigGeneratorImpl) BuildNameTable(node *model.Proxy, push *mo
 				for _, instance := range push.ServiceInstancesByPort(svc, svc.Ports[0].Port, nil) {
 					// TODO: should we skip the node's own IP like we do in listener?
 					addressList = append(addressList, instance.Endpoint.Address)
+					if instance.Endpoint.HostName != "" && instance.Endpoint.SubDomain == svc.Attributes.Name {
+						if podHostnames == nil {
+							podHostnames = make(map[string][]string)
+						}
+						podHostnames[instance.Endpoint.HostName] = append(podHostnames[instance.Endpoint.HostName],
+							instance.Endpoint.Address)
+					}
 				}
 			}
 
@@ -104,6 +112,16 @@ func (configgen *ConfigGeneratorImpl) BuildNameTable(node *model.Proxy, push *mo
 			nameInfo.Shortname = svc.Attributes.Name
 		}
 		out.Table[string(svc.Hostname)] = nameInfo
+
+		// <hostname>.<service>.<namespace>.svc.<domain>, resolved by the agent like the service itself
+		for hostname, ips := range podHostnames {
+			out.Table[hostname+"."+string(svc.Hostname)] = &nds.NameTable_NameInfo{
+				Ips:       ips,
+				Registry:  svc.Attributes.ServiceRegistry,
+				Namespace: svc.Attributes.Namespace,
+				Shortname: hostname + "." + svc.Attributes.Name,
+			}
+		}
 	}
 	return out
 }
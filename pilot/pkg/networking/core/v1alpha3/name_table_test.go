@@ -0,0 +1,79 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1alpha3
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"istio.io/istio/pilot/pkg/model"
+	nds "istio.io/istio/pilot/pkg/proto"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pkg/config/constants"
+	"istio.io/istio/pkg/config/protocol"
+)
+
+func TestBuildNameTableHeadlessHostnames(t *testing.T) {
+	port := &model.Port{Name: "tcp", Port: 9000, Protocol: protocol.TCP}
+	service := &model.Service{
+		Hostname:   "web.default.svc.cluster.local",
+		Address:    constants.UnspecifiedIP,
+		Ports:      model.PortList{port},
+		Resolution: model.Passthrough,
+		Attributes: model.ServiceAttributes{
+			ServiceRegistry: string(serviceregistry.Kubernetes),
+			Name:            "web",
+			Namespace:       "default",
+		},
+	}
+	instance := func(ip, hostname, subdomain string) *model.ServiceInstance {
+		return &model.ServiceInstance{
+			Service:     service,
+			ServicePort: port,
+			Endpoint: &model.IstioEndpoint{
+				Address:         ip,
+				EndpointPort:    9000,
+				ServicePortName: "tcp",
+				HostName:        hostname,
+				SubDomain:       subdomain,
+			},
+		}
+	}
+	cg := NewConfigGenTest(t, TestOptions{
+		Services: []*model.Service{service},
+		Instances: []*model.ServiceInstance{
+			instance("10.0.0.1", "web-0", "web"),
+			instance("10.0.0.2", "web-1", "web"),
+			// no stable network identity
+			instance("10.0.0.3", "", ""),
+			// the hostname is scoped to another service
+			instance("10.0.0.4", "other-0", "other"),
+		},
+	})
+
+	table := cg.ConfigGen.BuildNameTable(cg.SetupProxy(nil), cg.PushContext())
+
+	g := NewWithT(t)
+	g.Expect(table.Table).To(HaveLen(3))
+	g.Expect(table.Table["web.default.svc.cluster.local"].Ips).To(ConsistOf("10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"))
+	g.Expect(table.Table["web-0.web.default.svc.cluster.local"]).To(Equal(&nds.NameTable_NameInfo{
+		Ips:       []string{"10.0.0.1"},
+		Registry:  string(serviceregistry.Kubernetes),
+		Namespace: "default",
+		Shortname: "web-0.web",
+	}))
+	g.Expect(table.Table["web-1.web.default.svc.cluster.local"].Ips).To(Equal([]string{"10.0.0.2"}))
+}
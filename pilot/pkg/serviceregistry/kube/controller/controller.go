@@ -15,18 +15,24 @@
 package controller
 
 import (
+	"context"
 	"fmt"
+	"math/rand"
+	"reflect"
 	"sort"
 	"sync"
 	"time"
 
 	"github.com/hashicorp/go-multierror"
 	"github.com/yl2chen/cidranger"
+	"golang.org/x/time/rate"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	klabels "k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	listerv1 "k8s.io/client-go/listers/core/v1"
@@ -68,8 +74,15 @@ const (
 )
 
 var (
-	typeTag  = monitoring.MustCreateLabel("type")
-	eventTag = monitoring.MustCreateLabel("event")
+	typeTag    = monitoring.MustCreateLabel("type")
+	eventTag   = monitoring.MustCreateLabel("event")
+	clusterTag = monitoring.MustCreateLabel("cluster")
+	// namespaceTag is the namespace of the resource a metric is recorded for.
+	namespaceTag = monitoring.MustCreateLabel("namespace")
+	// serviceTag is the hostname of the service a metric is recorded for.
+	serviceTag = monitoring.MustCreateLabel("service")
+	// edsKindTag tells EDS cache updates ("cache") from EDS updates triggering a push ("full").
+	edsKindTag = monitoring.MustCreateLabel("kind")
 
 	k8sEvents = monitoring.NewSum(
 		"pilot_k8s_reg_events",
@@ -88,12 +101,134 @@ var (
 		"pilot_k8s_endpoints_pending_pod",
 		"Number of endpoints that do not currently have any corresponding pods.",
 	)
+
+	endpointsPendingPodByNamespace = monitoring.NewGauge(
+		"pilot_k8s_endpoints_pending_pod_by_namespace",
+		"Number of endpoints that do not currently have any corresponding pods, by namespace of the endpoints.",
+		monitoring.WithLabels(namespaceTag),
+	)
+
+	observedNetworks = monitoring.NewGauge(
+		"pilot_k8s_observed_networks",
+		"Number of distinct networks of the endpoints built by the k8s registry.",
+		monitoring.WithLabels(clusterTag),
+	)
+
+	endpointsWithNoLocality = monitoring.NewGauge(
+		"pilot_k8s_endpoints_no_locality",
+		"Number of endpoints that do not have a locality, typically because their node is missing topology labels.",
+		monitoring.WithLabels(clusterTag),
+	)
+
+	queueDepth = monitoring.NewGauge(
+		"pilot_k8s_reg_queue_depth",
+		"Number of events waiting to be processed by the k8s registry.",
+		monitoring.WithLabels(clusterTag),
+	)
+
+	queueDepthHighWatermark = monitoring.NewGauge(
+		"pilot_k8s_reg_queue_depth_high_watermark",
+		"Highest number of events observed waiting to be processed by the k8s registry.",
+		monitoring.WithLabels(clusterTag),
+	)
+
+	queueOldestAge = monitoring.NewGauge(
+		"pilot_k8s_reg_queue_oldest_age_seconds",
+		"How long the oldest event waiting to be processed by the k8s registry has been queued.",
+		monitoring.WithLabels(clusterTag),
+	)
+
+	ambiguousNetworkMatches = monitoring.NewSum(
+		"pilot_k8s_ambiguous_network_matches",
+		"Number of endpoint IPs matching the CIDRs of multiple networks.",
+		monitoring.WithLabels(clusterTag),
+	)
+
+	convertServiceCalls = monitoring.NewSum(
+		"pilot_k8s_convert_service_calls",
+		"Number of times a Kubernetes service was converted to an Istio service.",
+		monitoring.WithLabels(clusterTag),
+	)
+
+	serviceConflicts = monitoring.NewSum(
+		"pilot_k8s_service_conflicts",
+		"Number of service events flagged by strict validation due to conflicting port protocols.",
+		monitoring.WithLabels(clusterTag),
+	)
+
+	servicesNoPorts = monitoring.NewSum(
+		"pilot_k8s_services_no_ports",
+		"Number of service events for services without any port.",
+		monitoring.WithLabels(clusterTag),
+	)
+
+	edsDeduped = monitoring.NewSum(
+		"pilot_k8s_eds_deduped",
+		"Number of EDS updates skipped because the endpoints of the service did not change.",
+		monitoring.WithLabels(clusterTag),
+	)
+
+	fullPushesCoalesced = monitoring.NewSum(
+		"pilot_k8s_full_pushes_coalesced",
+		"Number of full pushes merged into a pending push because of the full push coalescing window.",
+		monitoring.WithLabels(clusterTag),
+	)
+
+	overlappingSelectorPods = monitoring.NewGauge(
+		"pilot_k8s_overlapping_selectors",
+		"Number of pods selected by more than one service.",
+		monitoring.WithLabels(clusterTag),
+	)
+
+	edsUpdates = monitoring.NewSum(
+		"pilot_k8s_eds_updates",
+		"Number of EDS updates sent by the registry, by kind (cache or full).",
+		monitoring.WithLabels(clusterTag, edsKindTag),
+	)
+
+	endpointPortMismatch = monitoring.NewSum(
+		"pilot_k8s_endpoint_port_mismatch",
+		"Number of times the named target port of a service was not found on a pod selected by the service.",
+		monitoring.WithLabels(clusterTag, serviceTag),
+	)
+
+	staleServices = monitoring.NewGauge(
+		"pilot_k8s_stale_services",
+		"Number of services in the registry missing from the informer at the last full sync.",
+		monitoring.WithLabels(clusterTag),
+	)
+)
+
+const (
+	// defaultQueueDepthSamplePeriod is how often the queue depth is sampled when not configured.
+	defaultQueueDepthSamplePeriod = 10 * time.Second
+	// defaultFullResyncJitter is the jitter applied to the full resync period when not configured.
+	defaultFullResyncJitter = 0.1
+	// defaultEndpointBuildParallelThreshold is the number of addresses from which endpoints are built in
+	// parallel when not configured.
+	defaultEndpointBuildParallelThreshold = 1000
 )
 
 func init() {
 	monitoring.MustRegister(k8sEvents)
 	monitoring.MustRegister(endpointsWithNoPods)
 	monitoring.MustRegister(endpointsPendingPodUpdate)
+	monitoring.MustRegister(endpointsPendingPodByNamespace)
+	monitoring.MustRegister(endpointsWithNoLocality)
+	monitoring.MustRegister(observedNetworks)
+	monitoring.MustRegister(queueDepth)
+	monitoring.MustRegister(queueDepthHighWatermark)
+	monitoring.MustRegister(queueOldestAge)
+	monitoring.MustRegister(ambiguousNetworkMatches)
+	monitoring.MustRegister(convertServiceCalls)
+	monitoring.MustRegister(serviceConflicts)
+	monitoring.MustRegister(servicesNoPorts)
+	monitoring.MustRegister(edsDeduped)
+	monitoring.MustRegister(fullPushesCoalesced)
+	monitoring.MustRegister(overlappingSelectorPods)
+	monitoring.MustRegister(staleServices)
+	monitoring.MustRegister(edsUpdates)
+	monitoring.MustRegister(endpointPortMismatch)
 }
 
 func incrementEvent(kind, event string) {
@@ -109,9 +244,17 @@ type Options struct {
 	ResyncPeriod      time.Duration
 	DomainSuffix      string
 
+	// AdditionalDomainSuffixes are domain suffixes services are also registered under, in addition to
+	// DomainSuffix. This allows services to be resolved under both suffixes during a migration.
+	AdditionalDomainSuffixes []string
+
 	// ClusterID identifies the remote cluster in a multicluster env.
 	ClusterID string
 
+	// ConfigCluster is set for the controller of the cluster Istio reads its configuration from, as opposed
+	// to remote clusters added through secrets. Its services are marked with FromConfigCluster.
+	ConfigCluster bool
+
 	// FetchCaRoot defines the function to get caRoot
 	FetchCaRoot func() map[string]string
 
@@ -139,6 +282,176 @@ type Options struct {
 
 	// Maximum burst for throttle when communicating with the kubernetes API
 	KubernetesAPIBurst int
+
+	// FullResyncPeriod, if set, periodically re-processes all cached resources as a safeguard against
+	// the controller drifting from the API server. Disabled when zero.
+	FullResyncPeriod time.Duration
+
+	// FullResyncJitter is the fraction of FullResyncPeriod by which each resync is randomly advanced or
+	// delayed, so controllers for different clusters do not resync in lockstep. Defaults to 0.1 when zero,
+	// negative values disable jitter.
+	FullResyncJitter float64
+
+	// QueueDepthSamplePeriod is how often the event queue depth metric is sampled. Defaults to 10s.
+	QueueDepthSamplePeriod time.Duration
+
+	// QueueDepthWarningThreshold, if positive, logs a warning whenever the sampled queue depth exceeds it.
+	QueueDepthWarningThreshold int
+
+	// QueueFactory, if set, creates the event queue of the controller, identified by the cluster ID. Defaults
+	// to a queue retrying failed tasks after a second.
+	QueueFactory func(id string) queue.Instance
+
+	// BuildSliceEndpointsWithoutPod builds endpoints from EndpointSlice data alone when their pod is not yet
+	// in the pod cache, rather than skipping them until it arrives. Only applies with EndpointSliceOnly.
+	BuildSliceEndpointsWithoutPod bool
+
+	// DisableNodePortGatewayDiscovery ignores NodePort gateway services and node events. Nodes are still
+	// watched to determine pod locality.
+	DisableNodePortGatewayDiscovery bool
+
+	// ExcludedPodPhases are pod phases whose endpoints are skipped, even if Kubernetes still lists them.
+	ExcludedPodPhases []v1.PodPhase
+
+	// ExcludedNamespaces are namespaces, such as kube-system, whose services, endpoints and pods are never
+	// discovered. The network label of the system namespace is still read if it is excluded.
+	ExcludedNamespaces []string
+
+	// RequireInjectedSidecar skips the endpoints of pods without the sidecar.istio.io/status annotation, so
+	// that traffic is only routed to pods which can take part in mTLS. Endpoints not backed by a pod are kept.
+	RequireInjectedSidecar bool
+
+	// MultiNetworkMatchPolicy decides the network of an endpoint whose IP matches the CIDRs of multiple
+	// networks in meshNetworks. Defaults to LongestPrefix.
+	MultiNetworkMatchPolicy MultiNetworkMatchPolicy
+
+	// EndpointLabelAllowlist, if set, restricts the pod labels copied onto endpoints to the listed keys,
+	// to reduce the size of EDS pushes. Labels Istio relies on, such as topology and network labels, are
+	// always kept. Note that DestinationRule subsets can only select on labels that are kept. Workload
+	// instances passed to workload handlers keep all the labels of the pod.
+	EndpointLabelAllowlist []string
+
+	// EndpointAddressRewriter, if set, rewrites the address of endpoints before they are advertised, for
+	// example to a NAT address. The network of the endpoint is resolved from the rewritten address. The pod
+	// is nil for endpoints without one. An empty result keeps the original address.
+	EndpointAddressRewriter func(original string, pod *v1.Pod) string
+
+	// AdvertiseHostNetworkNodeIP advertises the IP of the node, rather than the pod IP, as the address of
+	// endpoints backed by host-network pods. It applies before EndpointAddressRewriter.
+	AdvertiseHostNetworkNodeIP bool
+
+	// FullPushCoalesceWindow, if positive, coalesces the full pushes triggered by node events, NodePort
+	// gateway address changes and headless service endpoints within the window into a single push. This
+	// bounds the push rate when nodes or endpoints churn. Pushes are triggered immediately when zero.
+	FullPushCoalesceWindow time.Duration
+
+	// SkipUnschedulableGatewayNodes leaves out the addresses of unschedulable nodes, whether cordoned or
+	// tainted with node.kubernetes.io/unschedulable, from the addresses of NodePort gateways.
+	SkipUnschedulableGatewayNodes bool
+
+	// EvictStaleServices evicts the services found in the registry but missing from the informer during a
+	// full sync, which happens if a delete event was missed. Stale services are only logged when false.
+	EvictStaleServices bool
+
+	// SpreadConstraintTopologyLabels copies onto endpoints the labels of the node of the pod whose keys are
+	// the topology keys of the pod's topology spread constraints. Labels of the pod take precedence.
+	SpreadConstraintTopologyLabels bool
+
+	// PodDiscoveryFilter, if set, restricts the pods tracked by the controller to the namespaces it accepts.
+	// Services are still discovered in every namespace, but endpoints backed by pods in other namespaces
+	// are ignored.
+	PodDiscoveryFilter func(namespace string) bool
+
+	// CrossNamespaceWorkloadInstances lets workload instances from other registries, such as workload entries,
+	// join the services of any namespace whose selector matches their labels. By default, workload instances
+	// only join the services of their own namespace.
+	CrossNamespaceWorkloadInstances bool
+
+	// DetectOverlappingSelectors tracks pods selected by more than one service, which is usually a
+	// misconfiguration. Overlaps are counted in the pilot_k8s_overlapping_selectors metric and listed by
+	// OverlappingSelectors.
+	DetectOverlappingSelectors bool
+
+	// EndpointHealthChecker, if set, is consulted for endpoints of workload instances selected by services.
+	// Endpoints it reports as unhealthy are excluded, as for pods that are not ready.
+	EndpointHealthChecker EndpointHealthChecker
+
+	// ManualEndpointsOnly builds the endpoints of services without a selector from their manually managed
+	// Endpoints or EndpointSlices only. Addresses that do not reference a pod are not matched to a pod by IP,
+	// so they carry no pod labels or other pod metadata, as they may be shared by host network pods.
+	ManualEndpointsOnly bool
+
+	// ServiceDeleteGracePeriod delays the removal of deleted services. A service recreated within the
+	// grace period is kept as is, which avoids churn when services are deleted and recreated quickly.
+	// Services are removed immediately when zero.
+	ServiceDeleteGracePeriod time.Duration
+
+	// NamespaceTerminationGracePeriod delays the removal of services deleted while their namespace is
+	// terminating, so they can drain. Such services are marked as draining in the meantime. When zero,
+	// ServiceDeleteGracePeriod applies to them as to other services.
+	NamespaceTerminationGracePeriod time.Duration
+
+	// StrictServiceValidation flags services mapping multiple ports with different protocols to the same
+	// target port, which otherwise cause listener conflicts. Such services are still registered, but are
+	// logged, counted, and marked with a ValidationError.
+	StrictServiceValidation bool
+
+	// ServicesWithoutPortsPolicy decides how services without any port are handled. Defaults to
+	// IgnoreServicesWithoutPorts.
+	ServicesWithoutPortsPolicy ServicesWithoutPortsPolicy
+
+	// LocalitySource decides whether the locality label of pods or the topology labels of their node take
+	// precedence. Defaults to PodLabelFirst.
+	LocalitySource LocalitySource
+
+	// SyncNamespaceBatchSize is the number of services, pods or endpoints of a namespace processed in turn
+	// during a full sync, before moving on to the next namespace, so a large namespace does not hold back the
+	// others. Defaults to 1.
+	SyncNamespaceBatchSize int
+
+	// SyncQPS, if positive, limits the rate at which objects are processed during a full sync, allowing
+	// bursts of up to SyncBurst objects.
+	SyncQPS   float64
+	SyncBurst int
+
+	// EndpointBuildWorkers, if greater than one, is the number of goroutines building the endpoints of a
+	// single Endpoints object with at least EndpointBuildParallelThreshold addresses, which speeds up large
+	// headless services. The endpoints are built serially otherwise. The order of the endpoints is unchanged.
+	EndpointBuildWorkers int
+	// EndpointBuildParallelThreshold defaults to 1000.
+	EndpointBuildParallelThreshold int
+}
+
+// ServicesWithoutPortsPolicy decides how services without any port, which are usually misconfigured, are handled.
+type ServicesWithoutPortsPolicy int
+
+const (
+	// IgnoreServicesWithoutPorts registers services without ports like any other service.
+	IgnoreServicesWithoutPorts ServicesWithoutPortsPolicy = iota
+	// SkipServicesWithoutPorts logs a warning and does not register services without ports.
+	SkipServicesWithoutPorts
+	// CountServicesWithoutPorts registers services without ports, and counts them in the
+	// pilot_k8s_services_no_ports metric.
+	CountServicesWithoutPorts
+)
+
+// LocalitySource decides which source of the locality of a pod takes precedence. The other source is used
+// when the preferred one does not provide a locality.
+type LocalitySource int
+
+const (
+	// PodLabelFirst prefers the istio-locality label of the pod over the topology labels of its node.
+	PodLabelFirst LocalitySource = iota
+	// NodeLabelFirst prefers the topology labels of the node over the istio-locality label of the pod.
+	NodeLabelFirst
+)
+
+// EndpointHealthChecker provides health information for endpoints that Kubernetes has no readiness for,
+// such as workload entries of VMs. It is called with the controller lock held, so it must not call back
+// into the controller. Health changes are reported through Controller.EndpointHealthChanged.
+type EndpointHealthChecker interface {
+	// Healthy reports whether the endpoint with the given address and port can receive traffic.
+	Healthy(ip string, port int) bool
 }
 
 // EndpointMode decides what source to use to get endpoint information
@@ -151,14 +464,19 @@ const (
 	// EndpointSliceOnly type will use only Kubernetes EndpointSlices
 	EndpointSliceOnly
 
-	// TODO: add other modes. Likely want a mode with Endpoints+EndpointSlices that are not controlled by
-	// Kubernetes Controller (e.g. made by user and not duplicated with Endpoints), or a mode with both that
-	// does deduping. Simply doing both won't work for now, since not all Kubernetes components support EndpointSlice.
+	// EndpointsAndManualEndpointSlices type will use Kubernetes Endpoints, along with EndpointSlices that are
+	// not managed by Kubernetes (e.g. made by user and not duplicated with Endpoints). Endpoints present in
+	// both are deduplicated.
+	EndpointsAndManualEndpointSlices
+
+	// TODO: add other modes. Likely want a mode with both that does deduping of all EndpointSlices. Simply doing
+	// both won't work for now, since not all Kubernetes components support EndpointSlice.
 )
 
 var EndpointModeNames = map[EndpointMode]string{
-	EndpointsOnly:     "EndpointsOnly",
-	EndpointSliceOnly: "EndpointSliceOnly",
+	EndpointsOnly:                    "EndpointsOnly",
+	EndpointSliceOnly:                "EndpointSliceOnly",
+	EndpointsAndManualEndpointSlices: "EndpointsAndManualEndpointSlices",
 }
 
 func (m EndpointMode) String() string {
@@ -171,6 +489,8 @@ var _ serviceregistry.Instance = &Controller{}
 type kubernetesNode struct {
 	address string
 	labels  labels.Instance
+	// unschedulable is set for cordoned nodes
+	unschedulable bool
 }
 
 // controllerInterface is a simplified interface for the Controller used for testing.
@@ -178,6 +498,10 @@ type controllerInterface interface {
 	getPodLocality(pod *v1.Pod) string
 	cidrRanger() cidranger.Ranger
 	defaultNetwork() string
+	multiNetworkMatchPolicy() MultiNetworkMatchPolicy
+	endpointLabelAllowlist() map[string]struct{}
+	spreadTopologyLabels(pod *v1.Pod) labels.Instance
+	rewriteEndpointAddress(address string, pod *v1.Pod) string
 	Cluster() string
 }
 
@@ -196,6 +520,8 @@ type Controller struct {
 	serviceLister   listerv1.ServiceLister
 
 	endpoints kubeEndpointsController
+	// endpointMode is the source of the endpoints
+	endpointMode EndpointMode
 
 	// Used to watch node accessible from remote cluster.
 	// In multi-cluster(shared control plane multi-networks) scenario, ingress gateway service can be of nodePort type.
@@ -210,9 +536,48 @@ type Controller struct {
 	xdsUpdater      model.XDSUpdater
 	domainSuffix    string
 	clusterID       string
-
-	serviceHandlers  []func(*model.Service, model.Event)
-	workloadHandlers []func(*model.WorkloadInstance, model.Event)
+	configCluster   bool
+
+	fullResyncPeriod time.Duration
+	fullResyncJitter float64
+
+	sliceEndpointsWithoutPod bool
+	additionalDomainSuffixes []string
+	excludedPodPhases        map[v1.PodPhase]struct{}
+	excludedNamespaces       map[string]struct{}
+	requireInjectedSidecar   bool
+	nodePortGatewaysDisabled bool
+
+	queueDepthSamplePeriod     time.Duration
+	queueDepthWarningThreshold int
+
+	endpointHealthChecker      EndpointHealthChecker
+	serviceDeleteGracePeriod   time.Duration
+	strictServiceValidation    bool
+	servicesWithoutPortsPolicy ServicesWithoutPortsPolicy
+
+	// nsTerminationGracePeriod delays the removal of services of terminating namespaces
+	nsTerminationGracePeriod time.Duration
+	// localitySource decides the precedence of the sources of pod localities
+	localitySource LocalitySource
+	// syncBatchSize and syncLimiter control the order and rate of objects processed during full syncs
+	syncBatchSize int
+	syncLimiter   *rate.Limiter
+	// syncCtx is cancelled once the controller stops, aborting a rate limited full sync
+	syncCtx    context.Context
+	cancelSync context.CancelFunc
+	// endpointBuildWorkers and endpointBuildThreshold control the parallel building of large endpoints
+	endpointBuildWorkers   int
+	endpointBuildThreshold int
+	// namespaceInformer and namespaceLister track terminating namespaces, if nsTerminationGracePeriod is set
+	namespaceInformer cache.SharedIndexInformer
+	namespaceLister   listerv1.NamespaceLister
+
+	serviceHandlers         []func(*model.Service, model.Event)
+	workloadHandlers        []func(*model.WorkloadInstance, model.Event)
+	podHandlers             []func(*v1.Pod, model.Event)
+	serviceSelectorHandlers []func(prev, curr *model.Service)
+	initialSyncHandlers     []func()
 
 	// This is only used for test
 	stop chan struct{}
@@ -234,9 +599,65 @@ type Controller struct {
 	workloadInstancesByIP map[string]*model.WorkloadInstance
 	// Stores a map of workload instance name/namespace to address
 	workloadInstancesIPsByName map[string]string
+	// workload instances partitioned by namespace - map of namespace -> ip -> workload instance
+	workloadInstancesByNamespace map[string]map[string]*model.WorkloadInstance
+	// serviceLastUpdate stores hostname => time of the last event updating the service in servicesMap
+	serviceLastUpdate map[host.Name]time.Time
+	// pendingServiceDeletes stores hostname => timer removing the service once its delete grace period elapses
+	pendingServiceDeletes map[host.Name]*time.Timer
+	// serviceNetworks stores hostname => network forced by the ServiceNetworkAnnotation
+	serviceNetworks map[host.Name]string
+	// gatewayRouteServices stores the hostnames of services referenced by Gateway API routes
+	gatewayRouteServices map[host.Name]struct{}
+	// endpointsNoLocality stores hostname => number of endpoints without a locality
+	endpointsNoLocality      map[host.Name]int
+	endpointsNoLocalityTotal int
+	// endpointNetworks stores hostname => networks of the endpoints of the service
+	endpointNetworks map[host.Name]map[string]struct{}
+	// networkServices stores network => number of services with endpoints in the network
+	networkServices map[string]int
+	// edsHashes stores hostname => hash of the endpoints last sent to the xDS updater, so that service events
+	// that leave the endpoints unchanged do not update them again
+	edsHashes map[host.Name]uint64
+	// edsPushedHashes stores hostname => hash of the endpoints last pushed, so that workload instance
+	// events that leave the endpoints unchanged do not push them again
+	edsPushedHashes map[host.Name]uint64
+	// queueDepthHighWatermark is the highest sampled depth of queue
+	queueDepthHighWatermark int
 
 	// CIDR ranger based on path-compressed prefix trie
 	ranger cidranger.Ranger
+	// networkMatchPolicy decides the network for IPs matching multiple CIDRs in ranger
+	networkMatchPolicy MultiNetworkMatchPolicy
+	// endpointLabels is the set of pod label keys copied onto endpoints, nil to copy all labels
+	endpointLabels map[string]struct{}
+	// endpointAddressRewriter rewrites endpoint addresses, if set
+	endpointAddressRewriter func(original string, pod *v1.Pod) string
+	// hostNetworkNodeIP advertises the node IP for endpoints of host-network pods
+	hostNetworkNodeIP bool
+	// spreadConstraintLabels copies the node labels of topology spread constraint keys onto endpoints
+	spreadConstraintLabels bool
+	// fullPushWindow is the window full pushes are coalesced in, if positive
+	fullPushWindow time.Duration
+	// skipUnschedulableNodes leaves unschedulable nodes out of NodePort gateway addresses
+	skipUnschedulableNodes bool
+	// evictStaleServices evicts services missing from the informer during a full sync
+	evictStaleServices bool
+	// pendingFullPush is the coalesced push waiting for the end of the window, guarded by fullPushMutex
+	pendingFullPush *model.PushRequest
+	fullPushMutex   sync.Mutex
+	// podDiscoveryFilter restricts the namespaces of tracked pods, if set
+	podDiscoveryFilter func(namespace string) bool
+	// crossNamespaceWorkloads lets workload instances join services of other namespaces
+	crossNamespaceWorkloads bool
+	// manualEndpointsOnly skips the pod lookup by IP for endpoints of services without a selector
+	manualEndpointsOnly bool
+	// detectOverlappingSelectors enables tracking of overlappingSelectors
+	detectOverlappingSelectors bool
+	// overlappingSelectors stores pod key => sorted names of the services selecting it, for pods selected
+	// by more than one service. Guarded by overlapMutex, as it is updated under the pod cache lock.
+	overlappingSelectors map[string][]string
+	overlapMutex         sync.RWMutex
 
 	// Network name for to be used when the meshNetworks for registry nor network label on pod is specified
 	network string
@@ -248,29 +669,112 @@ type Controller struct {
 	networkGateways map[host.Name]map[string][]*model.Gateway
 
 	once sync.Once
+	// initialSyncDone is set once the initial sync has completed and initialSyncHandlers have been called
+	initialSyncDone bool
+	// syncErrors are the errors of the last full sync, empty if it succeeded
+	syncErrors []error
 }
 
 // NewController creates a new Kubernetes controller
 // Created by bootstrap and multicluster (see secretcontroler).
 func NewController(kubeClient kubelib.Client, options Options) *Controller {
-	// The queue requires a time duration for a retry delay after a handler error
+	if options.FullResyncJitter == 0 {
+		options.FullResyncJitter = defaultFullResyncJitter
+	}
+	if options.EndpointBuildParallelThreshold == 0 {
+		options.EndpointBuildParallelThreshold = defaultEndpointBuildParallelThreshold
+	}
+	excludedPodPhases := make(map[v1.PodPhase]struct{}, len(options.ExcludedPodPhases))
+	for _, phase := range options.ExcludedPodPhases {
+		excludedPodPhases[phase] = struct{}{}
+	}
+	excludedNamespaces := make(map[string]struct{}, len(options.ExcludedNamespaces))
+	for _, ns := range options.ExcludedNamespaces {
+		excludedNamespaces[ns] = struct{}{}
+	}
+	var endpointLabels map[string]struct{}
+	if len(options.EndpointLabelAllowlist) > 0 {
+		endpointLabels = make(map[string]struct{}, len(options.EndpointLabelAllowlist))
+		for _, key := range options.EndpointLabelAllowlist {
+			endpointLabels[key] = struct{}{}
+		}
+	}
+	var q queue.Instance
+	if options.QueueFactory != nil {
+		q = options.QueueFactory(options.ClusterID)
+	} else {
+		// The queue requires a time duration for a retry delay after a handler error
+		q = queue.NewQueue(1 * time.Second)
+	}
 	c := &Controller{
-		domainSuffix:                options.DomainSuffix,
-		client:                      kubeClient.Kube(),
-		queue:                       queue.NewQueue(1 * time.Second),
-		clusterID:                   options.ClusterID,
-		xdsUpdater:                  options.XDSUpdater,
-		servicesMap:                 make(map[host.Name]*model.Service),
-		nodeSelectorsForServices:    make(map[host.Name]labels.Instance),
-		nodeInfoMap:                 make(map[string]kubernetesNode),
-		externalNameSvcInstanceMap:  make(map[host.Name][]*model.ServiceInstance),
-		workloadInstancesByIP:       make(map[string]*model.WorkloadInstance),
-		workloadInstancesIPsByName:  make(map[string]string),
-		registryServiceNameGateways: make(map[host.Name]uint32),
-		networkGateways:             make(map[host.Name]map[string][]*model.Gateway),
-		networksWatcher:             options.NetworksWatcher,
-		metrics:                     options.Metrics,
+		domainSuffix:                 options.DomainSuffix,
+		client:                       kubeClient.Kube(),
+		queue:                        newTimedQueue(q),
+		clusterID:                    options.ClusterID,
+		endpointMode:                 options.EndpointMode,
+		configCluster:                options.ConfigCluster,
+		xdsUpdater:                   options.XDSUpdater,
+		servicesMap:                  make(map[host.Name]*model.Service),
+		nodeSelectorsForServices:     make(map[host.Name]labels.Instance),
+		nodeInfoMap:                  make(map[string]kubernetesNode),
+		externalNameSvcInstanceMap:   make(map[host.Name][]*model.ServiceInstance),
+		workloadInstancesByIP:        make(map[string]*model.WorkloadInstance),
+		workloadInstancesIPsByName:   make(map[string]string),
+		workloadInstancesByNamespace: make(map[string]map[string]*model.WorkloadInstance),
+		serviceLastUpdate:            make(map[host.Name]time.Time),
+		pendingServiceDeletes:        make(map[host.Name]*time.Timer),
+		serviceNetworks:              make(map[host.Name]string),
+		gatewayRouteServices:         make(map[host.Name]struct{}),
+		endpointsNoLocality:          make(map[host.Name]int),
+		endpointNetworks:             make(map[host.Name]map[string]struct{}),
+		networkServices:              make(map[string]int),
+		edsHashes:                    make(map[host.Name]uint64),
+		edsPushedHashes:              make(map[host.Name]uint64),
+		registryServiceNameGateways:  make(map[host.Name]uint32),
+		networkGateways:              make(map[host.Name]map[string][]*model.Gateway),
+		networksWatcher:              options.NetworksWatcher,
+		metrics:                      options.Metrics,
+		fullResyncPeriod:             options.FullResyncPeriod,
+		fullResyncJitter:             options.FullResyncJitter,
+		sliceEndpointsWithoutPod:     options.BuildSliceEndpointsWithoutPod,
+		additionalDomainSuffixes:     options.AdditionalDomainSuffixes,
+		excludedPodPhases:            excludedPodPhases,
+		excludedNamespaces:           excludedNamespaces,
+		requireInjectedSidecar:       options.RequireInjectedSidecar,
+		nodePortGatewaysDisabled:     options.DisableNodePortGatewayDiscovery,
+		queueDepthSamplePeriod:       options.QueueDepthSamplePeriod,
+		queueDepthWarningThreshold:   options.QueueDepthWarningThreshold,
+		networkMatchPolicy:           options.MultiNetworkMatchPolicy,
+		endpointLabels:               endpointLabels,
+		endpointAddressRewriter:      options.EndpointAddressRewriter,
+		hostNetworkNodeIP:            options.AdvertiseHostNetworkNodeIP,
+		spreadConstraintLabels:       options.SpreadConstraintTopologyLabels,
+		fullPushWindow:               options.FullPushCoalesceWindow,
+		skipUnschedulableNodes:       options.SkipUnschedulableGatewayNodes,
+		evictStaleServices:           options.EvictStaleServices,
+		podDiscoveryFilter:           options.PodDiscoveryFilter,
+		crossNamespaceWorkloads:      options.CrossNamespaceWorkloadInstances,
+		manualEndpointsOnly:          options.ManualEndpointsOnly,
+		detectOverlappingSelectors:   options.DetectOverlappingSelectors,
+		overlappingSelectors:         make(map[string][]string),
+		endpointHealthChecker:        options.EndpointHealthChecker,
+		serviceDeleteGracePeriod:     options.ServiceDeleteGracePeriod,
+		strictServiceValidation:      options.StrictServiceValidation,
+		servicesWithoutPortsPolicy:   options.ServicesWithoutPortsPolicy,
+		nsTerminationGracePeriod:     options.NamespaceTerminationGracePeriod,
+		localitySource:               options.LocalitySource,
+		syncBatchSize:                options.SyncNamespaceBatchSize,
+		endpointBuildWorkers:         options.EndpointBuildWorkers,
+		endpointBuildThreshold:       options.EndpointBuildParallelThreshold,
 	}
+	if options.SyncQPS > 0 {
+		burst := options.SyncBurst
+		if burst <= 0 {
+			burst = 1
+		}
+		c.syncLimiter = rate.NewLimiter(rate.Limit(options.SyncQPS), burst)
+	}
+	c.syncCtx, c.cancelSync = context.WithCancel(context.Background())
 
 	if options.SystemNamespace != "" {
 		c.nsInformer = informers.NewSharedInformerFactoryWithOptions(c.client, options.ResyncPeriod,
@@ -280,6 +784,11 @@ func NewController(kubeClient kubelib.Client, options Options) *Controller {
 		registerHandlers(c.nsInformer, c.queue, "Namespaces", c.onNamespaceEvent, nil)
 	}
 
+	if c.nsTerminationGracePeriod > 0 {
+		c.namespaceInformer = kubeClient.KubeInformer().Core().V1().Namespaces().Informer()
+		c.namespaceLister = kubeClient.KubeInformer().Core().V1().Namespaces().Lister()
+	}
+
 	c.serviceInformer = kubeClient.KubeInformer().Core().V1().Services().Informer()
 	c.serviceLister = kubeClient.KubeInformer().Core().V1().Services().Lister()
 	registerHandlers(c.serviceInformer, c.queue, "Services", c.onServiceEvent, nil)
@@ -289,12 +798,18 @@ func NewController(kubeClient kubelib.Client, options Options) *Controller {
 		c.endpoints = newEndpointsController(c, kubeClient.KubeInformer().Core().V1().Endpoints())
 	case EndpointSliceOnly:
 		c.endpoints = newEndpointSliceController(c, kubeClient.KubeInformer().Discovery().V1beta1().EndpointSlices())
+	case EndpointsAndManualEndpointSlices:
+		c.endpoints = newMergedEndpointsController(c, kubeClient.KubeInformer().Core().V1().Endpoints(),
+			kubeClient.KubeInformer().Discovery().V1beta1().EndpointSlices())
 	}
+	log.Infof("Kubernetes service registry %q using endpoint mode %s", c.clusterID, c.endpointMode)
 
 	// This is for getting the node IPs of a selected set of nodes
 	c.nodeInformer = kubeClient.KubeInformer().Core().V1().Nodes().Informer()
 	c.nodeLister = kubeClient.KubeInformer().Core().V1().Nodes().Lister()
-	registerHandlers(c.nodeInformer, c.queue, "Nodes", c.onNodeEvent, nil)
+	if !c.nodePortGatewaysDisabled {
+		registerHandlers(c.nodeInformer, c.queue, "Nodes", c.onNodeEvent, nil)
+	}
 
 	c.pods = newPodCache(c, kubeClient.KubeInformer().Core().V1().Pods(), func(key string) {
 		item, exists, err := c.endpoints.getInformer().GetStore().GetByKey(key)
@@ -311,6 +826,9 @@ func NewController(kubeClient kubelib.Client, options Options) *Controller {
 		})
 	})
 	registerHandlers(c.pods.informer, c.queue, "Pods", c.pods.onEvent, nil)
+	if c.detectOverlappingSelectors {
+		c.AppendPodHandler(c.onPodSelectorOverlapEvent)
+	}
 
 	return c
 }
@@ -319,6 +837,11 @@ func (c *Controller) Provider() serviceregistry.ProviderID {
 	return serviceregistry.Kubernetes
 }
 
+// EndpointMode returns the source the controller uses for endpoint information.
+func (c *Controller) EndpointMode() EndpointMode {
+	return c.endpointMode
+}
+
 func (c *Controller) Cluster() string {
 	return c.clusterID
 }
@@ -327,6 +850,94 @@ func (c *Controller) cidrRanger() cidranger.Ranger {
 	return c.ranger
 }
 
+// serviceNetwork returns the network forced on the service by the ServiceNetworkAnnotation, if any.
+func (c *Controller) serviceNetwork(hostname host.Name) string {
+	c.RLock()
+	defer c.RUnlock()
+	return c.serviceNetworks[hostname]
+}
+
+// skipPodLookupByIP returns true if the endpoints of the service that do not reference a pod are built
+// without a pod, see Options.ManualEndpointsOnly.
+func (c *Controller) skipPodLookupByIP(hostname host.Name) bool {
+	return c.manualEndpointsOnly && c.serviceWithoutSelector(hostname)
+}
+
+// serviceWithoutSelector returns true if the service is known and has no selector, so that its endpoints
+// are managed manually rather than derived from pods.
+func (c *Controller) serviceWithoutSelector(hostname host.Name) bool {
+	c.RLock()
+	svc := c.servicesMap[hostname]
+	c.RUnlock()
+	if svc == nil {
+		return false
+	}
+	k8sSvc, err := c.serviceLister.Services(svc.Attributes.Namespace).Get(svc.Attributes.Name)
+	if err != nil || k8sSvc == nil {
+		return false
+	}
+	return len(k8sSvc.Spec.Selector) == 0 && k8sSvc.Spec.Type != v1.ServiceTypeExternalName
+}
+
+func (c *Controller) multiNetworkMatchPolicy() MultiNetworkMatchPolicy {
+	return c.networkMatchPolicy
+}
+
+func (c *Controller) endpointLabelAllowlist() map[string]struct{} {
+	return c.endpointLabels
+}
+
+// spreadTopologyLabels returns the labels of the node of the pod for the topology keys of its topology
+// spread constraints, if enabled.
+func (c *Controller) spreadTopologyLabels(pod *v1.Pod) labels.Instance {
+	if !c.spreadConstraintLabels || pod == nil || len(pod.Spec.TopologySpreadConstraints) == 0 || pod.Spec.NodeName == "" {
+		return nil
+	}
+	node, err := c.nodeLister.Get(pod.Spec.NodeName)
+	if err != nil {
+		return nil
+	}
+	out := make(labels.Instance)
+	for _, constraint := range pod.Spec.TopologySpreadConstraints {
+		if v, f := node.Labels[constraint.TopologyKey]; f {
+			out[constraint.TopologyKey] = v
+		}
+	}
+	return out
+}
+
+// namespaceExcluded returns true if nothing is discovered in the namespace.
+func (c *Controller) namespaceExcluded(namespace string) bool {
+	_, f := c.excludedNamespaces[namespace]
+	return f
+}
+
+// podNamespaceDiscovered returns true if pods of the namespace are tracked.
+func (c *Controller) podNamespaceDiscovered(namespace string) bool {
+	if c.namespaceExcluded(namespace) {
+		return false
+	}
+	return c.podDiscoveryFilter == nil || c.podDiscoveryFilter(namespace)
+}
+
+// podFilteredOut returns true if the endpoint target is a pod in a namespace that is not tracked.
+func (c *Controller) podFilteredOut(targetRef *v1.ObjectReference) bool {
+	return targetRef != nil && targetRef.Kind == "Pod" && !c.podNamespaceDiscovered(targetRef.Namespace)
+}
+
+func (c *Controller) rewriteEndpointAddress(address string, pod *v1.Pod) string {
+	if c.hostNetworkNodeIP && pod != nil && pod.Spec.HostNetwork && pod.Status.HostIP != "" {
+		address = pod.Status.HostIP
+	}
+	if c.endpointAddressRewriter == nil {
+		return address
+	}
+	if rewritten := c.endpointAddressRewriter(address, pod); rewritten != "" {
+		return rewritten
+	}
+	return address
+}
+
 func (c *Controller) defaultNetwork() string {
 	if c.networkForRegistry != "" {
 		return c.networkForRegistry
@@ -335,6 +946,8 @@ func (c *Controller) defaultNetwork() string {
 }
 
 func (c *Controller) Cleanup() error {
+	// the coalesced push may still hold updates for the services of the cluster
+	c.flushFullPush()
 	// TODO(landow) do we need to cleanup other things besides endpoint shards?
 	svcs, err := c.serviceLister.List(klabels.NewSelector())
 	if err != nil {
@@ -363,19 +976,133 @@ func (c *Controller) onServiceEvent(curr interface{}, event model.Event) error {
 		}
 	}
 
+	if c.namespaceExcluded(svc.Namespace) {
+		return nil
+	}
+
 	log.Debugf("Handle event %s for service %s in namespace %s", event, svc.Name, svc.Namespace)
 
+	if c.detectOverlappingSelectors {
+		c.recheckSelectorOverlaps(svc)
+	}
+
+	if c.serviceDeleteGracePeriod > 0 || c.nsTerminationGracePeriod > 0 {
+		if event == model.EventDelete {
+			if gracePeriod := c.serviceDeleteGracePeriodFor(svc); gracePeriod > 0 {
+				c.scheduleServiceDelete(svc, gracePeriod)
+				return nil
+			}
+		} else {
+			c.cancelServiceDelete(kube.ServiceHostname(svc.Name, svc.Namespace, c.domainSuffix))
+		}
+	}
+	return c.processServiceEvent(svc, event)
+}
+
+// serviceDeleteGracePeriodFor returns how long the removal of the deleted service is delayed. Services of
+// terminating namespaces are marked as draining when nsTerminationGracePeriod applies, and the service
+// handlers notified of the change.
+func (c *Controller) serviceDeleteGracePeriodFor(svc *v1.Service) time.Duration {
+	if c.nsTerminationGracePeriod == 0 || !c.namespaceTerminating(svc.Namespace) {
+		return c.serviceDeleteGracePeriod
+	}
+	hostname := kube.ServiceHostname(svc.Name, svc.Namespace, c.domainSuffix)
+	log.Infof("Draining service %s of terminating namespace %s for %v", hostname, svc.Namespace, c.nsTerminationGracePeriod)
+	c.RLock()
+	prev := c.servicesMap[hostname]
+	c.RUnlock()
+	if prev == nil {
+		return c.nsTerminationGracePeriod
+	}
+	prev.Mutex.Lock()
+	changed := !prev.Attributes.Draining
+	prev.Attributes.Draining = true
+	prev.Mutex.Unlock()
+	if changed {
+		for _, f := range c.serviceHandlers {
+			f(prev, model.EventUpdate)
+		}
+	}
+	return c.nsTerminationGracePeriod
+}
+
+// namespaceTerminating returns true if the namespace is being deleted.
+func (c *Controller) namespaceTerminating(namespace string) bool {
+	ns, err := c.namespaceLister.Get(namespace)
+	if err != nil {
+		// the namespace may already be gone
+		return errors.IsNotFound(err)
+	}
+	return ns.Status.Phase == v1.NamespaceTerminating || ns.DeletionTimestamp != nil
+}
+
+// scheduleServiceDelete removes the service once the grace period elapses, unless it is recreated before.
+func (c *Controller) scheduleServiceDelete(svc *v1.Service, gracePeriod time.Duration) {
+	hostname := kube.ServiceHostname(svc.Name, svc.Namespace, c.domainSuffix)
+	log.Debugf("Deferring delete of service %s by %v", hostname, gracePeriod)
+	c.Lock()
+	defer c.Unlock()
+	if timer := c.pendingServiceDeletes[hostname]; timer != nil {
+		timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(gracePeriod, func() {
+		c.queue.Push(func() error {
+			c.Lock()
+			// the delete was cancelled or superseded in the meantime
+			if c.pendingServiceDeletes[hostname] != timer {
+				c.Unlock()
+				return nil
+			}
+			delete(c.pendingServiceDeletes, hostname)
+			c.Unlock()
+			if _, err := c.serviceLister.Services(svc.Namespace).Get(svc.Name); err == nil {
+				return nil
+			}
+			return c.processServiceEvent(svc, model.EventDelete)
+		})
+	})
+	c.pendingServiceDeletes[hostname] = timer
+}
+
+// cancelServiceDelete cancels the pending delete of a service, if any.
+func (c *Controller) cancelServiceDelete(hostname host.Name) {
+	c.Lock()
+	defer c.Unlock()
+	if timer := c.pendingServiceDeletes[hostname]; timer != nil {
+		timer.Stop()
+		delete(c.pendingServiceDeletes, hostname)
+		log.Debugf("Service %s recreated within the delete grace period", hostname)
+	}
+}
+
+func (c *Controller) processServiceEvent(svc *v1.Service, event model.Event) error {
+	if event != model.EventDelete && len(svc.Spec.Ports) == 0 {
+		switch c.servicesWithoutPortsPolicy {
+		case SkipServicesWithoutPorts:
+			log.Warnf("Skipping service %s/%s without ports", svc.Namespace, svc.Name)
+			// the service may have been registered before losing its ports
+			event = model.EventDelete
+		case CountServicesWithoutPorts:
+			servicesNoPorts.With(clusterTag.Value(c.clusterID)).Increment()
+		}
+	}
 	svcConv := kube.ConvertService(*svc, c.domainSuffix, c.clusterID)
+	convertServiceCalls.With(clusterTag.Value(c.clusterID)).Increment()
+	if c.strictServiceValidation && event != model.EventDelete {
+		if err := validateTargetPortProtocols(svc, svcConv); err != nil {
+			log.Errorf("service %s/%s failed validation: %v", svc.Namespace, svc.Name, err)
+			serviceConflicts.With(clusterTag.Value(c.clusterID)).Increment()
+			svcConv.Attributes.ValidationError = err.Error()
+		}
+	}
+	svcConv.Attributes.FromConfigCluster = c.configCluster
+	var prevConv *model.Service
 	switch event {
 	case model.EventDelete:
-		c.Lock()
-		delete(c.servicesMap, svcConv.Hostname)
-		delete(c.nodeSelectorsForServices, svcConv.Hostname)
-		delete(c.externalNameSvcInstanceMap, svcConv.Hostname)
-		delete(c.networkGateways, svcConv.Hostname)
-		c.Unlock()
+		c.deleteService(svcConv.Hostname)
 	default:
-		if isNodePortGatewayService(svc) {
+		if !c.nodePortGatewaysDisabled && isNodePortGatewayService(svc) {
 			// We need to know which services are using node selectors because during node events,
 			// we have to update all the node port services accordingly.
 			nodeSelector := getNodeSelectorsForService(svc)
@@ -390,7 +1117,17 @@ func (c *Controller) onServiceEvent(curr interface{}, event model.Event) error {
 		// instance conversion is only required when service is added/updated.
 		instances := kube.ExternalNameServiceInstances(svc, svcConv)
 		c.Lock()
+		if _, f := c.gatewayRouteServices[svcConv.Hostname]; f {
+			svcConv.Attributes.GatewayRouteReferenced = true
+		}
+		prevConv = c.servicesMap[svcConv.Hostname]
 		c.servicesMap[svcConv.Hostname] = svcConv
+		c.serviceLastUpdate[svcConv.Hostname] = time.Now()
+		if nw := svc.Annotations[kube.ServiceNetworkAnnotation]; nw != "" {
+			c.serviceNetworks[svcConv.Hostname] = nw
+		} else {
+			delete(c.serviceNetworks, svcConv.Hostname)
+		}
 		if len(instances) > 0 {
 			c.externalNameSvcInstanceMap[svcConv.Hostname] = instances
 		}
@@ -399,16 +1136,19 @@ func (c *Controller) onServiceEvent(curr interface{}, event model.Event) error {
 
 	// We also need to update when the Service changes. For Kubernetes, a service change will result in Endpoint updates,
 	// but workload entries will also need to be updated.
+	var endpoints []*model.IstioEndpoint
 	if event == model.EventAdd || event == model.EventUpdate {
 		// Build IstioEndpoints
-		endpoints := c.endpoints.buildIstioEndpointsWithService(svc.Name, svc.Namespace, svcConv.Hostname)
+		endpoints = c.endpoints.buildIstioEndpointsWithService(svc.Name, svc.Namespace, svcConv.Hostname)
 		if features.EnableK8SServiceSelectWorkloadEntries {
 			fep := c.collectWorkloadInstanceEndpoints(svcConv)
 			endpoints = append(endpoints, fep...)
 		}
+		c.updateEndpointsWithoutLocality(svcConv.Hostname, endpoints)
+		c.updateObservedNetworks(svcConv.Hostname, endpoints)
 
-		if len(endpoints) > 0 {
-			c.xdsUpdater.EDSCacheUpdate(c.clusterID, string(svcConv.Hostname), svc.Namespace, endpoints)
+		if len(endpoints) > 0 && !c.edsUnchanged(svcConv.Hostname, endpoints) {
+			c.edsCacheUpdate(svcConv.Hostname, svc.Namespace, endpoints)
 		}
 	}
 
@@ -417,11 +1157,122 @@ func (c *Controller) onServiceEvent(curr interface{}, event model.Event) error {
 	for _, f := range c.serviceHandlers {
 		f(svcConv, event)
 	}
+	// The EDS update above cannot be tagged with the selector change: XDSUpdater.EDSUpdate and EDSCacheUpdate
+	// take no push reason, and the endpoints of the new selector only arrive with the following Endpoints
+	// event. Selector changes are signaled to the selector handlers instead.
+	if event == model.EventUpdate && prevConv != nil && selectorChanged(prevConv, svcConv) {
+		log.Debugf("Selector changed for service %s in namespace %s", svc.Name, svc.Namespace)
+		for _, f := range c.serviceSelectorHandlers {
+			f(prevConv, svcConv)
+		}
+	}
+
+	c.onServiceAliasEvent(svc, event, endpoints)
+
+	return nil
+}
+
+// onServiceAliasEvent registers the service under each of the additional domain suffixes, sharing the
+// endpoints of the primary hostname.
+func (c *Controller) onServiceAliasEvent(svc *v1.Service, event model.Event, endpoints []*model.IstioEndpoint) {
+	for _, suffix := range c.additionalDomainSuffixes {
+		alias := kube.ConvertService(*svc, suffix, c.clusterID)
+		alias.Attributes.FromConfigCluster = c.configCluster
+		c.Lock()
+		if event == model.EventDelete {
+			delete(c.servicesMap, alias.Hostname)
+			delete(c.edsHashes, alias.Hostname)
+			delete(c.edsPushedHashes, alias.Hostname)
+		} else {
+			c.servicesMap[alias.Hostname] = alias
+		}
+		c.Unlock()
+
+		if len(endpoints) > 0 && !c.edsUnchanged(alias.Hostname, endpoints) {
+			c.edsCacheUpdate(alias.Hostname, svc.Namespace, endpoints)
+		}
+		c.xdsUpdater.SvcUpdate(c.clusterID, string(alias.Hostname), svc.Namespace, event)
+		for _, f := range c.serviceHandlers {
+			f(alias, event)
+		}
+	}
+}
+
+// aliasHostnames returns the hostnames of the service under the additional domain suffixes.
+func (c *Controller) aliasHostnames(name, namespace string) []host.Name {
+	if len(c.additionalDomainSuffixes) == 0 {
+		return nil
+	}
+	out := make([]host.Name, 0, len(c.additionalDomainSuffixes))
+	for _, suffix := range c.additionalDomainSuffixes {
+		out = append(out, kube.ServiceHostname(name, namespace, suffix))
+	}
+	return out
+}
+
+// selectorChanged reports whether the workload selector of the service differs between prev and curr.
+func selectorChanged(prev, curr *model.Service) bool {
+	if len(prev.Attributes.LabelSelectors) == 0 && len(curr.Attributes.LabelSelectors) == 0 {
+		return false
+	}
+	return !labels.Instance(prev.Attributes.LabelSelectors).Equals(curr.Attributes.LabelSelectors)
+}
+
+// deleteService removes all state associated with the service hostname from the controller.
+func (c *Controller) deleteService(hostname host.Name) {
+	c.Lock()
+	delete(c.servicesMap, hostname)
+	delete(c.nodeSelectorsForServices, hostname)
+	delete(c.externalNameSvcInstanceMap, hostname)
+	delete(c.networkGateways, hostname)
+	delete(c.serviceNetworks, hostname)
+	delete(c.serviceLastUpdate, hostname)
+	// the endpoints of a re-created service must be sent again
+	delete(c.edsHashes, hostname)
+	delete(c.edsPushedHashes, hostname)
+	c.Unlock()
+}
+
+// EvictService forcibly removes a service from the controller and notifies handlers of its deletion.
+// This is an operational tool to recover from missed delete events. Unless force is set, a service
+// that still exists in the informer cache will not be evicted.
+func (c *Controller) EvictService(hostname host.Name, force bool) error {
+	c.RLock()
+	svc := c.servicesMap[hostname]
+	c.RUnlock()
+	if svc == nil {
+		return fmt.Errorf("service %s not found", hostname)
+	}
+	if !force {
+		if _, err := c.serviceLister.Services(svc.Attributes.Namespace).Get(svc.Attributes.Name); err == nil {
+			return fmt.Errorf("service %s still exists in the informer, refusing to evict", hostname)
+		}
+	}
 
+	log.Infof("Evicting service %s from cluster %s", hostname, c.clusterID)
+	c.deleteService(hostname)
+	c.xdsUpdater.SvcUpdate(c.clusterID, string(hostname), svc.Attributes.Namespace, model.EventDelete)
+	for _, f := range c.serviceHandlers {
+		f(svc, model.EventDelete)
+	}
 	return nil
 }
 
+// nodeSelectorMatchChangedLocked returns true if any nodePort gateway service selects a node with only
+// one of the two label sets.
+func (c *Controller) nodeSelectorMatchChangedLocked(prev, curr labels.Instance) bool {
+	for _, selector := range c.nodeSelectorsForServices {
+		if selector.SubsetOf(prev) != selector.SubsetOf(curr) {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Controller) onNodeEvent(obj interface{}, event model.Event) error {
+	if c.nodePortGatewaysDisabled {
+		return nil
+	}
 	node, ok := obj.(*v1.Node)
 	if !ok {
 		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
@@ -442,7 +1293,7 @@ func (c *Controller) onNodeEvent(obj interface{}, event model.Event) error {
 		delete(c.nodeInfoMap, node.Name)
 		c.Unlock()
 	} else {
-		k8sNode := kubernetesNode{labels: node.Labels}
+		k8sNode := kubernetesNode{labels: node.Labels, unschedulable: isNodeUnschedulable(node)}
 		for _, address := range node.Status.Addresses {
 			if address.Type == v1.NodeExternalIP && address.Address != "" {
 				k8sNode.address = address.Address
@@ -459,20 +1310,51 @@ func (c *Controller) onNodeEvent(obj interface{}, event model.Event) error {
 		currentNode, exists := c.nodeInfoMap[node.Name]
 		if !exists || !nodeEquals(currentNode, k8sNode) {
 			c.nodeInfoMap[node.Name] = k8sNode
-			updatedNeeded = true
+			// a label change only matters if it changes which node selectors match the node
+			updatedNeeded = !exists || currentNode.address != k8sNode.address ||
+				c.nodeSelectorMatchChangedLocked(currentNode.labels, k8sNode.labels) ||
+				(c.skipUnschedulableNodes && currentNode.unschedulable != k8sNode.unschedulable)
 		}
 		c.Unlock()
 	}
 
 	// update all related services
 	if updatedNeeded && c.updateServiceNodePortAddresses() {
-		c.xdsUpdater.ConfigUpdate(&model.PushRequest{
+		c.fullPush(&model.PushRequest{
 			Full: true,
 		})
 	}
 	return nil
 }
 
+// fullPush triggers the full push, or merges it into the pending one if pushes are coalesced.
+func (c *Controller) fullPush(req *model.PushRequest) {
+	if c.fullPushWindow <= 0 {
+		c.xdsUpdater.ConfigUpdate(req)
+		return
+	}
+	c.fullPushMutex.Lock()
+	defer c.fullPushMutex.Unlock()
+	if c.pendingFullPush != nil {
+		c.pendingFullPush = c.pendingFullPush.Merge(req)
+		fullPushesCoalesced.With(clusterTag.Value(c.clusterID)).Increment()
+		return
+	}
+	c.pendingFullPush = req
+	time.AfterFunc(c.fullPushWindow, c.flushFullPush)
+}
+
+// flushFullPush triggers the pending coalesced full push, if any, without waiting for the end of the window.
+func (c *Controller) flushFullPush() {
+	c.fullPushMutex.Lock()
+	pending := c.pendingFullPush
+	c.pendingFullPush = nil
+	c.fullPushMutex.Unlock()
+	if pending != nil {
+		c.xdsUpdater.ConfigUpdate(pending)
+	}
+}
+
 // FilterOutFunc func for filtering out objects during update callback
 type FilterOutFunc func(old, cur interface{}) bool
 
@@ -544,6 +1426,7 @@ func tryGetLatestObject(informer cache.SharedIndexInformer, obj interface{}) int
 // HasSynced returns true after the initial state synchronization
 func (c *Controller) HasSynced() bool {
 	if (c.nsInformer != nil && !c.nsInformer.HasSynced()) ||
+		(c.namespaceInformer != nil && !c.namespaceInformer.HasSynced()) ||
 		!c.serviceInformer.HasSynced() ||
 		!c.endpoints.HasSynced() ||
 		!c.pods.informer.HasSynced() ||
@@ -556,6 +1439,14 @@ func (c *Controller) HasSynced() bool {
 		if err := c.SyncAll(); err != nil {
 			log.Errorf("one or more errors force-syncing resources: %v", err)
 		}
+		c.Lock()
+		c.initialSyncDone = true
+		handlers := c.initialSyncHandlers
+		c.initialSyncHandlers = nil
+		c.Unlock()
+		for _, f := range handlers {
+			f()
+		}
 	})
 
 	return true
@@ -566,6 +1457,12 @@ func (c *Controller) HasSynced() bool {
 // This can cause great performance cost in multi clusters scenario.
 // Maybe just sync the cache and trigger one push at last.
 func (c *Controller) SyncAll() error {
+	return c.syncAll(false)
+}
+
+// syncAll implements SyncAll. A resync skips the services which are unchanged since they were last processed,
+// so that their handlers are not notified again.
+func (c *Controller) syncAll(resync bool) error {
 	var err *multierror.Error
 
 	if c.nsInformer != nil {
@@ -583,36 +1480,155 @@ func (c *Controller) SyncAll() error {
 
 	services := c.serviceInformer.GetStore().List()
 	log.Debugf("initializing %d services", len(services))
-	for _, s := range services {
+	for _, s := range interleaveByNamespace(services, c.syncBatchSize) {
+		if svc, ok := s.(*v1.Service); ok && resync && c.serviceUnchanged(svc) {
+			continue
+		}
+		if werr := c.waitSyncLimiter(resync); werr != nil {
+			err = multierror.Append(err, werr)
+			break
+		}
 		err = multierror.Append(err, c.onServiceEvent(s, model.EventAdd))
 	}
+	c.detectStaleServices(services)
+
+	err = multierror.Append(err, c.syncPods(resync))
+	err = multierror.Append(err, c.syncEndpoints(resync))
+
+	out := multierror.Flatten(err.ErrorOrNil())
+	var syncErrors []error
+	if merr, ok := out.(*multierror.Error); ok {
+		syncErrors = merr.Errors
+	} else if out != nil {
+		syncErrors = []error{out}
+	}
+	c.Lock()
+	c.syncErrors = syncErrors
+	c.Unlock()
+	return out
+}
+
+// serviceUnchanged returns true if the service converts to the one already in servicesMap. Attributes set by
+// the controller after the conversion, such as the addresses of node port gateways, are kept up to date by
+// their own events and are not compared.
+func (c *Controller) serviceUnchanged(svc *v1.Service) bool {
+	conv := kube.ConvertService(*svc, c.domainSuffix, c.clusterID)
+	c.RLock()
+	prev := c.servicesMap[conv.Hostname]
+	network, hasNetwork := c.serviceNetworks[conv.Hostname]
+	c.RUnlock()
+	if prev == nil || network != svc.Annotations[kube.ServiceNetworkAnnotation] ||
+		hasNetwork != (svc.Annotations[kube.ServiceNetworkAnnotation] != "") {
+		return false
+	}
+
+	prev.Mutex.RLock()
+	defer prev.Mutex.RUnlock()
+	if prev.Address != conv.Address || prev.Resolution != conv.Resolution || prev.MeshExternal != conv.MeshExternal ||
+		!reflect.DeepEqual(prev.Ports, conv.Ports) || !reflect.DeepEqual(prev.ServiceAccounts, conv.ServiceAccounts) {
+		return false
+	}
+	if !reflect.DeepEqual(prev.Attributes.Labels, conv.Attributes.Labels) ||
+		!reflect.DeepEqual(prev.Attributes.ExportTo, conv.Attributes.ExportTo) ||
+		!reflect.DeepEqual(prev.Attributes.LabelSelectors, conv.Attributes.LabelSelectors) ||
+		!reflect.DeepEqual(prev.Attributes.ClusterExternalPorts, conv.Attributes.ClusterExternalPorts) {
+		return false
+	}
+	if !isNodePortGatewayService(svc) &&
+		!reflect.DeepEqual(prev.Attributes.ClusterExternalAddresses, conv.Attributes.ClusterExternalAddresses) {
+		return false
+	}
+	return true
+}
+
+// SyncErrors returns the errors of the last full sync, so that health checks can tell a sync that succeeded
+// from one that completed with errors. It returns nil if the last sync succeeded, or none has run yet.
+func (c *Controller) SyncErrors() []error {
+	c.RLock()
+	defer c.RUnlock()
+	if len(c.syncErrors) == 0 {
+		return nil
+	}
+	return append([]error(nil), c.syncErrors...)
+}
+
+// detectStaleServices logs the services of the registry which are missing from the listed services, and
+// evicts them if evictStaleServices is set. Services retained for a delete grace period are not stale.
+func (c *Controller) detectStaleServices(services []interface{}) {
+	listed := make(map[string]struct{}, len(services))
+	for _, obj := range services {
+		if svc, ok := obj.(*v1.Service); ok {
+			listed[kube.KeyFunc(svc.Name, svc.Namespace)] = struct{}{}
+		}
+	}
 
-	err = multierror.Append(err, c.syncPods())
-	err = multierror.Append(err, c.syncEndpoints())
+	var stale []host.Name
+	c.RLock()
+	for hostname, svc := range c.servicesMap {
+		if _, f := listed[kube.KeyFunc(svc.Attributes.Name, svc.Attributes.Namespace)]; f {
+			continue
+		}
+		primary := kube.ServiceHostname(svc.Attributes.Name, svc.Attributes.Namespace, c.domainSuffix)
+		if _, f := c.pendingServiceDeletes[primary]; f {
+			continue
+		}
+		stale = append(stale, hostname)
+	}
+	c.RUnlock()
+	staleServices.With(clusterTag.Value(c.clusterID)).Record(float64(len(stale)))
 
-	return multierror.Flatten(err.ErrorOrNil())
+	sort.Slice(stale, func(i, j int) bool { return stale[i] < stale[j] })
+	for _, hostname := range stale {
+		if !c.evictStaleServices {
+			log.Warnf("Service %s of cluster %s is missing from the informer, a delete event may have been missed",
+				hostname, c.clusterID)
+			continue
+		}
+		if err := c.EvictService(hostname, false); err != nil {
+			log.Warnf("Failed to evict stale service %s: %v", hostname, err)
+		}
+	}
 }
 
-func (c *Controller) syncPods() error {
+func (c *Controller) syncPods(resync bool) error {
 	var err *multierror.Error
 	pods := c.pods.informer.GetStore().List()
 	log.Debugf("initializing %d pods", len(pods))
-	for _, s := range pods {
+	for _, s := range interleaveByNamespace(pods, c.syncBatchSize) {
+		if werr := c.waitSyncLimiter(resync); werr != nil {
+			return multierror.Append(err, werr).ErrorOrNil()
+		}
 		err = multierror.Append(err, c.pods.onEvent(s, model.EventAdd))
 	}
 	return err.ErrorOrNil()
 }
 
-func (c *Controller) syncEndpoints() error {
+func (c *Controller) syncEndpoints(resync bool) error {
 	var err *multierror.Error
 	endpoints := c.endpoints.getInformer().GetStore().List()
 	log.Debugf("initializing%d endpoints", len(endpoints))
-	for _, s := range endpoints {
+	for _, s := range interleaveByNamespace(endpoints, c.syncBatchSize) {
+		if werr := c.waitSyncLimiter(resync); werr != nil {
+			return multierror.Append(err, werr).ErrorOrNil()
+		}
 		err = multierror.Append(err, c.endpoints.onEvent(s, model.EventAdd))
 	}
 	return err.ErrorOrNil()
 }
 
+// waitSyncLimiter blocks until the next object of a full sync may be processed, and returns an error if the
+// controller stopped in the meantime. Periodic resyncs run on the event queue and are not rate limited, as
+// they would otherwise hold up the processing of all other events.
+func (c *Controller) waitSyncLimiter(resync bool) error {
+	if c.syncLimiter == nil || resync {
+		return nil
+	}
+	if err := c.syncLimiter.Wait(c.syncCtx); err != nil {
+		return fmt.Errorf("full sync of cluster %s aborted: %v", c.clusterID, err)
+	}
+	return nil
+}
+
 // Run all controllers until a signal is received
 func (c *Controller) Run(stop <-chan struct{}) {
 	if c.networksWatcher != nil {
@@ -624,16 +1640,137 @@ func (c *Controller) Run(stop <-chan struct{}) {
 	}
 	// TODO(https://github.com/kubernetes/kubernetes/issues/95262) remove this
 	time.Sleep(time.Millisecond * 5)
+	go func() {
+		<-stop
+		c.cancelSync()
+	}()
 	cache.WaitForCacheSync(stop, c.HasSynced)
+	if c.fullResyncPeriod > 0 {
+		go c.runFullResync(stop)
+	}
+	go c.runQueueDepthSampler(stop)
 	c.queue.Run(stop)
 	log.Infof("Controller terminated")
 }
 
+// runFullResync periodically queues a SyncAll until stop is closed. The resync is pushed onto the
+// queue, so it never runs concurrently with the regular event handlers.
+func (c *Controller) runFullResync(stop <-chan struct{}) {
+	timer := time.NewTimer(jitter(c.fullResyncPeriod, c.fullResyncJitter))
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+			c.queue.Push(func() error {
+				log.Infof("Running periodic full resync for cluster %s", c.clusterID)
+				if err := c.syncAll(true); err != nil {
+					log.Errorf("one or more errors during periodic full resync: %v", err)
+				}
+				return nil
+			})
+			timer.Reset(jitter(c.fullResyncPeriod, c.fullResyncJitter))
+		}
+	}
+}
+
+// jitter returns d randomly adjusted by up to factor*d in either direction. A non-positive factor
+// returns d unchanged.
+func jitter(d time.Duration, factor float64) time.Duration {
+	if factor <= 0 {
+		return d
+	}
+	return d + time.Duration((rand.Float64()*2-1)*factor*float64(d))
+}
+
+// runQueueDepthSampler periodically records the depth of the event queue until stop is closed.
+func (c *Controller) runQueueDepthSampler(stop <-chan struct{}) {
+	period := c.queueDepthSamplePeriod
+	if period <= 0 {
+		period = defaultQueueDepthSamplePeriod
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			c.recordQueueDepth()
+		}
+	}
+}
+
+// recordQueueDepth samples the event queue depth and updates the depth, high-watermark and oldest age metrics.
+func (c *Controller) recordQueueDepth() {
+	depth := c.queue.Len()
+	if tq, ok := c.queue.(*timedQueue); ok {
+		queueOldestAge.With(clusterTag.Value(c.clusterID)).Record(tq.oldestAge().Seconds())
+	}
+	c.Lock()
+	if depth > c.queueDepthHighWatermark {
+		c.queueDepthHighWatermark = depth
+	}
+	highWatermark := c.queueDepthHighWatermark
+	c.Unlock()
+
+	queueDepth.With(clusterTag.Value(c.clusterID)).Record(float64(depth))
+	queueDepthHighWatermark.With(clusterTag.Value(c.clusterID)).Record(float64(highWatermark))
+	if c.queueDepthWarningThreshold > 0 && depth > c.queueDepthWarningThreshold {
+		log.Warnf("Event queue for cluster %s has %d pending events, exceeding the threshold of %d",
+			c.clusterID, depth, c.queueDepthWarningThreshold)
+	}
+}
+
+// timedQueue records when tasks are pushed, to track how long the oldest task has been waiting to run.
+type timedQueue struct {
+	queue.Instance
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]time.Time
+}
+
+func newTimedQueue(q queue.Instance) *timedQueue {
+	return &timedQueue{Instance: q, pending: make(map[uint64]time.Time)}
+}
+
+func (q *timedQueue) Push(task queue.Task) {
+	q.mu.Lock()
+	id := q.nextID
+	q.nextID++
+	q.pending[id] = time.Now()
+	q.mu.Unlock()
+	q.Instance.Push(func() error {
+		q.mu.Lock()
+		delete(q.pending, id)
+		q.mu.Unlock()
+		return task()
+	})
+}
+
+// oldestAge returns how long the oldest task that has not started yet has been queued, or zero if there is none.
+func (q *timedQueue) oldestAge() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var oldest time.Time
+	for _, pushed := range q.pending {
+		if oldest.IsZero() || pushed.Before(oldest) {
+			oldest = pushed
+		}
+	}
+	if oldest.IsZero() {
+		return 0
+	}
+	return time.Since(oldest)
+}
+
 // Stop the controller. Only for tests, to simplify the code (defer c.Stop())
 func (c *Controller) Stop() {
 	if c.stop != nil {
 		close(c.stop)
 	}
+	c.flushFullPush()
 }
 
 // Services implements a service catalog operation
@@ -649,6 +1786,37 @@ func (c *Controller) Services() ([]*model.Service, error) {
 	return out, nil
 }
 
+// ServicesByProvider returns the services backed by the given registry provider, sorted by hostname.
+// All services of this controller are Kubernetes services, the provider is matched against the registry
+// recorded on each service so that aggregate code can treat all registries alike.
+func (c *Controller) ServicesByProvider(p serviceregistry.ProviderID) []*model.Service {
+	c.RLock()
+	out := make([]*model.Service, 0)
+	for _, svc := range c.servicesMap {
+		if svc.Attributes.ServiceRegistry == string(p) {
+			out = append(out, svc)
+		}
+	}
+	c.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Hostname < out[j].Hostname })
+	return out
+}
+
+// ServicesByNamespace returns the services known to the registry grouped by namespace, each sorted by hostname.
+func (c *Controller) ServicesByNamespace() map[string][]*model.Service {
+	out := make(map[string][]*model.Service)
+	c.RLock()
+	for _, svc := range c.servicesMap {
+		out[svc.Attributes.Namespace] = append(out[svc.Attributes.Namespace], svc)
+	}
+	c.RUnlock()
+	for _, services := range out {
+		services := services
+		sort.Slice(services, func(i, j int) bool { return services[i].Hostname < services[j].Hostname })
+	}
+	return out
+}
+
 // GetService implements a service catalog operation by hostname specified.
 func (c *Controller) GetService(hostname host.Name) (*model.Service, error) {
 	c.RLock()
@@ -657,25 +1825,194 @@ func (c *Controller) GetService(hostname host.Name) (*model.Service, error) {
 	return svc, nil
 }
 
+// ExternalNameServices returns the ExternalName services known to the registry, sorted by hostname.
+func (c *Controller) ExternalNameServices() []*model.Service {
+	c.RLock()
+	out := make([]*model.Service, 0, len(c.externalNameSvcInstanceMap))
+	for hostname := range c.externalNameSvcInstanceMap {
+		if svc := c.servicesMap[hostname]; svc != nil {
+			out = append(out, svc)
+		}
+	}
+	c.RUnlock()
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Hostname < out[j].Hostname
+	})
+	return out
+}
+
+// MeshExternalServices returns the services known to the registry that are marked as mesh external, sorted
+// by hostname. Unlike ExternalNameServices, this is based on the model flag rather than the service type.
+func (c *Controller) MeshExternalServices() []*model.Service {
+	c.RLock()
+	out := make([]*model.Service, 0)
+	for _, svc := range c.servicesMap {
+		if svc.MeshExternal {
+			out = append(out, svc)
+		}
+	}
+	c.RUnlock()
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Hostname < out[j].Hostname
+	})
+	return out
+}
+
+// ServicesSelectingPod returns the services whose selector matches the pod, sorted by hostname. This is the
+// inverse of endpoint building, to explain why a pod is an endpoint of a service. It returns nil for unknown pods.
+func (c *Controller) ServicesSelectingPod(namespace, podName string) []*model.Service {
+	item, exists, err := c.pods.informer.GetStore().GetByKey(kube.KeyFunc(podName, namespace))
+	if !exists || err != nil {
+		return nil
+	}
+	pod, ok := item.(*v1.Pod)
+	if !ok {
+		return nil
+	}
+	services, err := getPodServices(c.serviceLister, pod)
+	if err != nil {
+		log.Debugf("services selecting pod %s/%s => error %v", namespace, podName, err)
+		return nil
+	}
+	var out []*model.Service
+	c.RLock()
+	for _, svc := range services {
+		if s := c.servicesMap[kube.ServiceHostname(svc.Name, svc.Namespace, c.domainSuffix)]; s != nil {
+			out = append(out, s)
+		}
+	}
+	c.RUnlock()
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Hostname < out[j].Hostname
+	})
+	return out
+}
+
+// CachedPods returns the pods of the namespace currently held by the pod cache, sorted by name. Comparing
+// them with the pods of the API server shows whether the cache drifted.
+func (c *Controller) CachedPods(namespace string) []types.NamespacedName {
+	return c.pods.cachedPods(namespace)
+}
+
+// ServicePorts returns a copy of the ports of the service, or nil if the service is unknown.
+func (c *Controller) ServicePorts(hostname host.Name) model.PortList {
+	c.RLock()
+	svc := c.servicesMap[hostname]
+	c.RUnlock()
+	if svc == nil {
+		return nil
+	}
+	out := make(model.PortList, 0, len(svc.Ports))
+	for _, port := range svc.Ports {
+		p := *port
+		out = append(out, &p)
+	}
+	return out
+}
+
+// AllEndpoints returns the endpoints of every service known to the registry, keyed by hostname. Services are
+// taken from a snapshot of the registry, and their endpoints built from the informer caches without updating the
+// state of the controller. Services without endpoints are omitted. This is intended for diagnostics and is not cheap.
+func (c *Controller) AllEndpoints() map[host.Name][]*model.IstioEndpoint {
+	c.RLock()
+	services := make([]*model.Service, 0, len(c.servicesMap))
+	for _, svc := range c.servicesMap {
+		services = append(services, svc)
+	}
+	c.RUnlock()
+
+	out := make(map[host.Name][]*model.IstioEndpoint, len(services))
+	for _, svc := range services {
+		endpoints := c.endpoints.snapshotIstioEndpoints(svc.Attributes.Name, svc.Attributes.Namespace, svc.Hostname)
+		if features.EnableK8SServiceSelectWorkloadEntries {
+			endpoints = append(endpoints, c.collectWorkloadInstanceEndpoints(svc)...)
+		}
+		if len(endpoints) > 0 {
+			out[svc.Hostname] = endpoints
+		}
+	}
+	return out
+}
+
+// ServiceLastUpdate returns the time the service was last updated by an event, and whether the service is known.
+func (c *Controller) ServiceLastUpdate(hostname host.Name) (time.Time, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	t, f := c.serviceLastUpdate[hostname]
+	return t, f
+}
+
+// ExternalNameInstances returns a copy of the instances derived for an ExternalName service.
+// Nil is returned if the hostname is not an ExternalName service.
+func (c *Controller) ExternalNameInstances(hostname host.Name) []*model.ServiceInstance {
+	c.RLock()
+	defer c.RUnlock()
+	instances := c.externalNameSvcInstanceMap[hostname]
+	if instances == nil {
+		return nil
+	}
+	out := make([]*model.ServiceInstance, len(instances))
+	copy(out, instances)
+	return out
+}
+
 // getPodLocality retrieves the locality for a pod.
 func (c *Controller) getPodLocality(pod *v1.Pod) string {
 	// if pod has `istio-locality` label, skip below ops
-	if len(pod.Labels[model.LocalityLabel]) > 0 {
+	if c.localitySource == PodLabelFirst && len(pod.Labels[model.LocalityLabel]) > 0 {
 		return model.GetLocalityLabelOrDefault(pod.Labels[model.LocalityLabel], "")
 	}
 
 	// NodeName is set by the scheduler after the pod is created
 	// https://github.com/kubernetes/community/blob/master/contributors/devel/api-conventions.md#late-initialization
-	raw, err := c.nodeLister.Get(pod.Spec.NodeName)
+	locality, err := c.nodeLocality(pod.Spec.NodeName)
 	if err != nil {
-		log.Warnf("unable to get node %q for pod %q: %v", pod.Spec.NodeName, pod.Name, err)
-		return ""
+		log.Warnf("unable to get locality of node %q for pod %q: %v", pod.Spec.NodeName, pod.Name, err)
+	}
+	if locality == "" && c.localitySource == NodeLabelFirst && len(pod.Labels[model.LocalityLabel]) > 0 {
+		return model.GetLocalityLabelOrDefault(pod.Labels[model.LocalityLabel], "")
+	}
+	return locality
+}
+
+// NodeLocality returns the locality of the node, in the "region/zone/subzone" format, derived from its topology
+// labels. It returns an empty string for unknown nodes, or nodes without topology labels.
+func (c *Controller) NodeLocality(nodeName string) string {
+	locality, _ := c.nodeLocality(nodeName)
+	return locality
+}
+
+// GetNode returns the node with the given name, stripped to the name, labels and addresses used by the registry.
+// It returns nil for unknown nodes.
+func (c *Controller) GetNode(name string) *v1.Node {
+	node, err := c.nodeLister.Get(name)
+	if err != nil {
+		return nil
+	}
+	nodeLabels := make(map[string]string, len(node.Labels))
+	for k, v := range node.Labels {
+		nodeLabels[k] = v
+	}
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   node.Name,
+			Labels: nodeLabels,
+		},
+		Status: v1.NodeStatus{
+			Addresses: append([]v1.NodeAddress(nil), node.Status.Addresses...),
+		},
+	}
+}
+
+func (c *Controller) nodeLocality(nodeName string) (string, error) {
+	raw, err := c.nodeLister.Get(nodeName)
+	if err != nil {
+		return "", err
 	}
 
 	nodeMeta, err := meta.Accessor(raw)
 	if err != nil {
-		log.Warnf("unable to get node meta: %v", nodeMeta)
-		return ""
+		return "", fmt.Errorf("unable to get node meta: %v", err)
 	}
 
 	region := getLabelValue(nodeMeta, NodeRegionLabel, NodeRegionLabelGA)
@@ -683,10 +2020,10 @@ func (c *Controller) getPodLocality(pod *v1.Pod) string {
 	subzone := getLabelValue(nodeMeta, label.IstioSubZone, "")
 
 	if region == "" && zone == "" && subzone == "" {
-		return ""
+		return "", nil
 	}
 
-	return region + "/" + zone + "/" + subzone // Format: "%s/%s/%s"
+	return region + "/" + zone + "/" + subzone, nil // Format: "%s/%s/%s"
 }
 
 // InstancesByPort implements a service catalog operation
@@ -763,10 +2100,11 @@ func (c *Controller) serviceInstancesFromWorkloadInstances(svc *model.Service, r
 	out := make([]*model.ServiceInstance, 0)
 
 	c.RLock()
-	for _, wi := range c.workloadInstancesByIP {
-		if wi.Namespace != svc.Attributes.Namespace {
-			continue
-		}
+	candidates := c.workloadInstancesByNamespace[svc.Attributes.Namespace]
+	if c.crossNamespaceWorkloads {
+		candidates = c.workloadInstancesByIP
+	}
+	for _, wi := range candidates {
 		if selector.SubsetOf(wi.Endpoint.Labels) {
 			// create an instance with endpoint whose service port name matches
 			istioEndpoint := *wi.Endpoint
@@ -781,6 +2119,10 @@ func (c *Controller) serviceInstancesFromWorkloadInstances(svc *model.Service, r
 			} else {
 				istioEndpoint.EndpointPort = uint32(targetPort)
 			}
+			if c.endpointHealthChecker != nil &&
+				!c.endpointHealthChecker.Healthy(istioEndpoint.Address, int(istioEndpoint.EndpointPort)) {
+				continue
+			}
 			istioEndpoint.ServicePortName = servicePort.Name
 			out = append(out, &model.ServiceInstance{
 				Service:     svc,
@@ -824,6 +2166,46 @@ func (c *Controller) collectWorkloadInstanceEndpoints(svc *model.Service) []*mod
 	return endpoints
 }
 
+// GetPodForProxy returns a copy of the pod the proxy was matched to, or nil if no pod matches its IP.
+// This is intended for debugging proxy to pod resolution.
+func (c *Controller) GetPodForProxy(proxy *model.Proxy) *v1.Pod {
+	pod := c.pods.getPodByProxy(proxy)
+	if pod == nil {
+		return nil
+	}
+	return pod.DeepCopy()
+}
+
+// ServicesForProxyIP returns the services selecting the pod or workload instance with the given IP.
+// This is intended for debugging, when only the IP of a proxy is known.
+func (c *Controller) ServicesForProxyIP(ip string) []*model.Service {
+	c.RLock()
+	workload, f := c.workloadInstancesByIP[ip]
+	c.RUnlock()
+	var k8sServices []*v1.Service
+	var err error
+	if f {
+		k8sServices, err = c.getWorkloadInstanceServices(workload)
+	} else if pod := c.pods.getPodByIP(ip); pod != nil {
+		k8sServices, err = getPodServices(c.serviceLister, pod)
+	} else {
+		return nil
+	}
+	if err != nil {
+		log.Warnf("failed to get services for proxy IP %s: %v", ip, err)
+		return nil
+	}
+	out := make([]*model.Service, 0, len(k8sServices))
+	c.RLock()
+	defer c.RUnlock()
+	for _, k8sSvc := range k8sServices {
+		if svc := c.servicesMap[kube.ServiceHostname(k8sSvc.Name, k8sSvc.Namespace, c.domainSuffix)]; svc != nil {
+			out = append(out, svc)
+		}
+	}
+	return out
+}
+
 // GetProxyServiceInstances returns service instances co-located with a given proxy
 // TODO: this code does not return k8s service instances when the proxy's IP is a workload entry
 // To tackle this, we need a ip2instance map like what we have in service entry.
@@ -875,16 +2257,25 @@ func (c *Controller) GetProxyServiceInstances(proxy *model.Proxy) []*model.Servi
 	return nil
 }
 
-func (c *Controller) hydrateWorkloadInstance(si *model.WorkloadInstance) []*model.ServiceInstance {
-	out := []*model.ServiceInstance{}
+// getWorkloadInstanceServices returns the services selecting the workload instance, in its namespace unless
+// crossNamespaceWorkloads is set.
+func (c *Controller) getWorkloadInstanceServices(si *model.WorkloadInstance) ([]*v1.Service, error) {
+	namespace := si.Namespace
+	if c.crossNamespaceWorkloads {
+		namespace = metav1.NamespaceAll
+	}
 	// find the workload entry's service by label selector
 	// rather than scanning through our internal map of model.services, get the services via the k8s apis
 	dummyPod := &v1.Pod{
-		ObjectMeta: metav1.ObjectMeta{Namespace: si.Namespace, Labels: si.Endpoint.Labels},
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Labels: si.Endpoint.Labels},
 	}
+	return getPodServices(c.serviceLister, dummyPod)
+}
 
+func (c *Controller) hydrateWorkloadInstance(si *model.WorkloadInstance) []*model.ServiceInstance {
+	out := []*model.ServiceInstance{}
 	// find the services that map to this workload entry, fire off eds updates if the service is of type client-side lb
-	if k8sServices, err := getPodServices(c.serviceLister, dummyPod); err == nil && len(k8sServices) > 0 {
+	if k8sServices, err := c.getWorkloadInstanceServices(si); err == nil && len(k8sServices) > 0 {
 		for _, k8sSvc := range k8sServices {
 			var service *model.Service
 			c.RLock()
@@ -922,27 +2313,39 @@ func (c *Controller) WorkloadInstanceHandler(si *model.WorkloadInstance, event m
 	c.Lock()
 	switch event {
 	case model.EventDelete:
-		delete(c.workloadInstancesByIP, si.Endpoint.Address)
+		c.deleteWorkloadInstanceLocked(si.Endpoint.Address)
 	default: // add or update
 		// Check to see if the workload entry changed. If it did, clear the old entry
 		k := si.Name + "~" + si.Namespace
 		existing := c.workloadInstancesIPsByName[k]
 		if existing != si.Endpoint.Address {
-			delete(c.workloadInstancesByIP, existing)
+			c.deleteWorkloadInstanceLocked(existing)
 		}
-		c.workloadInstancesByIP[si.Endpoint.Address] = si
+		c.addWorkloadInstanceLocked(si)
 		c.workloadInstancesIPsByName[k] = si.Endpoint.Address
 	}
 	c.Unlock()
 
-	// find the workload entry's service by label selector
-	// rather than scanning through our internal map of model.services, get the services via the k8s apis
-	dummyPod := &v1.Pod{
-		ObjectMeta: metav1.ObjectMeta{Namespace: si.Namespace, Labels: si.Endpoint.Labels},
+	c.updateEDSForWorkloadInstance(si)
+}
+
+// EndpointHealthChanged rebuilds the endpoints of the services selecting the workload instance with the IP.
+// The EndpointHealthChecker source calls it when the health of one of its endpoints changes, outside of
+// Healthy as the controller lock is held then.
+func (c *Controller) EndpointHealthChanged(ip string) {
+	c.RLock()
+	si := c.workloadInstancesByIP[ip]
+	c.RUnlock()
+	if si == nil {
+		return
 	}
+	c.updateEDSForWorkloadInstance(si)
+}
 
+// updateEDSForWorkloadInstance rebuilds the endpoints of the services selecting the workload instance.
+func (c *Controller) updateEDSForWorkloadInstance(si *model.WorkloadInstance) {
 	// find the services that map to this workload entry, fire off eds updates if the service is of type client-side lb
-	if k8sServices, err := getPodServices(c.serviceLister, dummyPod); err == nil && len(k8sServices) > 0 {
+	if k8sServices, err := c.getWorkloadInstanceServices(si); err == nil && len(k8sServices) > 0 {
 		for _, k8sSvc := range k8sServices {
 			var service *model.Service
 			c.RLock()
@@ -969,11 +2372,79 @@ func (c *Controller) WorkloadInstanceHandler(si *model.WorkloadInstance, event m
 				}
 			}
 			// fire off eds update
-			c.xdsUpdater.EDSUpdate(c.clusterID, string(service.Hostname), service.Attributes.Namespace, endpoints)
+			if !c.edsPushUnchanged(service.Hostname, endpoints) {
+				c.edsUpdate(service.Hostname, service.Attributes.Namespace, endpoints)
+			}
 		}
 	}
 }
 
+// addWorkloadInstanceLocked indexes the workload instance by IP and namespace. Must be called with the lock held.
+func (c *Controller) addWorkloadInstanceLocked(si *model.WorkloadInstance) {
+	if prev := c.workloadInstancesByIP[si.Endpoint.Address]; prev != nil && prev.Namespace != si.Namespace {
+		c.deleteWorkloadInstanceLocked(si.Endpoint.Address)
+	}
+	c.workloadInstancesByIP[si.Endpoint.Address] = si
+	byIP := c.workloadInstancesByNamespace[si.Namespace]
+	if byIP == nil {
+		byIP = make(map[string]*model.WorkloadInstance)
+		c.workloadInstancesByNamespace[si.Namespace] = byIP
+	}
+	byIP[si.Endpoint.Address] = si
+}
+
+// deleteWorkloadInstanceLocked removes the workload instance with the given IP from the IP and namespace
+// indexes. Must be called with the lock held.
+func (c *Controller) deleteWorkloadInstanceLocked(ip string) {
+	si := c.workloadInstancesByIP[ip]
+	if si == nil {
+		return
+	}
+	delete(c.workloadInstancesByIP, ip)
+	if byIP := c.workloadInstancesByNamespace[si.Namespace]; byIP != nil {
+		delete(byIP, ip)
+		if len(byIP) == 0 {
+			delete(c.workloadInstancesByNamespace, si.Namespace)
+		}
+	}
+}
+
+// GatewayRouteHandler is informed of services referenced by Gateway API routes. Referenced services
+// are marked with GatewayRouteReferenced, which is used as a discovery hint for scoping.
+func (c *Controller) GatewayRouteHandler(hostname host.Name, event model.Event) {
+	referenced := event != model.EventDelete
+	c.Lock()
+	if referenced {
+		c.gatewayRouteServices[hostname] = struct{}{}
+	} else {
+		delete(c.gatewayRouteServices, hostname)
+	}
+	svc := c.servicesMap[hostname]
+	c.Unlock()
+	if svc == nil {
+		// the flag will be applied once the service is added
+		return
+	}
+
+	svc.Mutex.Lock()
+	changed := svc.Attributes.GatewayRouteReferenced != referenced
+	svc.Attributes.GatewayRouteReferenced = referenced
+	svc.Mutex.Unlock()
+	if changed {
+		for _, f := range c.serviceHandlers {
+			f(svc, model.EventUpdate)
+		}
+	}
+}
+
+// IsGatewayRouteReferenced returns true if the service is referenced by a Gateway API route.
+func (c *Controller) IsGatewayRouteReferenced(hostname host.Name) bool {
+	c.RLock()
+	defer c.RUnlock()
+	_, f := c.gatewayRouteServices[hostname]
+	return f
+}
+
 func (c *Controller) onNamespaceEvent(obj interface{}, ev model.Event) error {
 	var nw string
 	if ev != model.EventDelete {
@@ -1103,6 +2574,7 @@ func (c *Controller) getProxyServiceInstancesByPod(pod *v1.Pod,
 		portNum, err := FindPort(pod, &port)
 		if err != nil {
 			log.Warnf("Failed to find port for service %s/%s: %v", service.Namespace, service.Name, err)
+			endpointPortMismatch.With(clusterTag.Value(c.clusterID), serviceTag.Value(string(hostname))).Increment()
 			continue
 		}
 		// Dedupe the target ports here - Service might have configured multiple ports to the same target port,
@@ -1157,8 +2629,36 @@ func (c *Controller) AppendServiceHandler(f func(*model.Service, model.Event)) e
 	return nil
 }
 
+// AppendServiceSelectorChangeHandler registers a handler that is called when the selector of an
+// existing service changes, which replaces its endpoint set wholesale. This is the only signal of a
+// selector change, as EDS updates carry no reason.
+func (c *Controller) AppendServiceSelectorChangeHandler(f func(prev, curr *model.Service)) {
+	c.serviceSelectorHandlers = append(c.serviceSelectorHandlers, f)
+}
+
+// AppendInitialSyncHandler registers a handler that is called once, after the initial in-order sync of all
+// resources completes and before queued events are processed. Handlers are called in registration order.
+// If the initial sync has already completed, the handler is called immediately.
+func (c *Controller) AppendInitialSyncHandler(f func()) {
+	c.Lock()
+	if !c.initialSyncDone {
+		c.initialSyncHandlers = append(c.initialSyncHandlers, f)
+		c.Unlock()
+		return
+	}
+	c.Unlock()
+	f()
+}
+
 // AppendWorkloadHandler implements a service catalog operation
 func (c *Controller) AppendWorkloadHandler(f func(*model.WorkloadInstance, model.Event)) error {
 	c.workloadHandlers = append(c.workloadHandlers, f)
 	return nil
 }
+
+// AppendPodHandler registers a handler that is called for each pod event, once the pod cache processed it.
+// Pods filtered out by the controller are not notified. Handlers are called with the pod cache locked, and
+// must not modify the pod.
+func (c *Controller) AppendPodHandler(f func(*v1.Pod, model.Event)) {
+	c.podHandlers = append(c.podHandlers, f)
+}
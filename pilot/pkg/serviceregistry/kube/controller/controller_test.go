@@ -19,11 +19,15 @@ import (
 	"fmt"
 	"reflect"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"go.opencensus.io/stats/view"
+	"golang.org/x/time/rate"
 	coreV1 "k8s.io/api/core/v1"
 	discovery "k8s.io/api/discovery/v1beta1"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -37,9 +41,11 @@ import (
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/serviceregistry"
 	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/config/host"
 	"istio.io/istio/pkg/config/labels"
 	"istio.io/istio/pkg/config/mesh"
 	"istio.io/istio/pkg/config/protocol"
+	"istio.io/istio/pkg/queue"
 	"istio.io/istio/pkg/spiffe"
 	"istio.io/istio/pkg/test"
 	"istio.io/istio/pkg/test/util/retry"
@@ -173,6 +179,520 @@ func makeService(n, ns string, cl kubernetes.Interface, t *testing.T) {
 	log.Infof("Created service %s", n)
 }
 
+func TestMultiNetworkMatchPolicy(t *testing.T) {
+	networksWatcher := mesh.NewFixedNetworksWatcher(&meshconfig.MeshNetworks{
+		Networks: map[string]*meshconfig.Network{
+			"wide": {
+				Endpoints: []*meshconfig.Network_NetworkEndpoints{{
+					Ne: &meshconfig.Network_NetworkEndpoints_FromCidr{FromCidr: "10.0.0.0/8"},
+				}},
+			},
+			"narrow": {
+				Endpoints: []*meshconfig.Network_NetworkEndpoints{{
+					Ne: &meshconfig.Network_NetworkEndpoints_FromCidr{FromCidr: "10.10.0.0/16"},
+				}},
+			},
+		},
+	})
+
+	cases := []struct {
+		name   string
+		policy MultiNetworkMatchPolicy
+		ip     string
+		want   []string
+	}{
+		{name: "longest prefix overlapping", policy: LongestPrefix, ip: "10.10.1.1", want: []string{"narrow"}},
+		{name: "longest prefix single match", policy: LongestPrefix, ip: "10.20.1.1", want: []string{"wide"}},
+		{name: "first match overlapping", policy: FirstMatch, ip: "10.10.1.1", want: []string{"narrow", "wide"}},
+		{name: "error overlapping", policy: ErrorOnMultipleMatch, ip: "10.10.1.1", want: []string{""}},
+		{name: "error single match", policy: ErrorOnMultipleMatch, ip: "10.20.1.1", want: []string{"wide"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			controller, _ := NewFakeControllerWithOptions(FakeControllerOptions{NetworksWatcher: networksWatcher})
+			defer controller.Stop()
+			controller.networkMatchPolicy = tc.policy
+
+			got := NewEndpointBuilder(controller, nil).endpointNetwork(tc.ip)
+			for _, want := range tc.want {
+				if got == want {
+					return
+				}
+			}
+			t.Fatalf("expected network of %s to be one of %v, got %q", tc.ip, tc.want, got)
+		})
+	}
+}
+
+func TestServiceNetworkAnnotation(t *testing.T) {
+	networksWatcher := mesh.NewFixedNetworksWatcher(&meshconfig.MeshNetworks{
+		Networks: map[string]*meshconfig.Network{
+			"network1": {
+				Endpoints: []*meshconfig.Network_NetworkEndpoints{{
+					Ne: &meshconfig.Network_NetworkEndpoints_FromCidr{FromCidr: "10.10.1.0/24"},
+				}},
+			},
+		},
+	})
+
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{NetworksWatcher: networksWatcher, Mode: mode})
+			defer controller.Stop()
+
+			pod := generatePod("10.10.1.2", "pod2", "nsA", "", "node1",
+				map[string]string{"app": "a", label.IstioNetwork: "podnetwork"}, map[string]string{})
+			addPods(t, controller, fx, pod)
+
+			createService(controller, "svc1", "nsA", map[string]string{kube.ServiceNetworkAnnotation: "forced"},
+				[]int32{8080}, map[string]string{"app": "a"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			createService(controller, "svc2", "nsA", nil, []int32{8080}, map[string]string{"app": "b"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+
+			cases := []struct {
+				svc      string
+				expected map[string]string
+			}{
+				// the annotation wins over the CIDR, but not over the pod network label
+				{svc: "svc1", expected: map[string]string{"10.10.1.1": "forced", "10.10.1.2": "podnetwork"}},
+				// without the annotation the CIDR wins
+				{svc: "svc2", expected: map[string]string{"10.10.1.1": "network1"}},
+			}
+			for _, tc := range cases {
+				var ips []string
+				for ip := range tc.expected {
+					ips = append(ips, ip)
+				}
+				createEndpoints(controller, tc.svc, "nsA", []string{"tcp-port"}, ips, nil, t)
+				ev := fx.Wait("eds")
+				if ev == nil {
+					t.Fatal("Timeout incremental eds")
+				}
+				if len(ev.Endpoints) != len(tc.expected) {
+					t.Fatalf("%s: expected %d endpoints, got %d", tc.svc, len(tc.expected), len(ev.Endpoints))
+				}
+				for _, ep := range ev.Endpoints {
+					if ep.Network != tc.expected[ep.Address] {
+						t.Errorf("%s: expected endpoint %s on network %q, got %q", tc.svc, ep.Address, tc.expected[ep.Address], ep.Network)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestObservedNetworksMetric(t *testing.T) {
+	clusterID := "observed-networks-cluster"
+	networksWatcher := mesh.NewFixedNetworksWatcher(&meshconfig.MeshNetworks{
+		Networks: map[string]*meshconfig.Network{
+			"network1": {
+				Endpoints: []*meshconfig.Network_NetworkEndpoints{{
+					Ne: &meshconfig.Network_NetworkEndpoints_FromCidr{FromCidr: "10.10.1.0/24"},
+				}},
+			},
+			"network2": {
+				Endpoints: []*meshconfig.Network_NetworkEndpoints{{
+					Ne: &meshconfig.Network_NetworkEndpoints_FromCidr{FromCidr: "10.10.2.0/24"},
+				}},
+			},
+		},
+	})
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{ClusterID: clusterID, NetworksWatcher: networksWatcher})
+	defer controller.Stop()
+
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "a"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	assertNetworks := func(expected float64) {
+		t.Helper()
+		retry.UntilSuccessOrFail(t, func() error {
+			if got := getGaugeValue(t, "pilot_k8s_observed_networks", clusterID); got != expected {
+				return fmt.Errorf("expected %v observed networks, got %v", expected, got)
+			}
+			return nil
+		}, retry.Timeout(5*time.Second))
+	}
+
+	createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"10.10.1.1", "10.10.1.2", "10.10.2.1"}, nil, t)
+	assertNetworks(2)
+
+	updateEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"10.10.1.1"}, t)
+	assertNetworks(1)
+}
+
+func TestOverlappingSelectors(t *testing.T) {
+	clusterID := "overlapping-selectors-cluster"
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{ClusterID: clusterID, DetectOverlappingSelectors: true})
+	defer controller.Stop()
+
+	addPods(t, controller, fx,
+		generatePod("10.0.0.1", "pod1", "nsA", "", "", map[string]string{"app": "a", "version": "v1"}, nil),
+		generatePod("10.0.0.2", "pod2", "nsA", "", "", map[string]string{"app": "a"}, nil))
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "a"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	createService(controller, "svc2", "nsA", nil, []int32{8080}, map[string]string{"version": "v1"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+
+	expectOverlaps := func(expected map[string][]string) {
+		t.Helper()
+		retry.UntilSuccessOrFail(t, func() error {
+			if got := controller.OverlappingSelectors(); !reflect.DeepEqual(got, expected) {
+				return fmt.Errorf("expected overlaps %v, got %v", expected, got)
+			}
+			if got := getGaugeValue(t, "pilot_k8s_overlapping_selectors", clusterID); got != float64(len(expected)) {
+				return fmt.Errorf("expected %d overlapping pods, got %v", len(expected), got)
+			}
+			return nil
+		}, retry.Timeout(5*time.Second))
+	}
+	expectOverlaps(map[string][]string{"nsA/pod1": {"svc1", "svc2"}})
+
+	if err := controller.client.CoreV1().Services("nsA").Delete(context.TODO(), "svc2", metaV1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expectOverlaps(map[string][]string{})
+}
+
+func TestEndpointAddressRewriter(t *testing.T) {
+	networksWatcher := mesh.NewFixedNetworksWatcher(&meshconfig.MeshNetworks{
+		Networks: map[string]*meshconfig.Network{
+			"network1": {
+				Endpoints: []*meshconfig.Network_NetworkEndpoints{{
+					Ne: &meshconfig.Network_NetworkEndpoints_FromCidr{FromCidr: "192.168.0.0/24"},
+				}},
+			},
+		},
+	})
+	rewriter := func(original string, pod *coreV1.Pod) string {
+		if pod == nil || pod.Name != "pod1" {
+			return ""
+		}
+		return "192.168.0.1"
+	}
+
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{
+				NetworksWatcher:         networksWatcher,
+				Mode:                    mode,
+				EndpointAddressRewriter: rewriter,
+			})
+			defer controller.Stop()
+
+			addPods(t, controller, fx,
+				generatePod("10.0.0.1", "pod1", "nsA", "", "node1", map[string]string{"app": "a"}, map[string]string{}),
+				generatePod("10.0.0.2", "pod2", "nsA", "", "node1", map[string]string{"app": "a"}, map[string]string{}))
+			createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "a"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"10.0.0.1", "10.0.0.2"}, nil, t)
+			ev := fx.Wait("eds")
+			if ev == nil {
+				t.Fatal("Timeout incremental eds")
+			}
+
+			// pod1 is rewritten, and its network resolved from the rewritten address; pod2 keeps its address
+			expected := map[string]string{"192.168.0.1": "network1", "10.0.0.2": ""}
+			if len(ev.Endpoints) != len(expected) {
+				t.Fatalf("expected %d endpoints, got %d", len(expected), len(ev.Endpoints))
+			}
+			for _, ep := range ev.Endpoints {
+				network, f := expected[ep.Address]
+				if !f {
+					t.Fatalf("unexpected endpoint address %s", ep.Address)
+				}
+				if ep.Network != network {
+					t.Errorf("expected endpoint %s on network %q, got %q", ep.Address, network, ep.Network)
+				}
+			}
+		})
+	}
+}
+
+func TestAdvertiseHostNetworkNodeIP(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{
+				Mode:                       mode,
+				AdvertiseHostNetworkNodeIP: true,
+			})
+			defer controller.Stop()
+
+			hostPod := generatePod("10.0.0.1", "pod1", "nsA", "", "node1", map[string]string{"app": "a"}, map[string]string{})
+			hostPod.Spec.HostNetwork = true
+			hostPod.Status.HostIP = "192.168.0.1"
+			pod := generatePod("10.0.0.2", "pod2", "nsA", "", "node1", map[string]string{"app": "a"}, map[string]string{})
+			pod.Status.HostIP = "192.168.0.1"
+			addPods(t, controller, fx, hostPod, pod)
+			createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "a"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"10.0.0.1", "10.0.0.2"}, nil, t)
+			ev := fx.Wait("eds")
+			if ev == nil {
+				t.Fatal("Timeout incremental eds")
+			}
+
+			// only the host-network pod advertises the node IP
+			var got []string
+			for _, ep := range ev.Endpoints {
+				got = append(got, ep.Address)
+			}
+			sort.Strings(got)
+			expected := []string{"10.0.0.2", "192.168.0.1"}
+			if !reflect.DeepEqual(got, expected) {
+				t.Fatalf("expected endpoint addresses %v, got %v", expected, got)
+			}
+		})
+	}
+}
+
+func TestSpreadConstraintTopologyLabels(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		enabled := enabled
+		t.Run(fmt.Sprintf("enabled=%v", enabled), func(t *testing.T) {
+			controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{SpreadConstraintTopologyLabels: enabled})
+			defer controller.Stop()
+
+			addNodes(t, controller, generateNode("node1", map[string]string{"example.com/rack": "r1", "example.com/row": "w1"}))
+			pod := generatePod("10.0.0.1", "pod1", "nsA", "", "node1", map[string]string{"app": "a"}, map[string]string{})
+			pod.Spec.TopologySpreadConstraints = []coreV1.TopologySpreadConstraint{{
+				MaxSkew:           1,
+				TopologyKey:       "example.com/rack",
+				WhenUnsatisfiable: coreV1.ScheduleAnyway,
+			}}
+			addPods(t, controller, fx, pod)
+			createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "a"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"10.0.0.1"}, nil, t)
+			ev := fx.Wait("eds")
+			if ev == nil {
+				t.Fatal("Timeout incremental eds")
+			}
+			if len(ev.Endpoints) != 1 {
+				t.Fatalf("expected 1 endpoint, got %d", len(ev.Endpoints))
+			}
+
+			epLabels := ev.Endpoints[0].Labels
+			if rack, f := epLabels["example.com/rack"]; f != enabled || (enabled && rack != "r1") {
+				t.Fatalf("unexpected rack label on endpoint: %v", epLabels)
+			}
+			// node labels not referenced by a constraint are never copied
+			if _, f := epLabels["example.com/row"]; f {
+				t.Fatalf("unexpected row label on endpoint: %v", epLabels)
+			}
+		})
+	}
+}
+
+func TestExcludedNamespaces(t *testing.T) {
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{
+		SystemNamespace:    "istio-system",
+		ExcludedNamespaces: []string{"kube-system", "istio-system"},
+	})
+	defer controller.Stop()
+
+	// the network label of the system namespace is read even though it is excluded
+	ns := &coreV1.Namespace{ObjectMeta: metaV1.ObjectMeta{Name: "istio-system", Labels: map[string]string{label.IstioNetwork: "nw1"}}}
+	if _, err := controller.client.CoreV1().Namespaces().Create(context.TODO(), ns, metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	retry.UntilSuccessOrFail(t, func() error {
+		controller.RLock()
+		defer controller.RUnlock()
+		if controller.network != "nw1" {
+			return fmt.Errorf("expected network nw1, got %q", controller.network)
+		}
+		return nil
+	}, retry.Timeout(time.Second*5), retry.Delay(time.Millisecond*10))
+
+	for _, namespace := range []string{"kube-system", "istio-system", "nsA"} {
+		createService(controller, "svc1", namespace, nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+	}
+	ev := fx.Wait("service")
+	if ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	expected := string(kube.ServiceHostname("svc1", "nsA", defaultFakeDomainSuffix))
+	if ev.ID != expected {
+		t.Fatalf("expected service event for %s, got %s", expected, ev.ID)
+	}
+	if svcs, _ := controller.Services(); len(svcs) != 1 || string(svcs[0].Hostname) != expected {
+		t.Fatalf("expected only service %s, got %v", expected, svcs)
+	}
+
+	for _, namespace := range []string{"kube-system", "nsA"} {
+		createEndpoints(controller, "svc1", namespace, []string{"tcp-port"}, []string{"10.0.0.1"}, nil, t)
+	}
+	if ev := fx.Wait("eds"); ev == nil || ev.ID != expected {
+		t.Fatalf("expected eds event for %s, got %v", expected, ev)
+	}
+}
+
+func TestSystemNamespaceNetwork(t *testing.T) {
+	controller, _ := NewFakeControllerWithOptions(FakeControllerOptions{SystemNamespace: "istio-system"})
+	defer controller.Stop()
+
+	if nw := controller.SystemNamespaceNetwork(); nw != "" {
+		t.Fatalf("expected no network, got %q", nw)
+	}
+	ns := &coreV1.Namespace{ObjectMeta: metaV1.ObjectMeta{Name: "istio-system", Labels: map[string]string{label.IstioNetwork: "nw1"}}}
+	if _, err := controller.client.CoreV1().Namespaces().Create(context.TODO(), ns, metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	retry.UntilSuccessOrFail(t, func() error {
+		if nw := controller.SystemNamespaceNetwork(); nw != "nw1" {
+			return fmt.Errorf("expected network nw1, got %q", nw)
+		}
+		return nil
+	}, retry.Timeout(time.Second*5), retry.Delay(time.Millisecond*10))
+}
+
+func TestPodDiscoveryFilter(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{
+				Mode: mode,
+				PodDiscoveryFilter: func(namespace string) bool {
+					return namespace == "nsA"
+				},
+			})
+			defer controller.Stop()
+
+			pods := []*coreV1.Pod{
+				generatePod("10.0.0.1", "pod1", "nsA", "", "node1", map[string]string{"app": "a"}, map[string]string{}),
+				generatePod("10.0.0.2", "pod2", "nsB", "", "node1", map[string]string{"app": "b"}, map[string]string{}),
+			}
+			// addPods waits for pods to reach the pod cache, which filtered pods never do
+			for _, pod := range pods {
+				newPod, err := controller.client.CoreV1().Pods(pod.Namespace).Create(context.TODO(), pod, metaV1.CreateOptions{})
+				if err != nil {
+					t.Fatalf("Cannot create %s in namespace %s (error: %v)", pod.Name, pod.Namespace, err)
+				}
+				newPod.Status.PodIP = pod.Status.PodIP
+				newPod.Status.Phase = coreV1.PodRunning
+				if _, err := controller.client.CoreV1().Pods(pod.Namespace).UpdateStatus(context.TODO(), newPod, metaV1.UpdateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			retry.UntilSuccessOrFail(t, func() error {
+				if controller.pods.getPodByIP("10.0.0.1") == nil {
+					return fmt.Errorf("pod1 not found")
+				}
+				return nil
+			}, retry.Timeout(5*time.Second))
+			if controller.pods.getPodByIP("10.0.0.2") != nil {
+				t.Fatal("expected pod2 to be filtered out")
+			}
+
+			for _, pod := range pods {
+				createService(controller, "svc1", pod.Namespace, nil, []int32{8080}, pod.Labels, t)
+				if ev := fx.Wait("service"); ev == nil {
+					t.Fatal("Timeout creating service")
+				}
+				ref := &coreV1.ObjectReference{Kind: "Pod", Name: pod.Name, Namespace: pod.Namespace}
+				createEndpoints(controller, "svc1", pod.Namespace, []string{"tcp-port"}, []string{pod.Status.PodIP},
+					[]*coreV1.ObjectReference{ref}, t)
+			}
+
+			// both services are discovered, but only the one with pods in scope has endpoints
+			for ns, expected := range map[string]int{"nsA": 1, "nsB": 0} {
+				hostname := kube.ServiceHostname("svc1", ns, defaultFakeDomainSuffix)
+				retry.UntilSuccessOrFail(t, func() error {
+					svc, _ := controller.GetService(hostname)
+					if svc == nil {
+						return fmt.Errorf("service %s not found", hostname)
+					}
+					if got := len(controller.InstancesByPort(svc, 8080, labels.Collection{})); got != expected {
+						return fmt.Errorf("%s: expected %d instances, got %d", hostname, expected, got)
+					}
+					if got := len(controller.endpoints.buildIstioEndpointsWithService("svc1", ns, hostname)); got != expected {
+						return fmt.Errorf("%s: expected %d endpoints, got %d", hostname, expected, got)
+					}
+					return nil
+				}, retry.Timeout(5*time.Second))
+			}
+		})
+	}
+}
+
+func TestPodHandler(t *testing.T) {
+	controller, _ := NewFakeControllerWithOptions(FakeControllerOptions{
+		PodDiscoveryFilter: func(namespace string) bool {
+			return namespace == "nsA"
+		},
+	})
+	defer controller.Stop()
+
+	type podEvent struct {
+		name  string
+		event model.Event
+	}
+	events := make(chan podEvent, 10)
+	controller.AppendPodHandler(func(pod *coreV1.Pod, event model.Event) {
+		events <- podEvent{pod.Name, event}
+	})
+	expectEvent := func(name string, event model.Event) {
+		t.Helper()
+		select {
+		case ev := <-events:
+			if ev.name != name || ev.event != event {
+				t.Fatalf("expected %s event for %s, got %s event for %s", event, name, ev.event, ev.name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s event for %s", event, name)
+		}
+	}
+
+	// pods filtered out by the controller are not notified
+	filtered := generatePod("10.0.0.2", "pod2", "nsB", "", "node1", map[string]string{"app": "a"}, map[string]string{})
+	if _, err := controller.client.CoreV1().Pods("nsB").Create(context.TODO(), filtered, metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	pod := generatePod("10.0.0.1", "pod1", "nsA", "", "node1", map[string]string{"app": "a"}, map[string]string{})
+	if _, err := controller.client.CoreV1().Pods("nsA").Create(context.TODO(), pod, metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent("pod1", model.EventAdd)
+
+	pod.Labels = map[string]string{"app": "b"}
+	pod.ResourceVersion = "2"
+	if _, err := controller.client.CoreV1().Pods("nsA").Update(context.TODO(), pod, metaV1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent("pod1", model.EventUpdate)
+
+	if err := controller.client.CoreV1().Pods("nsA").Delete(context.TODO(), "pod1", metaV1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent("pod1", model.EventDelete)
+
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected %s event for %s", ev.event, ev.name)
+	default:
+	}
+}
+
 func TestController_GetPodLocality(t *testing.T) {
 	pod1 := generatePod("128.0.1.1", "pod1", "nsA", "", "node1", map[string]string{"app": "prod-app"}, map[string]string{})
 	pod2 := generatePod("128.0.1.2", "pod2", "nsB", "", "node2", map[string]string{"app": "prod-app"}, map[string]string{})
@@ -302,27 +822,115 @@ func TestController_GetPodLocality(t *testing.T) {
 
 }
 
-func TestGetProxyServiceInstances(t *testing.T) {
-	clusterID := "fakeCluster"
-	for mode, name := range EndpointModeNames {
-		mode := mode
-		t.Run(name, func(t *testing.T) {
-			controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{
-				Mode:      mode,
-				ClusterID: clusterID,
-			})
-			defer controller.Stop()
-			p := generatePod("128.0.0.1", "pod1", "nsa", "foo", "node1", map[string]string{"app": "test-app"}, map[string]string{})
-			addPods(t, controller, fx, p)
-
-			k8sSaOnVM := "acct4"
-			canonicalSaOnVM := "acctvm2@gserviceaccount2.com"
-
-			createService(controller, "svc1", "nsa",
-				map[string]string{
-					annotation.AlphaKubernetesServiceAccounts.Name: k8sSaOnVM,
-					annotation.AlphaCanonicalServiceAccounts.Name:  canonicalSaOnVM},
-				[]int32{8080}, map[string]string{"app": "prod-app"}, t)
+func TestLocalitySource(t *testing.T) {
+	pod := generatePod("128.0.1.1", "pod1", "nsA", "", "node1",
+		map[string]string{"app": "prod-app", model.LocalityLabel: "podRegion.podZone.podSubzone"}, map[string]string{})
+	podWithoutNodeTopology := generatePod("128.0.1.2", "pod2", "nsA", "", "node2",
+		map[string]string{"app": "prod-app", model.LocalityLabel: "podRegion.podZone.podSubzone"}, map[string]string{})
+	cases := []struct {
+		source LocalitySource
+		want   map[*coreV1.Pod]string
+	}{
+		{
+			source: PodLabelFirst,
+			want: map[*coreV1.Pod]string{
+				pod:                    "podRegion/podZone/podSubzone",
+				podWithoutNodeTopology: "podRegion/podZone/podSubzone",
+			},
+		},
+		{
+			source: NodeLabelFirst,
+			want: map[*coreV1.Pod]string{
+				pod:                    "nodeRegion/nodeZone/",
+				podWithoutNodeTopology: "podRegion/podZone/podSubzone",
+			},
+		},
+	}
+	for _, tc := range cases {
+		controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{LocalitySource: tc.source})
+		addNodes(t, controller,
+			generateNode("node1", map[string]string{NodeRegionLabelGA: "nodeRegion", NodeZoneLabelGA: "nodeZone"}),
+			generateNode("node2", map[string]string{}))
+		addPods(t, controller, fx, pod, podWithoutNodeTopology)
+		for p, want := range tc.want {
+			if got := controller.getPodLocality(p); got != want {
+				t.Errorf("source %v, pod %s: expected locality %q, got %q", tc.source, p.Name, want, got)
+			}
+		}
+		controller.Stop()
+	}
+}
+
+func TestNodeLocality(t *testing.T) {
+	controller, _ := NewFakeControllerWithOptions(FakeControllerOptions{})
+	defer controller.Stop()
+
+	addNodes(t, controller,
+		generateNode("full", map[string]string{NodeRegionLabelGA: "region1", NodeZoneLabelGA: "zone1", label.IstioSubZone: "subzone1"}),
+		generateNode("partial", map[string]string{NodeRegionLabel: "region2"}),
+		generateNode("none", map[string]string{"foo": "bar"}))
+
+	cases := map[string]string{
+		"full":    "region1/zone1/subzone1",
+		"partial": "region2//",
+		"none":    "",
+		"missing": "",
+	}
+	for node, expected := range cases {
+		if got := controller.NodeLocality(node); got != expected {
+			t.Errorf("node %s: expected locality %q, got %q", node, expected, got)
+		}
+	}
+}
+
+func TestGetNode(t *testing.T) {
+	controller, _ := NewFakeControllerWithOptions(FakeControllerOptions{})
+	defer controller.Stop()
+
+	node := generateNode("node1", map[string]string{NodeRegionLabelGA: "region1"})
+	node.Status.Addresses = []coreV1.NodeAddress{{Type: coreV1.NodeExternalIP, Address: "1.2.3.4"}}
+	node.Status.Images = []coreV1.ContainerImage{{Names: []string{"image"}}}
+	addNodes(t, controller, node)
+
+	got := controller.GetNode("node1")
+	if got == nil {
+		t.Fatal("expected node1 to be found")
+	}
+	if got.Name != "node1" || got.Labels[NodeRegionLabelGA] != "region1" {
+		t.Errorf("unexpected node metadata: %v", got.ObjectMeta)
+	}
+	if !reflect.DeepEqual(got.Status.Addresses, node.Status.Addresses) {
+		t.Errorf("expected addresses %v, got %v", node.Status.Addresses, got.Status.Addresses)
+	}
+	if len(got.Status.Images) != 0 {
+		t.Errorf("expected images to be stripped, got %v", got.Status.Images)
+	}
+	if got := controller.GetNode("missing"); got != nil {
+		t.Errorf("expected nil for unknown node, got %v", got)
+	}
+}
+
+func TestGetProxyServiceInstances(t *testing.T) {
+	clusterID := "fakeCluster"
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{
+				Mode:      mode,
+				ClusterID: clusterID,
+			})
+			defer controller.Stop()
+			p := generatePod("128.0.0.1", "pod1", "nsa", "foo", "node1", map[string]string{"app": "test-app"}, map[string]string{})
+			addPods(t, controller, fx, p)
+
+			k8sSaOnVM := "acct4"
+			canonicalSaOnVM := "acctvm2@gserviceaccount2.com"
+
+			createService(controller, "svc1", "nsa",
+				map[string]string{
+					annotation.AlphaKubernetesServiceAccounts.Name: k8sSaOnVM,
+					annotation.AlphaCanonicalServiceAccounts.Name:  canonicalSaOnVM},
+				[]int32{8080}, map[string]string{"app": "prod-app"}, t)
 			ev := fx.Wait("service")
 			if ev == nil {
 				t.Fatal("Timeout creating service")
@@ -712,106 +1320,1621 @@ func TestGetProxyServiceInstancesWithMultiIPsAndTargetPorts(t *testing.T) {
 	}
 }
 
-func TestController_GetIstioServiceAccounts(t *testing.T) {
-	oldTrustDomain := spiffe.GetTrustDomain()
-	spiffe.SetTrustDomain(defaultFakeDomainSuffix)
-	defer spiffe.SetTrustDomain(oldTrustDomain)
-
+func TestGetProxyServiceInstancesFromMetadataNamedTargetPort(t *testing.T) {
+	clusterID := "fakeCluster"
 	for mode, name := range EndpointModeNames {
 		mode := mode
 		t.Run(name, func(t *testing.T) {
-			controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{Mode: mode})
+			controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{Mode: mode, ClusterID: clusterID})
 			defer controller.Stop()
 
-			sa1 := "acct1"
-			sa2 := "acct2"
-			sa3 := "acct3"
-			k8sSaOnVM := "acct4"
-			canonicalSaOnVM := "acctvm@gserviceaccount.com"
+			createServiceWithTargetPorts(controller, "svc1", "nsa", nil,
+				[]coreV1.ServicePort{
+					{
+						Name:       "http-port",
+						Port:       8080,
+						Protocol:   coreV1.ProtocolTCP,
+						TargetPort: intstr.FromString("http-app"),
+					},
+				}, map[string]string{"app": "prod-app"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
 
-			pods := []*coreV1.Pod{
-				generatePod("128.0.0.1", "pod1", "nsA", sa1, "node1", map[string]string{"app": "test-app"}, map[string]string{}),
-				generatePod("128.0.0.2", "pod2", "nsA", sa2, "node2", map[string]string{"app": "prod-app"}, map[string]string{}),
-				generatePod("128.0.0.3", "pod3", "nsB", sa3, "node1", map[string]string{"app": "prod-app"}, map[string]string{}),
+			proxy := func(podPorts model.PodPortList) *model.Proxy {
+				return &model.Proxy{
+					Type:            "sidecar",
+					IPAddresses:     []string{"1.1.1.1"},
+					ConfigNamespace: "nsa",
+					Metadata: &model.NodeMetadata{
+						ClusterID: clusterID,
+						Labels:    map[string]string{"app": "prod-app"},
+						PodPorts:  podPorts,
+					},
+				}
 			}
-			addPods(t, controller, fx, pods...)
 
-			createService(controller, "svc1", "nsA",
-				map[string]string{
-					annotation.AlphaKubernetesServiceAccounts.Name: k8sSaOnVM,
-					annotation.AlphaCanonicalServiceAccounts.Name:  canonicalSaOnVM},
-				[]int32{8080}, map[string]string{"app": "prod-app"}, t)
-			fx.Wait("service")
-			createService(controller, "svc2", "nsA", nil, []int32{8080}, map[string]string{"app": "staging-app"}, t)
-			fx.Wait("service")
+			// The pod port protocol is omitted, which Kubernetes defaults to TCP.
+			instances := controller.GetProxyServiceInstances(proxy(model.PodPortList{{Name: "http-app", ContainerPort: 7070}}))
+			if len(instances) != 1 {
+				t.Fatalf("expected 1 instance, got %v", len(instances))
+			}
+			if instances[0].Endpoint.EndpointPort != 7070 {
+				t.Fatalf("expected endpoint port 7070, got %v", instances[0].Endpoint.EndpointPort)
+			}
 
-			// Endpoints are generated by Kubernetes from pod labels and service selectors.
-			// Here we manually create them for mocking purpose.
-			svc1Ips := []string{"128.0.0.2"}
-			svc2Ips := make([]string, 0)
-			portNames := []string{"tcp-port"}
-			createEndpoints(controller, "svc1", "nsA", portNames, svc1Ips, nil, t)
-			createEndpoints(controller, "svc2", "nsA", portNames, svc2Ips, nil, t)
+			// The named port cannot be resolved, so no instance should be built on port 0.
+			instances = controller.GetProxyServiceInstances(proxy(model.PodPortList{{Name: "other", ContainerPort: 7070}}))
+			if len(instances) != 0 {
+				t.Fatalf("expected no instances, got %v", instances)
+			}
+		})
+	}
+}
 
-			// We expect only one EDS update with Endpoints.
-			<-fx.Events
+func TestFullResync(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{
+		FullResyncPeriod: 50 * time.Millisecond,
+		ServiceHandler: func(_ *model.Service, _ model.Event) {
+			mu.Lock()
+			calls++
+			mu.Unlock()
+		},
+	})
+	defer controller.Stop()
+	handlerCalls := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls
+	}
 
-			hostname := kube.ServiceHostname("svc1", "nsA", defaultFakeDomainSuffix)
-			svc, err := controller.GetService(hostname)
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+
+	// resyncs leave the unchanged service alone
+	initial := handlerCalls()
+	time.Sleep(300 * time.Millisecond)
+	if got := handlerCalls(); got != initial {
+		t.Fatalf("expected no handler calls for the unchanged service, got %d", got-initial)
+	}
+
+	// a service missing from the registry is restored by each resync
+	hostname := kube.ServiceHostname("svc1", "nsA", defaultFakeDomainSuffix)
+	for i := 1; i <= 2; i++ {
+		controller.Lock()
+		delete(controller.servicesMap, hostname)
+		controller.Unlock()
+		retry.UntilSuccessOrFail(t, func() error {
+			if got := handlerCalls(); got != initial+i {
+				return fmt.Errorf("expected %d handler calls, got %d", initial+i, got)
+			}
+			return nil
+		}, retry.Timeout(5*time.Second))
+	}
+}
+
+func TestWaitSyncLimiter(t *testing.T) {
+	controller, _ := NewFakeControllerWithOptions(FakeControllerOptions{})
+	controller.syncLimiter = rate.NewLimiter(rate.Every(time.Hour), 1)
+
+	if err := controller.waitSyncLimiter(false); err != nil {
+		t.Fatalf("expected the burst to be allowed, got %v", err)
+	}
+	// periodic resyncs are not rate limited
+	if err := controller.waitSyncLimiter(true); err != nil {
+		t.Fatalf("expected resyncs not to be rate limited, got %v", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- controller.waitSyncLimiter(false)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("expected the sync to be rate limited, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	controller.Stop()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected the rate limited sync to be aborted")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("rate limited sync was not aborted on stop")
+	}
+}
+
+func TestGatewayRouteHandler(t *testing.T) {
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{})
+	defer controller.Stop()
+
+	referenced := kube.ServiceHostname("svc1", "nsA", defaultFakeDomainSuffix)
+	other := kube.ServiceHostname("svc2", "nsA", defaultFakeDomainSuffix)
+
+	// Mark a service before it exists, the flag should be applied once it is added.
+	controller.GatewayRouteHandler(referenced, model.EventAdd)
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	createService(controller, "svc2", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+
+	assertReferenced := func(hostname host.Name, expected bool) {
+		t.Helper()
+		if got := controller.IsGatewayRouteReferenced(hostname); got != expected {
+			t.Fatalf("expected %s referenced=%v, got %v", hostname, expected, got)
+		}
+		svc, _ := controller.GetService(hostname)
+		if svc == nil {
+			t.Fatalf("service %s not found", hostname)
+		}
+		if svc.Attributes.GatewayRouteReferenced != expected {
+			t.Fatalf("expected %s GatewayRouteReferenced=%v, got %v", hostname, expected, svc.Attributes.GatewayRouteReferenced)
+		}
+	}
+	assertReferenced(referenced, true)
+	assertReferenced(other, false)
+
+	controller.GatewayRouteHandler(other, model.EventAdd)
+	assertReferenced(other, true)
+
+	controller.GatewayRouteHandler(referenced, model.EventDelete)
+	assertReferenced(referenced, false)
+	assertReferenced(other, true)
+}
+
+func TestEvictService(t *testing.T) {
+	var mu sync.Mutex
+	deleted := map[host.Name]bool{}
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{
+		ServiceHandler: func(svc *model.Service, e model.Event) {
+			if e == model.EventDelete {
+				mu.Lock()
+				deleted[svc.Hostname] = true
+				mu.Unlock()
+			}
+		},
+	})
+	defer controller.Stop()
+
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	existing := kube.ServiceHostname("svc1", "nsA", defaultFakeDomainSuffix)
+
+	// Simulate a service whose delete event was missed.
+	phantom := kube.ServiceHostname("phantom", "nsA", defaultFakeDomainSuffix)
+	controller.Lock()
+	controller.servicesMap[phantom] = &model.Service{
+		Hostname:   phantom,
+		Attributes: model.ServiceAttributes{Name: "phantom", Namespace: "nsA"},
+	}
+	controller.Unlock()
+	fx.Clear()
+
+	if err := controller.EvictService(phantom, false); err != nil {
+		t.Fatalf("failed to evict phantom service: %v", err)
+	}
+	if svc, _ := controller.GetService(phantom); svc != nil {
+		t.Fatalf("expected phantom service to be evicted")
+	}
+	if ev := fx.Wait("service"); ev == nil || ev.ID != string(phantom) {
+		t.Fatalf("expected service delete event for %s, got %v", phantom, ev)
+	}
+	mu.Lock()
+	if !deleted[phantom] {
+		t.Fatalf("expected delete handler to be called for %s", phantom)
+	}
+	mu.Unlock()
+
+	// A service backed by a kubernetes object is only evicted when forced.
+	if err := controller.EvictService(existing, false); err == nil {
+		t.Fatalf("expected error evicting a service that exists in the informer")
+	}
+	if svc, _ := controller.GetService(existing); svc == nil {
+		t.Fatalf("expected service %s to not be evicted", existing)
+	}
+	if err := controller.EvictService(existing, true); err != nil {
+		t.Fatalf("failed to force evict service: %v", err)
+	}
+	if svc, _ := controller.GetService(existing); svc != nil {
+		t.Fatalf("expected service %s to be evicted", existing)
+	}
+
+	if err := controller.EvictService(phantom, false); err == nil {
+		t.Fatalf("expected error evicting an unknown service")
+	}
+}
+
+func TestServiceSelectorChangeHandler(t *testing.T) {
+	cases := []struct {
+		name    string
+		prev    map[string]string
+		curr    map[string]string
+		changed bool
+	}{
+		{name: "selector added", prev: nil, curr: map[string]string{"app": "a"}, changed: true},
+		{name: "selector changed", prev: map[string]string{"app": "a"}, curr: map[string]string{"app": "b"}, changed: true},
+		{name: "selector removed", prev: map[string]string{"app": "a"}, curr: nil, changed: true},
+		{name: "selector unchanged", prev: map[string]string{"app": "a"}, curr: map[string]string{"app": "a"}, changed: false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{})
+			defer controller.Stop()
+
+			changes := make(chan [2]*model.Service, 10)
+			controller.AppendServiceSelectorChangeHandler(func(prev, curr *model.Service) {
+				changes <- [2]*model.Service{prev, curr}
+			})
+
+			createService(controller, "svc1", "nsA", nil, []int32{8080}, tc.prev, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			svc, err := controller.client.CoreV1().Services("nsA").Get(context.TODO(), "svc1", metaV1.GetOptions{})
 			if err != nil {
-				t.Fatalf("failed to get service: %v", err)
+				t.Fatal(err)
 			}
-			sa := controller.GetIstioServiceAccounts(svc, []int{8080})
-			sort.Strings(sa)
-			expected := []string{
-				canonicalSaOnVM,
-				"spiffe://company.com/ns/nsA/sa/" + sa2,
-				"spiffe://company.com/ns/nsA/sa/" + k8sSaOnVM,
+			svc.Spec.Selector = tc.curr
+			svc.Annotations = map[string]string{"updated": "true"}
+			if _, err := controller.client.CoreV1().Services("nsA").Update(context.TODO(), svc, metaV1.UpdateOptions{}); err != nil {
+				t.Fatal(err)
 			}
-			if !reflect.DeepEqual(sa, expected) {
-				t.Fatalf("Unexpected service accounts %v (expecting %v)", sa, expected)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout updating service")
 			}
 
-			hostname = kube.ServiceHostname("svc2", "nsA", defaultFakeDomainSuffix)
-			svc, err = controller.GetService(hostname)
-			if err != nil {
-				t.Fatalf("failed to get service: %v", err)
+			select {
+			case got := <-changes:
+				if !tc.changed {
+					t.Fatalf("unexpected selector change event: %v -> %v",
+						got[0].Attributes.LabelSelectors, got[1].Attributes.LabelSelectors)
+				}
+				if !labels.Instance(got[0].Attributes.LabelSelectors).Equals(tc.prev) ||
+					!labels.Instance(got[1].Attributes.LabelSelectors).Equals(tc.curr) {
+					t.Fatalf("got selectors %v -> %v, want %v -> %v",
+						got[0].Attributes.LabelSelectors, got[1].Attributes.LabelSelectors, tc.prev, tc.curr)
+				}
+			case <-time.After(time.Second):
+				if tc.changed {
+					t.Fatal("timed out waiting for selector change event")
+				}
 			}
-			sa = controller.GetIstioServiceAccounts(svc, []int{})
-			if len(sa) != 0 {
-				t.Fatal("Failure: Expected to resolve 0 service accounts, but got: ", sa)
+		})
+	}
+}
+
+func TestAllEndpoints(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{Mode: mode})
+			defer controller.Stop()
+
+			createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "a"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			createService(controller, "svc2", "nsB", nil, []int32{8080}, map[string]string{"app": "b"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			createService(controller, "svc3", "nsA", nil, []int32{8080}, map[string]string{"app": "c"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"10.0.0.1", "10.0.0.2"}, nil, t)
+			if ev := fx.Wait("eds"); ev == nil {
+				t.Fatal("Timeout incremental eds")
+			}
+			createEndpoints(controller, "svc2", "nsB", []string{"tcp-port"}, []string{"10.0.0.3"}, nil, t)
+			if ev := fx.Wait("eds"); ev == nil {
+				t.Fatal("Timeout incremental eds")
+			}
+
+			all := controller.AllEndpoints()
+			expected := map[host.Name][]string{
+				kube.ServiceHostname("svc1", "nsA", defaultFakeDomainSuffix): {"10.0.0.1", "10.0.0.2"},
+				kube.ServiceHostname("svc2", "nsB", defaultFakeDomainSuffix): {"10.0.0.3"},
+			}
+			if len(all) != len(expected) {
+				t.Fatalf("expected endpoints for %d services, got %d: %v", len(expected), len(all), all)
+			}
+			for hostname, ips := range expected {
+				var got []string
+				for _, ep := range all[hostname] {
+					got = append(got, ep.Address)
+				}
+				sort.Strings(got)
+				if !reflect.DeepEqual(got, ips) {
+					t.Errorf("expected endpoints %v for %s, got %v", ips, hostname, got)
+				}
 			}
 		})
 	}
 }
 
-func TestController_Service(t *testing.T) {
+func TestEndpointSortOrder(t *testing.T) {
 	for mode, name := range EndpointModeNames {
 		mode := mode
 		t.Run(name, func(t *testing.T) {
 			controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{Mode: mode})
 			defer controller.Stop()
-			// Use a timeout to keep the test from hanging.
 
-			createService(controller, "svc1", "nsA",
-				map[string]string{},
-				[]int32{8080}, map[string]string{"test-app": "test-app-1"}, t)
-			<-fx.Events
-			createService(controller, "svc2", "nsA",
-				map[string]string{},
-				[]int32{8081}, map[string]string{"test-app": "test-app-2"}, t)
-			<-fx.Events
-			createService(controller, "svc3", "nsA",
-				map[string]string{},
-				[]int32{8082}, map[string]string{"test-app": "test-app-3"}, t)
-			<-fx.Events
-			createService(controller, "svc4", "nsA",
-				map[string]string{},
-				[]int32{8083}, map[string]string{"test-app": "test-app-4"}, t)
-			<-fx.Events
+			createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "a"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"10.0.0.3", "10.0.0.1", "10.0.0.2"}, nil, t)
+			if ev := fx.Wait("eds"); ev == nil {
+				t.Fatal("Timeout incremental eds")
+			}
 
-			expectedSvcList := []*model.Service{
-				{
+			hostname := kube.ServiceHostname("svc1", "nsA", defaultFakeDomainSuffix)
+			expected := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+			for i := 0; i < 3; i++ {
+				var got []string
+				for _, ep := range controller.endpoints.buildIstioEndpointsWithService("svc1", "nsA", hostname) {
+					got = append(got, ep.Address)
+				}
+				if !reflect.DeepEqual(got, expected) {
+					t.Fatalf("build %d: expected endpoints %v, got %v", i, expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestServiceWithoutSelectorManualEndpoints(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		for _, manualOnly := range []bool{false, true} {
+			mode, manualOnly := mode, manualOnly
+			t.Run(fmt.Sprintf("%s/manual only %v", name, manualOnly), func(t *testing.T) {
+				testServiceWithoutSelectorManualEndpoints(t, mode, manualOnly)
+			})
+		}
+	}
+}
+
+func testServiceWithoutSelectorManualEndpoints(t *testing.T, mode EndpointMode, manualOnly bool) {
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{Mode: mode, ManualEndpointsOnly: manualOnly})
+	defer controller.Stop()
+
+	addPods(t, controller, fx, generatePod("10.0.0.5", "pod1", "nsA", "", "node1", map[string]string{"app": "a"}, nil))
+
+	createService(controller, "manual", "nsA", nil, []int32{8080}, nil, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	createService(controller, "selected", "nsA", nil, []int32{8080}, map[string]string{"app": "a"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	createEndpoints(controller, "manual", "nsA", []string{"tcp-port"}, []string{"10.0.0.5"}, nil, t)
+	if ev := fx.Wait("eds"); ev == nil {
+		t.Fatal("Timeout incremental eds")
+	}
+	createEndpoints(controller, "selected", "nsA", []string{"tcp-port"}, []string{"10.0.0.5"}, nil, t)
+	if ev := fx.Wait("eds"); ev == nil {
+		t.Fatal("Timeout incremental eds")
+	}
+
+	// the manual endpoint shares the pod IP, and only takes its labels unless restricted to manual endpoints
+	hostname := kube.ServiceHostname("manual", "nsA", defaultFakeDomainSuffix)
+	endpoints := controller.endpoints.buildIstioEndpointsWithService("manual", "nsA", hostname)
+	if len(endpoints) != 1 {
+		t.Fatalf("expected 1 endpoint, got %d", len(endpoints))
+	}
+	if _, f := endpoints[0].Labels["app"]; f == manualOnly {
+		t.Fatalf("unexpected labels on manual endpoint: %v", endpoints[0].Labels)
+	}
+
+	hostname = kube.ServiceHostname("selected", "nsA", defaultFakeDomainSuffix)
+	endpoints = controller.endpoints.buildIstioEndpointsWithService("selected", "nsA", hostname)
+	if len(endpoints) != 1 {
+		t.Fatalf("expected 1 endpoint, got %d", len(endpoints))
+	}
+	if endpoints[0].Labels["app"] != "a" {
+		t.Fatalf("expected pod labels on endpoint, got %v", endpoints[0].Labels)
+	}
+}
+
+func TestSyncErrors(t *testing.T) {
+	controller, _ := NewFakeControllerWithOptions(FakeControllerOptions{})
+	defer controller.Stop()
+
+	if err := controller.SyncAll(); err != nil {
+		t.Fatalf("unexpected sync error: %v", err)
+	}
+	if errs := controller.SyncErrors(); errs != nil {
+		t.Fatalf("expected no sync errors, got %v", errs)
+	}
+
+	// the pod cache rejects anything that is not a pod
+	bogus := &coreV1.Service{ObjectMeta: metaV1.ObjectMeta{Name: "bogus", Namespace: "nsA"}}
+	if err := controller.pods.informer.GetStore().Add(bogus); err != nil {
+		t.Fatal(err)
+	}
+	if err := controller.SyncAll(); err == nil {
+		t.Fatal("expected sync error")
+	}
+	if errs := controller.SyncErrors(); len(errs) != 1 {
+		t.Fatalf("expected 1 sync error, got %v", errs)
+	}
+
+	if err := controller.pods.informer.GetStore().Delete(bogus); err != nil {
+		t.Fatal(err)
+	}
+	if err := controller.SyncAll(); err != nil {
+		t.Fatalf("unexpected sync error: %v", err)
+	}
+	if errs := controller.SyncErrors(); errs != nil {
+		t.Fatalf("expected sync errors to be cleared, got %v", errs)
+	}
+}
+
+func TestStaleServices(t *testing.T) {
+	for _, evict := range []bool{false, true} {
+		evict := evict
+		t.Run(fmt.Sprintf("evict=%v", evict), func(t *testing.T) {
+			clusterID := fmt.Sprintf("stale-%v", evict)
+			controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{ClusterID: clusterID, EvictStaleServices: evict})
+			defer controller.Stop()
+
+			createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+
+			// a service whose delete event was missed
+			phantom := kube.ServiceHostname("phantom", "nsA", defaultFakeDomainSuffix)
+			controller.Lock()
+			controller.servicesMap[phantom] = &model.Service{
+				Hostname:   phantom,
+				Attributes: model.ServiceAttributes{Name: "phantom", Namespace: "nsA"},
+			}
+			controller.Unlock()
+
+			if err := controller.SyncAll(); err != nil {
+				t.Fatal(err)
+			}
+			if got := getGaugeValue(t, "pilot_k8s_stale_services", clusterID); got != 1 {
+				t.Fatalf("expected 1 stale service, got %v", got)
+			}
+			if svc, _ := controller.GetService(phantom); (svc == nil) != evict {
+				t.Fatalf("expected stale service evicted=%v, got %v", evict, svc)
+			}
+			if svc, _ := controller.GetService(kube.ServiceHostname("svc1", "nsA", defaultFakeDomainSuffix)); svc == nil {
+				t.Fatal("expected svc1 to be retained")
+			}
+		})
+	}
+}
+
+func TestAllEndpointsReadOnly(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{Mode: mode})
+			defer controller.Stop()
+
+			hostname := kube.ServiceHostname("svc1", "nsA", defaultFakeDomainSuffix)
+			createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "a"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			pod := generatePod("10.0.0.1", "pod1", "nsA", "", "", map[string]string{"app": "a"}, map[string]string{})
+			addPods(t, controller, fx, pod)
+			refs := []*coreV1.ObjectReference{
+				{Kind: "Pod", Namespace: "nsA", Name: "pod1"},
+				{Kind: "Pod", Namespace: "nsA", Name: "pod2"},
+			}
+			createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"10.0.0.1", "10.0.0.2"}, refs, t)
+			if ev := fx.Wait("eds"); ev == nil {
+				t.Fatal("Timeout incremental eds")
+			}
+			retry.UntilSuccessOrFail(t, func() error {
+				controller.pods.RLock()
+				defer controller.pods.RUnlock()
+				if _, f := controller.pods.needResync["10.0.0.2"]; !f {
+					return fmt.Errorf("endpoint of the missing pod is not pending")
+				}
+				return nil
+			}, retry.Timeout(time.Second))
+
+			// forget the state recorded by the event, which building a snapshot must not restore
+			controller.pods.endpointDeleted(kube.KeyFunc("svc1", "nsA"), "10.0.0.2")
+			var slices *endpointSliceController
+			switch e := controller.endpoints.(type) {
+			case *endpointSliceController:
+				slices = e
+			case *mergedEndpointsController:
+				slices = e.slices
+			}
+			if slices != nil {
+				slices.endpointCache.Delete(hostname, "svc1")
+			}
+
+			if got := len(controller.AllEndpoints()[hostname]); got != 1 {
+				t.Fatalf("expected 1 endpoint, got %d", got)
+			}
+			controller.Describe()
+			controller.ExplainPodEndpoint("nsA", "pod1", hostname)
+
+			controller.pods.RLock()
+			pending := len(controller.pods.needResync)
+			controller.pods.RUnlock()
+			if pending != 0 {
+				t.Errorf("expected building a snapshot not to queue endpoints for missing pods, got %d", pending)
+			}
+			if slices != nil {
+				if got := slices.endpointCache.Get(hostname); len(got) != 0 {
+					t.Errorf("expected building a snapshot not to update the endpoint slice cache, got %v", got)
+				}
+			}
+		})
+	}
+}
+
+func TestExplainPodEndpoint(t *testing.T) {
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{
+		PodDiscoveryFilter: func(namespace string) bool { return namespace != "nsB" },
+		ExcludedPodPhases:  []coreV1.PodPhase{coreV1.PodPending},
+	})
+	defer controller.Stop()
+
+	addPods(t, controller, fx, generatePod("10.0.0.1", "ready", "nsA", "", "", map[string]string{"app": "a"}, nil))
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "a"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"10.0.0.1"}, nil, t)
+	if ev := fx.Wait("eds"); ev == nil {
+		t.Fatal("Timeout incremental eds")
+	}
+
+	// the remaining pods are only added to the store, as they would never become endpoints
+	pending := generatePod("10.0.0.3", "pending", "nsA", "", "", map[string]string{"app": "a"}, nil)
+	pending.Status.Phase = coreV1.PodPending
+	unready := generatePod("10.0.0.4", "unready", "nsA", "", "", map[string]string{"app": "a"}, nil)
+	unready.Status.Conditions = []coreV1.PodCondition{{Type: coreV1.PodReady, Status: coreV1.ConditionFalse}}
+	for _, pod := range []*coreV1.Pod{
+		generatePod("10.0.0.2", "other", "nsA", "", "", map[string]string{"app": "b"}, nil),
+		generatePod("10.0.1.1", "filtered", "nsB", "", "", map[string]string{"app": "a"}, nil),
+		pending,
+		generatePod("", "noip", "nsA", "", "", map[string]string{"app": "a"}, nil),
+		unready,
+		generatePod("10.0.0.5", "unlisted", "nsA", "", "", map[string]string{"app": "a"}, nil),
+	} {
+		if err := controller.pods.informer.GetStore().Add(pod); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hostname := kube.ServiceHostname("svc1", "nsA", defaultFakeDomainSuffix)
+	cases := []struct {
+		namespace string
+		pod       string
+		hostname  host.Name
+		expected  string
+	}{
+		{"nsA", "ready", "unknown.nsA.svc.company.com", "service unknown.nsA.svc.company.com not found"},
+		{"nsA", "missing", hostname, "pod nsA/missing not found"},
+		{"nsB", "filtered", hostname, "excluded from discovery"},
+		{"nsA", "other", hostname, "is not selected by service"},
+		{"nsA", "pending", hostname, "is in excluded phase Pending"},
+		{"nsA", "noip", hostname, "has no IP"},
+		{"nsA", "unready", hostname, "is not ready"},
+		{"nsA", "unlisted", hostname, "is not in the ready endpoints"},
+		{"nsA", "ready", hostname, "is an endpoint of service"},
+	}
+	for _, tc := range cases {
+		if got := controller.ExplainPodEndpoint(tc.namespace, tc.pod, tc.hostname); !strings.Contains(got, tc.expected) {
+			t.Errorf("%s/%s: expected %q in %q", tc.namespace, tc.pod, tc.expected, got)
+		}
+	}
+}
+
+func TestEndpointSliceEDSSortOrder(t *testing.T) {
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{Mode: EndpointSliceOnly})
+	defer controller.Stop()
+
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "a"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+
+	portName := "tcp-port"
+	var portNum int32 = 8080
+	slices := map[string][]string{
+		"svc1-a": {"10.0.0.5", "10.0.0.1", "10.0.0.3"},
+		"svc1-b": {"10.0.0.4", "10.0.0.2"},
+		"svc1-c": {"10.0.0.6"},
+	}
+	var expected []string
+	for _, name := range []string{"svc1-a", "svc1-b", "svc1-c"} {
+		var sliceEndpoints []discovery.Endpoint
+		for _, ip := range slices[name] {
+			sliceEndpoints = append(sliceEndpoints, discovery.Endpoint{Addresses: []string{ip}})
+		}
+		slice := &discovery.EndpointSlice{
+			ObjectMeta: metaV1.ObjectMeta{
+				Name:      name,
+				Namespace: "nsA",
+				Labels:    map[string]string{discovery.LabelServiceName: "svc1"},
+			},
+			Endpoints: sliceEndpoints,
+			Ports:     []discovery.EndpointPort{{Name: &portName, Port: &portNum}},
+		}
+		if _, err := controller.client.DiscoveryV1beta1().EndpointSlices("nsA").Create(context.TODO(), slice, metaV1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+
+		// every push carries the endpoints of all the slices so far, in the same order
+		expected = append(expected, slices[name]...)
+		sort.Strings(expected)
+		ev := fx.Wait("eds")
+		if ev == nil {
+			t.Fatal("Timeout incremental eds")
+		}
+		var got []string
+		for _, ep := range ev.Endpoints {
+			got = append(got, ep.Address)
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("after adding slice %s: expected endpoints %v, got %v", name, expected, got)
+		}
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{ClusterID: "cluster1"})
+	defer controller.Stop()
+
+	node := generateNode("node1", map[string]string{})
+	node.Status.Addresses = []coreV1.NodeAddress{{Type: coreV1.NodeExternalIP, Address: "1.2.3.4"}}
+	if _, err := controller.client.CoreV1().Nodes().Create(context.TODO(), node, metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "a"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"10.0.0.1", "10.0.0.2"}, nil, t)
+	if ev := fx.Wait("eds"); ev == nil {
+		t.Fatal("Timeout incremental eds")
+	}
+
+	hostname := kube.ServiceHostname("svc1", "nsA", defaultFakeDomainSuffix)
+	retry.UntilSuccessOrFail(t, func() error {
+		d := controller.Describe()
+		if d.ClusterID != "cluster1" || d.EndpointMode != controller.endpointMode {
+			return fmt.Errorf("unexpected cluster %q or mode %v", d.ClusterID, d.EndpointMode)
+		}
+		if !d.Synced {
+			return fmt.Errorf("expected controller to be synced")
+		}
+		if d.Services != 1 {
+			return fmt.Errorf("expected 1 service, got %d", d.Services)
+		}
+		if d.Endpoints[hostname] != 2 {
+			return fmt.Errorf("expected 2 endpoints for %s, got %v", hostname, d.Endpoints)
+		}
+		if d.Nodes["node1"] != "1.2.3.4" {
+			return fmt.Errorf("expected node1 with address 1.2.3.4, got %v", d.Nodes)
+		}
+		return nil
+	}, retry.Timeout(5*time.Second))
+}
+
+func TestAdditionalDomainSuffixes(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{
+				Mode:                     mode,
+				AdditionalDomainSuffixes: []string{"old.local"},
+			})
+			defer controller.Stop()
+
+			primary := kube.ServiceHostname("svc1", "nsA", defaultFakeDomainSuffix)
+			alias := kube.ServiceHostname("svc1", "nsA", "old.local")
+
+			createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "a"}, t)
+			for i := 0; i < 2; i++ {
+				if ev := fx.Wait("service"); ev == nil {
+					t.Fatal("Timeout creating service")
+				}
+			}
+			for _, hostname := range []host.Name{primary, alias} {
+				svc, _ := controller.GetService(hostname)
+				if svc == nil {
+					t.Fatalf("expected service %s to be found", hostname)
+				}
+				if svc.Hostname != hostname {
+					t.Fatalf("expected hostname %s, got %s", hostname, svc.Hostname)
+				}
+			}
+
+			createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"10.0.0.1"}, nil, t)
+			updated := map[string]bool{}
+			for i := 0; i < 2; i++ {
+				ev := fx.Wait("eds")
+				if ev == nil {
+					t.Fatal("Timeout incremental eds")
+				}
+				if len(ev.Endpoints) != 1 || ev.Endpoints[0].Address != "10.0.0.1" {
+					t.Fatalf("unexpected endpoints for %s: %v", ev.ID, ev.Endpoints)
+				}
+				updated[ev.ID] = true
+			}
+			if !updated[string(primary)] || !updated[string(alias)] {
+				t.Fatalf("expected eds updates for %s and %s, got %v", primary, alias, updated)
+			}
+
+			if err := controller.client.CoreV1().Services("nsA").Delete(context.TODO(), "svc1", metaV1.DeleteOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			retry.UntilSuccessOrFail(t, func() error {
+				for _, hostname := range []host.Name{primary, alias} {
+					if svc, _ := controller.GetService(hostname); svc != nil {
+						return fmt.Errorf("expected service %s to be deleted", hostname)
+					}
+				}
+				return nil
+			}, retry.Timeout(5*time.Second))
+		})
+	}
+}
+
+func TestEndpointMode(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, _ := NewFakeControllerWithOptions(FakeControllerOptions{Mode: mode})
+			defer controller.Stop()
+			if got := controller.EndpointMode(); got != mode {
+				t.Fatalf("expected endpoint mode %s, got %s", mode, got)
+			}
+		})
+	}
+}
+
+func TestServicePorts(t *testing.T) {
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{})
+	defer controller.Stop()
+
+	createService(controller, "svc1", "nsA", nil, []int32{8080, 9090}, map[string]string{"app": "prod-app"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+
+	hostname := kube.ServiceHostname("svc1", "nsA", defaultFakeDomainSuffix)
+	ports := controller.ServicePorts(hostname)
+	if len(ports) != 2 || ports[0].Port != 8080 || ports[1].Port != 9090 {
+		t.Fatalf("expected ports 8080 and 9090, got %v", ports)
+	}
+	// the returned ports must not alias the service ports
+	ports[0].Port = 1
+	if svc, _ := controller.GetService(hostname); svc.Ports[0].Port != 8080 {
+		t.Fatalf("service port was mutated through the returned ports")
+	}
+
+	if ports := controller.ServicePorts("unknown.nsA.svc.company.com"); ports != nil {
+		t.Fatalf("expected no ports for unknown hostname, got %v", ports)
+	}
+}
+
+func TestServiceLastUpdate(t *testing.T) {
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{})
+	defer controller.Stop()
+	hostname := kube.ServiceHostname("svc1", "nsA", defaultFakeDomainSuffix)
+
+	if _, f := controller.ServiceLastUpdate(hostname); f {
+		t.Fatal("expected no last update for unknown service")
+	}
+
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "a"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	created, f := controller.ServiceLastUpdate(hostname)
+	if !f {
+		t.Fatal("expected last update after service creation")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	svc, err := controller.client.CoreV1().Services("nsA").Get(context.TODO(), "svc1", metaV1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.Annotations = map[string]string{"updated": "true"}
+	if _, err := controller.client.CoreV1().Services("nsA").Update(context.TODO(), svc, metaV1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout updating service")
+	}
+	updated, f := controller.ServiceLastUpdate(hostname)
+	if !f || !updated.After(created) {
+		t.Fatalf("expected last update to advance past %v, got %v", created, updated)
+	}
+
+	if err := controller.client.CoreV1().Services("nsA").Delete(context.TODO(), "svc1", metaV1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout deleting service")
+	}
+	if _, f := controller.ServiceLastUpdate(hostname); f {
+		t.Fatal("expected no last update after service deletion")
+	}
+}
+
+func TestInitialSyncHandler(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	record := func(name string) func() {
+		return func() {
+			mu.Lock()
+			defer mu.Unlock()
+			calls = append(calls, name)
+		}
+	}
+
+	// registered before the sync
+	controller, _ := NewFakeControllerWithOptions(FakeControllerOptions{InitialSyncHandler: record("before")})
+	defer controller.Stop()
+	mu.Lock()
+	if !reflect.DeepEqual(calls, []string{"before"}) {
+		t.Fatalf("expected handler registered before sync to be called once, got %v", calls)
+	}
+	mu.Unlock()
+
+	// registered after the sync, called immediately in order
+	controller.AppendInitialSyncHandler(record("after1"))
+	controller.AppendInitialSyncHandler(record("after2"))
+	// further syncs must not call handlers again
+	controller.HasSynced()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(calls, []string{"before", "after1", "after2"}) {
+		t.Fatalf("unexpected handler calls %v", calls)
+	}
+}
+
+func TestGetPodForProxy(t *testing.T) {
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{})
+	defer controller.Stop()
+
+	pod := generatePod("128.0.0.1", "pod1", "nsA", "", "node1", map[string]string{"app": "test-app"}, map[string]string{})
+	addPods(t, controller, fx, pod)
+
+	got := controller.GetPodForProxy(&model.Proxy{IPAddresses: []string{"128.0.0.1"}})
+	if got == nil {
+		t.Fatal("expected pod for proxy IP 128.0.0.1")
+	}
+	if got.Name != "pod1" || got.Namespace != "nsA" {
+		t.Fatalf("expected pod nsA/pod1, got %s/%s", got.Namespace, got.Name)
+	}
+
+	if got := controller.GetPodForProxy(&model.Proxy{IPAddresses: []string{"128.0.0.99"}}); got != nil {
+		t.Fatalf("expected no pod for unknown proxy IP, got %s/%s", got.Namespace, got.Name)
+	}
+	if got := controller.GetPodForProxy(&model.Proxy{}); got != nil {
+		t.Fatalf("expected no pod for proxy without IPs, got %s/%s", got.Namespace, got.Name)
+	}
+}
+
+func TestServicesForProxyIP(t *testing.T) {
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{})
+	defer controller.Stop()
+
+	addPods(t, controller, fx, generatePod("128.0.0.1", "pod1", "nsA", "", "node1", map[string]string{"app": "test-app"}, map[string]string{}))
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "test-app"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	createService(controller, "svc2", "nsA", nil, []int32{8080}, map[string]string{"app": "other-app"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	controller.WorkloadInstanceHandler(&model.WorkloadInstance{
+		Name:      "workload",
+		Namespace: "nsA",
+		Endpoint: &model.IstioEndpoint{
+			Labels:       labels.Instance{"app": "other-app"},
+			Address:      "2.2.2.2",
+			EndpointPort: 8080,
+		},
+	}, model.EventAdd)
+
+	cases := map[string]string{
+		"128.0.0.1": "svc1.nsA.svc.company.com",
+		"2.2.2.2":   "svc2.nsA.svc.company.com",
+	}
+	for ip, expected := range cases {
+		svcs := controller.ServicesForProxyIP(ip)
+		if len(svcs) != 1 || svcs[0].Hostname != host.Name(expected) {
+			t.Errorf("expected service %s for IP %s, got %v", expected, ip, svcs)
+		}
+	}
+	if svcs := controller.ServicesForProxyIP("128.0.0.99"); len(svcs) != 0 {
+		t.Errorf("expected no services for unknown IP, got %v", svcs)
+	}
+}
+
+func TestCrossNamespaceWorkloadInstances(t *testing.T) {
+	for _, cross := range []bool{false, true} {
+		cross := cross
+		t.Run(fmt.Sprintf("cross=%v", cross), func(t *testing.T) {
+			controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{CrossNamespaceWorkloadInstances: cross})
+			defer controller.Stop()
+
+			createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "vm"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			controller.WorkloadInstanceHandler(&model.WorkloadInstance{
+				Name:      "workload",
+				Namespace: "nsB",
+				Endpoint: &model.IstioEndpoint{
+					Labels:       labels.Instance{"app": "vm"},
+					Address:      "2.2.2.2",
+					EndpointPort: 8080,
+				},
+			}, model.EventAdd)
+
+			svc, _ := controller.GetService(kube.ServiceHostname("svc1", "nsA", defaultFakeDomainSuffix))
+			instances := controller.InstancesByPort(svc, 8080, labels.Collection{})
+			if cross {
+				if len(instances) != 1 || instances[0].Endpoint.Address != "2.2.2.2" {
+					t.Fatalf("expected the workload entry of nsB to join svc1, got %v", instances)
+				}
+			} else if len(instances) != 0 {
+				t.Fatalf("expected no instances, got %v", instances)
+			}
+			if got := len(controller.ServicesForProxyIP("2.2.2.2")) == 1; got != cross {
+				t.Fatalf("expected workload entry services to be found=%v, got %v", cross, got)
+			}
+		})
+	}
+}
+
+// getEventCount returns the number of k8s registry events recorded for the type and event.
+func getEventCount(t *testing.T, otype, event string) float64 {
+	t.Helper()
+	rows, err := view.RetrieveData("pilot_k8s_reg_events")
+	if err != nil {
+		t.Fatalf("failed to get value for pilot_k8s_reg_events: %v", err)
+	}
+	for _, row := range rows {
+		var typeMatch, eventMatch bool
+		for _, tag := range row.Tags {
+			typeMatch = typeMatch || (tag.Key.Name() == "type" && tag.Value == otype)
+			eventMatch = eventMatch || (tag.Key.Name() == "event" && tag.Value == event)
+		}
+		if typeMatch && eventMatch {
+			return row.Data.(*view.SumData).Value
+		}
+	}
+	return 0
+}
+
+func TestUpdateSameEventType(t *testing.T) {
+	controller, _ := NewFakeControllerWithOptions(FakeControllerOptions{})
+	defer controller.Stop()
+
+	pod := generatePod("128.0.0.1", "pod1", "nsA", "", "node1", map[string]string{"app": "a"}, map[string]string{})
+	pod.ResourceVersion = "1"
+	if _, err := controller.client.CoreV1().Pods("nsA").Create(context.TODO(), pod, metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	retry.UntilSuccessOrFail(t, func() error {
+		if _, f, _ := controller.pods.informer.GetStore().GetByKey("nsA/pod1"); !f {
+			return fmt.Errorf("pod not in informer cache")
+		}
+		return nil
+	}, retry.Timeout(5*time.Second))
+
+	updateSame := getEventCount(t, "Pods", "updatesame")
+	updates := getEventCount(t, "Pods", "update")
+
+	// An update with an unchanged resource version is filtered out.
+	pod.Annotations = map[string]string{"foo": "bar"}
+	if _, err := controller.client.CoreV1().Pods("nsA").Update(context.TODO(), pod, metaV1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	retry.UntilSuccessOrFail(t, func() error {
+		if got := getEventCount(t, "Pods", "updatesame"); got != updateSame+1 {
+			return fmt.Errorf("expected %v updatesame events for Pods, got %v", updateSame+1, got)
+		}
+		return nil
+	}, retry.Timeout(5*time.Second))
+	if got := getEventCount(t, "Pods", "update"); got != updates {
+		t.Fatalf("expected no update events for Pods, got %v", got-updates)
+	}
+}
+
+// getGaugeValue returns the value of the gauge for the row with the given cluster label.
+func getGaugeValue(t *testing.T, name, cluster string) float64 {
+	t.Helper()
+	return getTaggedGaugeValue(t, name, "cluster", cluster)
+}
+
+func getTaggedGaugeValue(t *testing.T, name, key, value string) float64 {
+	t.Helper()
+	rows, err := view.RetrieveData(name)
+	if err != nil {
+		t.Fatalf("failed to get value for gauge %s: %v", name, err)
+	}
+	for _, row := range rows {
+		for _, tag := range row.Tags {
+			if tag.Key.Name() == key && tag.Value == value {
+				return row.Data.(*view.LastValueData).Value
+			}
+		}
+	}
+	return 0
+}
+
+func getSumValue(t *testing.T, name, cluster string) float64 {
+	t.Helper()
+	rows, err := view.RetrieveData(name)
+	if err != nil {
+		t.Fatalf("failed to get value for sum %s: %v", name, err)
+	}
+	for _, row := range rows {
+		for _, tag := range row.Tags {
+			if tag.Key.Name() == "cluster" && tag.Value == cluster {
+				return row.Data.(*view.SumData).Value
+			}
+		}
+	}
+	return 0
+}
+
+// getEDSUpdates returns the number of EDS updates of the kind recorded for the cluster.
+func getEDSUpdates(t *testing.T, cluster, kind string) float64 {
+	t.Helper()
+	rows, err := view.RetrieveData("pilot_k8s_eds_updates")
+	if err != nil {
+		t.Fatalf("failed to get value for pilot_k8s_eds_updates: %v", err)
+	}
+	for _, row := range rows {
+		var clusterMatch, kindMatch bool
+		for _, tag := range row.Tags {
+			clusterMatch = clusterMatch || (tag.Key.Name() == "cluster" && tag.Value == cluster)
+			kindMatch = kindMatch || (tag.Key.Name() == "kind" && tag.Value == kind)
+		}
+		if clusterMatch && kindMatch {
+			return row.Data.(*view.SumData).Value
+		}
+	}
+	return 0
+}
+
+func TestEndpointPortMismatchMetric(t *testing.T) {
+	clusterID := "port-mismatch-cluster"
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{ClusterID: clusterID})
+	defer controller.Stop()
+
+	// the pod does not expose the named target port of the service
+	addPods(t, controller, fx, generatePod("128.0.0.1", "pod1", "nsA", "", "node1", map[string]string{"app": "a"}, map[string]string{}))
+	createServiceWithTargetPorts(controller, "svc1", "nsA", nil, []coreV1.ServicePort{
+		{Name: "http-web", Port: 80, TargetPort: intstr.FromString("http-web")},
+	}, map[string]string{"app": "a"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+
+	instances := controller.GetProxyServiceInstances(&model.Proxy{
+		IPAddresses: []string{"128.0.0.1"},
+		Metadata:    &model.NodeMetadata{ClusterID: clusterID},
+	})
+	if len(instances) != 0 {
+		t.Fatalf("expected no service instances, got %v", instances)
+	}
+	if got := getSumValue(t, "pilot_k8s_endpoint_port_mismatch", clusterID); got != 1 {
+		t.Fatalf("expected 1 port mismatch, got %v", got)
+	}
+}
+
+func TestEDSUpdatesMetric(t *testing.T) {
+	clusterID := "eds-updates-cluster"
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{ClusterID: clusterID})
+	defer controller.Stop()
+
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	// endpoint events trigger a push
+	createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"10.0.0.1"}, nil, t)
+	if ev := fx.Wait("eds"); ev == nil {
+		t.Fatal("Timeout incremental eds")
+	}
+	if got := getEDSUpdates(t, clusterID, "full"); got != 1 {
+		t.Fatalf("expected 1 full eds update, got %v", got)
+	}
+	if got := getEDSUpdates(t, clusterID, "cache"); got != 0 {
+		t.Fatalf("expected no eds cache update, got %v", got)
+	}
+
+	// a re-created service only updates the cache, the service update triggers the push
+	if err := controller.client.CoreV1().Services("nsA").Delete(context.TODO(), "svc1", metaV1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout deleting service")
+	}
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	if got := getEDSUpdates(t, clusterID, "cache"); got != 1 {
+		t.Fatalf("expected 1 eds cache update, got %v", got)
+	}
+	if got := getEDSUpdates(t, clusterID, "full"); got != 1 {
+		t.Fatalf("expected 1 full eds update, got %v", got)
+	}
+}
+
+func TestFullPushCoalescing(t *testing.T) {
+	clusterID := "full-push-coalescing-cluster"
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{
+		ClusterID:              clusterID,
+		FullPushCoalesceWindow: 100 * time.Millisecond,
+	})
+	defer controller.Stop()
+	fx.Clear()
+
+	for i := 0; i < 5; i++ {
+		controller.fullPush(&model.PushRequest{Full: true})
+	}
+	if ev := fx.Wait("xds"); ev == nil {
+		t.Fatal("Timeout waiting for coalesced push")
+	}
+	select {
+	case ev := <-fx.Events:
+		t.Fatalf("unexpected event %s after coalesced push", ev.Type)
+	case <-time.After(300 * time.Millisecond):
+	}
+	if got := getSumValue(t, "pilot_k8s_full_pushes_coalesced", clusterID); got != 4 {
+		t.Fatalf("expected 4 coalesced pushes, got %v", got)
+	}
+
+	// a push after the window starts a new one
+	controller.fullPush(&model.PushRequest{Full: true})
+	if ev := fx.Wait("xds"); ev == nil {
+		t.Fatal("Timeout waiting for push")
+	}
+}
+
+func TestCleanupFlushesFullPush(t *testing.T) {
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{FullPushCoalesceWindow: time.Hour})
+	defer controller.Stop()
+
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	fx.Clear()
+
+	controller.fullPush(&model.PushRequest{Full: true})
+	if err := controller.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	// the pending push is sent before the services of the shard are removed
+	for _, expected := range []string{"xds", "service"} {
+		select {
+		case ev := <-fx.Events:
+			if ev.Type != expected {
+				t.Fatalf("expected %s event, got %s", expected, ev.Type)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for %s event", expected)
+		}
+	}
+}
+
+func TestConvertServiceCallsMetric(t *testing.T) {
+	clusterID := "convert-service-cluster"
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{ClusterID: clusterID})
+	defer controller.Stop()
+
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	if got := getSumValue(t, "pilot_k8s_convert_service_calls", clusterID); got != 1 {
+		t.Fatalf("expected 1 conversion after add, got %v", got)
+	}
+
+	if err := controller.client.CoreV1().Services("nsA").Delete(context.TODO(), "svc1", metaV1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout deleting service")
+	}
+	if got := getSumValue(t, "pilot_k8s_convert_service_calls", clusterID); got != 2 {
+		t.Fatalf("expected 2 conversions after delete, got %v", got)
+	}
+}
+
+func TestStrictServiceValidation(t *testing.T) {
+	cases := []struct {
+		name     string
+		ports    []coreV1.ServicePort
+		conflict bool
+	}{
+		{
+			name: "conflicting protocols",
+			ports: []coreV1.ServicePort{
+				{Name: "http-web", Port: 80, TargetPort: intstr.FromInt(8080)},
+				{Name: "tcp-db", Port: 81, TargetPort: intstr.FromInt(8080)},
+			},
+			conflict: true,
+		},
+		{
+			name: "same protocol",
+			ports: []coreV1.ServicePort{
+				{Name: "http-web", Port: 80, TargetPort: intstr.FromInt(8080)},
+				{Name: "http-alt", Port: 81, TargetPort: intstr.FromInt(8080)},
+			},
+		},
+		{
+			name: "distinct target ports",
+			ports: []coreV1.ServicePort{
+				{Name: "http-web", Port: 80},
+				{Name: "tcp-db", Port: 81},
+			},
+		},
+	}
+	for i, tc := range cases {
+		tc := tc
+		clusterID := fmt.Sprintf("strict-validation-%d", i)
+		t.Run(tc.name, func(t *testing.T) {
+			controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{ClusterID: clusterID, StrictServiceValidation: true})
+			defer controller.Stop()
+
+			svc := &coreV1.Service{
+				ObjectMeta: metaV1.ObjectMeta{Name: "svc1", Namespace: "nsA"},
+				Spec: coreV1.ServiceSpec{
+					ClusterIP: "10.0.0.1",
+					Ports:     tc.ports,
+					Selector:  map[string]string{"app": "prod-app"},
+				},
+			}
+			if _, err := controller.client.CoreV1().Services("nsA").Create(context.TODO(), svc, metaV1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+
+			conv, _ := controller.GetService(kube.ServiceHostname("svc1", "nsA", defaultFakeDomainSuffix))
+			if conv == nil {
+				t.Fatal("service not found")
+			}
+			if got := conv.Attributes.ValidationError != ""; got != tc.conflict {
+				t.Errorf("expected conflict %v, got validation error %q", tc.conflict, conv.Attributes.ValidationError)
+			}
+			expected := 0.0
+			if tc.conflict {
+				expected = 1
+			}
+			if got := getSumValue(t, "pilot_k8s_service_conflicts", clusterID); got != expected {
+				t.Errorf("expected %v conflicts, got %v", expected, got)
+			}
+		})
+	}
+}
+
+func TestServicesWithoutPortsPolicy(t *testing.T) {
+	cases := []struct {
+		name       string
+		policy     ServicesWithoutPortsPolicy
+		registered bool
+		counted    float64
+	}{
+		{"ignore", IgnoreServicesWithoutPorts, true, 0},
+		{"skip", SkipServicesWithoutPorts, false, 0},
+		{"count", CountServicesWithoutPorts, true, 1},
+	}
+	for _, tc := range cases {
+		tc := tc
+		clusterID := "no-ports-" + tc.name
+		t.Run(tc.name, func(t *testing.T) {
+			controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{ClusterID: clusterID, ServicesWithoutPortsPolicy: tc.policy})
+			defer controller.Stop()
+
+			createService(controller, "svc1", "nsA", nil, nil, map[string]string{"app": "prod-app"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			svc, _ := controller.GetService(kube.ServiceHostname("svc1", "nsA", defaultFakeDomainSuffix))
+			if registered := svc != nil; registered != tc.registered {
+				t.Errorf("expected service registered %v, got %v", tc.registered, registered)
+			}
+			if got := getSumValue(t, "pilot_k8s_services_no_ports", clusterID); got != tc.counted {
+				t.Errorf("expected %v services without ports, got %v", tc.counted, got)
+			}
+		})
+	}
+}
+
+func TestEndpointsWithoutLocalityMetric(t *testing.T) {
+	clusterID := "no-locality-cluster"
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{ClusterID: clusterID})
+	defer controller.Stop()
+
+	// node1 has topology labels, node2 does not exist so its pods have no locality.
+	addNodes(t, controller, generateNode("node1", map[string]string{NodeZoneLabel: "zone1", NodeRegionLabel: "region1"}))
+	addPods(t, controller, fx,
+		generatePod("128.0.0.1", "pod1", "nsA", "", "node1", map[string]string{"app": "prod-app"}, map[string]string{}),
+		generatePod("128.0.0.2", "pod2", "nsA", "", "node2", map[string]string{"app": "prod-app"}, map[string]string{}))
+
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1", "128.0.0.2"}, nil, t)
+	if ev := fx.Wait("eds"); ev == nil {
+		t.Fatal("Timeout incremental eds")
+	}
+	retry.UntilSuccessOrFail(t, func() error {
+		if got := getGaugeValue(t, "pilot_k8s_endpoints_no_locality", clusterID); got != 1 {
+			return fmt.Errorf("expected 1 endpoint without locality, got %v", got)
+		}
+		return nil
+	}, retry.Timeout(5*time.Second))
+
+	updateEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1"}, t)
+	retry.UntilSuccessOrFail(t, func() error {
+		if got := getGaugeValue(t, "pilot_k8s_endpoints_no_locality", clusterID); got != 0 {
+			return fmt.Errorf("expected 0 endpoints without locality, got %v", got)
+		}
+		return nil
+	}, retry.Timeout(5*time.Second))
+}
+
+func TestQueueDepthMetric(t *testing.T) {
+	clusterID := "queue-depth-cluster"
+	controller, _ := NewFakeControllerWithOptions(FakeControllerOptions{ClusterID: clusterID})
+	defer controller.Stop()
+
+	// Block the queue so pushed tasks accumulate.
+	release := make(chan struct{})
+	started := make(chan struct{})
+	controller.queue.Push(func() error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+	for i := 0; i < 5; i++ {
+		controller.queue.Push(func() error { return nil })
+	}
+
+	controller.recordQueueDepth()
+	if got := getGaugeValue(t, "pilot_k8s_reg_queue_depth", clusterID); got != 5 {
+		t.Fatalf("expected queue depth 5, got %v", got)
+	}
+	if got := getGaugeValue(t, "pilot_k8s_reg_queue_depth_high_watermark", clusterID); got != 5 {
+		t.Fatalf("expected queue depth high watermark 5, got %v", got)
+	}
+
+	close(release)
+	retry.UntilSuccessOrFail(t, func() error {
+		if l := controller.queue.Len(); l != 0 {
+			return fmt.Errorf("expected queue to drain, length is %d", l)
+		}
+		return nil
+	}, retry.Timeout(5*time.Second))
+	controller.recordQueueDepth()
+	if got := getGaugeValue(t, "pilot_k8s_reg_queue_depth", clusterID); got != 0 {
+		t.Fatalf("expected queue depth 0, got %v", got)
+	}
+	if got := getGaugeValue(t, "pilot_k8s_reg_queue_depth_high_watermark", clusterID); got != 5 {
+		t.Fatalf("expected queue depth high watermark to remain 5, got %v", got)
+	}
+}
+
+func TestQueueOldestAgeMetric(t *testing.T) {
+	clusterID := "queue-oldest-age-cluster"
+	controller, _ := NewFakeControllerWithOptions(FakeControllerOptions{ClusterID: clusterID})
+	defer controller.Stop()
+
+	// Block the queue so the pushed task waits.
+	release := make(chan struct{})
+	started := make(chan struct{})
+	controller.queue.Push(func() error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+	controller.queue.Push(func() error { return nil })
+
+	controller.recordQueueDepth()
+	first := getGaugeValue(t, "pilot_k8s_reg_queue_oldest_age_seconds", clusterID)
+	time.Sleep(50 * time.Millisecond)
+	controller.recordQueueDepth()
+	second := getGaugeValue(t, "pilot_k8s_reg_queue_oldest_age_seconds", clusterID)
+	if second < first+0.05 {
+		t.Fatalf("expected oldest age to grow by at least 50ms, got %v then %v", first, second)
+	}
+
+	close(release)
+	retry.UntilSuccessOrFail(t, func() error {
+		controller.recordQueueDepth()
+		if got := getGaugeValue(t, "pilot_k8s_reg_queue_oldest_age_seconds", clusterID); got != 0 {
+			return fmt.Errorf("expected oldest age 0 once drained, got %v", got)
+		}
+		return nil
+	}, retry.Timeout(5*time.Second))
+}
+
+// recordingQueue is a queue counting the tasks pushed to it.
+type recordingQueue struct {
+	queue.Instance
+	mu     sync.Mutex
+	id     string
+	pushes int
+}
+
+func (q *recordingQueue) Push(task queue.Task) {
+	q.mu.Lock()
+	q.pushes++
+	q.mu.Unlock()
+	q.Instance.Push(task)
+}
+
+func (q *recordingQueue) Pushes() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pushes
+}
+
+func TestQueueFactory(t *testing.T) {
+	var q *recordingQueue
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{
+		ClusterID: "queue-factory-cluster",
+		QueueFactory: func(id string) queue.Instance {
+			q = &recordingQueue{Instance: queue.NewQueue(time.Second), id: id}
+			return q
+		},
+	})
+	defer controller.Stop()
+
+	if q == nil {
+		t.Fatal("expected the queue factory to be used")
+	}
+	if q.id != "queue-factory-cluster" {
+		t.Fatalf("expected queue id %q, got %q", "queue-factory-cluster", q.id)
+	}
+	before := q.Pushes()
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "a"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	if q.Pushes() <= before {
+		t.Fatal("expected the service event to go through the injected queue")
+	}
+}
+
+func TestController_GetIstioServiceAccounts(t *testing.T) {
+	oldTrustDomain := spiffe.GetTrustDomain()
+	spiffe.SetTrustDomain(defaultFakeDomainSuffix)
+	defer spiffe.SetTrustDomain(oldTrustDomain)
+
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{Mode: mode})
+			defer controller.Stop()
+
+			sa1 := "acct1"
+			sa2 := "acct2"
+			sa3 := "acct3"
+			k8sSaOnVM := "acct4"
+			canonicalSaOnVM := "acctvm@gserviceaccount.com"
+
+			pods := []*coreV1.Pod{
+				generatePod("128.0.0.1", "pod1", "nsA", sa1, "node1", map[string]string{"app": "test-app"}, map[string]string{}),
+				generatePod("128.0.0.2", "pod2", "nsA", sa2, "node2", map[string]string{"app": "prod-app"}, map[string]string{}),
+				generatePod("128.0.0.3", "pod3", "nsB", sa3, "node1", map[string]string{"app": "prod-app"}, map[string]string{}),
+			}
+			addPods(t, controller, fx, pods...)
+
+			createService(controller, "svc1", "nsA",
+				map[string]string{
+					annotation.AlphaKubernetesServiceAccounts.Name: k8sSaOnVM,
+					annotation.AlphaCanonicalServiceAccounts.Name:  canonicalSaOnVM},
+				[]int32{8080}, map[string]string{"app": "prod-app"}, t)
+			fx.Wait("service")
+			createService(controller, "svc2", "nsA", nil, []int32{8080}, map[string]string{"app": "staging-app"}, t)
+			fx.Wait("service")
+
+			// Endpoints are generated by Kubernetes from pod labels and service selectors.
+			// Here we manually create them for mocking purpose.
+			svc1Ips := []string{"128.0.0.2"}
+			svc2Ips := make([]string, 0)
+			portNames := []string{"tcp-port"}
+			createEndpoints(controller, "svc1", "nsA", portNames, svc1Ips, nil, t)
+			createEndpoints(controller, "svc2", "nsA", portNames, svc2Ips, nil, t)
+
+			// We expect only one EDS update with Endpoints.
+			<-fx.Events
+
+			hostname := kube.ServiceHostname("svc1", "nsA", defaultFakeDomainSuffix)
+			svc, err := controller.GetService(hostname)
+			if err != nil {
+				t.Fatalf("failed to get service: %v", err)
+			}
+			sa := controller.GetIstioServiceAccounts(svc, []int{8080})
+			sort.Strings(sa)
+			expected := []string{
+				canonicalSaOnVM,
+				"spiffe://company.com/ns/nsA/sa/" + sa2,
+				"spiffe://company.com/ns/nsA/sa/" + k8sSaOnVM,
+			}
+			if !reflect.DeepEqual(sa, expected) {
+				t.Fatalf("Unexpected service accounts %v (expecting %v)", sa, expected)
+			}
+
+			hostname = kube.ServiceHostname("svc2", "nsA", defaultFakeDomainSuffix)
+			svc, err = controller.GetService(hostname)
+			if err != nil {
+				t.Fatalf("failed to get service: %v", err)
+			}
+			sa = controller.GetIstioServiceAccounts(svc, []int{})
+			if len(sa) != 0 {
+				t.Fatal("Failure: Expected to resolve 0 service accounts, but got: ", sa)
+			}
+		})
+	}
+}
+
+func TestController_Service(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{Mode: mode})
+			defer controller.Stop()
+			// Use a timeout to keep the test from hanging.
+
+			createService(controller, "svc1", "nsA",
+				map[string]string{},
+				[]int32{8080}, map[string]string{"test-app": "test-app-1"}, t)
+			<-fx.Events
+			createService(controller, "svc2", "nsA",
+				map[string]string{},
+				[]int32{8081}, map[string]string{"test-app": "test-app-2"}, t)
+			<-fx.Events
+			createService(controller, "svc3", "nsA",
+				map[string]string{},
+				[]int32{8082}, map[string]string{"test-app": "test-app-3"}, t)
+			<-fx.Events
+			createService(controller, "svc4", "nsA",
+				map[string]string{},
+				[]int32{8083}, map[string]string{"test-app": "test-app-4"}, t)
+			<-fx.Events
+
+			expectedSvcList := []*model.Service{
+				{
 					Hostname: kube.ServiceHostname("svc1", "nsA", defaultFakeDomainSuffix),
 					Address:  "10.0.0.1",
 					Ports: model.PortList{
@@ -822,61 +2945,852 @@ func TestController_Service(t *testing.T) {
 						},
 					},
 				},
-				{
-					Hostname: kube.ServiceHostname("svc2", "nsA", defaultFakeDomainSuffix),
-					Address:  "10.0.0.1",
-					Ports: model.PortList{
-						&model.Port{
-							Name:     "tcp-port",
-							Port:     8081,
-							Protocol: protocol.TCP,
-						},
-					},
+				{
+					Hostname: kube.ServiceHostname("svc2", "nsA", defaultFakeDomainSuffix),
+					Address:  "10.0.0.1",
+					Ports: model.PortList{
+						&model.Port{
+							Name:     "tcp-port",
+							Port:     8081,
+							Protocol: protocol.TCP,
+						},
+					},
+				},
+				{
+					Hostname: kube.ServiceHostname("svc3", "nsA", defaultFakeDomainSuffix),
+					Address:  "10.0.0.1",
+					Ports: model.PortList{
+						&model.Port{
+							Name:     "tcp-port",
+							Port:     8082,
+							Protocol: protocol.TCP,
+						},
+					},
+				},
+				{
+					Hostname: kube.ServiceHostname("svc4", "nsA", defaultFakeDomainSuffix),
+					Address:  "10.0.0.1",
+					Ports: model.PortList{
+						&model.Port{
+							Name:     "tcp-port",
+							Port:     8083,
+							Protocol: protocol.TCP,
+						},
+					},
+				},
+			}
+
+			svcList, _ := controller.Services()
+			if len(svcList) != len(expectedSvcList) {
+				t.Fatalf("Expecting %d service but got %d\r\n", len(expectedSvcList), len(svcList))
+			}
+			for i, exp := range expectedSvcList {
+				if exp.Hostname != svcList[i].Hostname {
+					t.Fatalf("got hostname of %dst service, got:\n%#v\nwanted:\n%#v\n", i, svcList[i].Hostname, exp.Hostname)
+				}
+				if exp.Address != svcList[i].Address {
+					t.Fatalf("got address of %dst service, got:\n%#v\nwanted:\n%#v\n", i, svcList[i].Address, exp.Address)
+				}
+				if !reflect.DeepEqual(exp.Ports, svcList[i].Ports) {
+					t.Fatalf("got ports of %dst service, got:\n%#v\nwanted:\n%#v\n", i, svcList[i].Ports, exp.Ports)
+				}
+			}
+		})
+	}
+}
+
+//
+func TestHeadlessServiceEndpointHostnames(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{Mode: mode})
+			defer controller.Stop()
+
+			createServiceWithoutClusterIP(controller, "web", "nsA", nil, []int32{8080}, map[string]string{"app": "web"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+
+			hostnames := map[string]string{"10.0.0.1": "web-0", "10.0.0.2": "web-1", "10.0.0.3": ""}
+			portName := "tcp-port"
+			var portNum int32 = 8080
+			var addresses []coreV1.EndpointAddress
+			var sliceEndpoints []discovery.Endpoint
+			for ip, hn := range hostnames {
+				hn := hn
+				addresses = append(addresses, coreV1.EndpointAddress{IP: ip, Hostname: hn})
+				sliceEndpoints = append(sliceEndpoints, discovery.Endpoint{Addresses: []string{ip}, Hostname: &hn})
+			}
+			endpoints := &coreV1.Endpoints{
+				ObjectMeta: metaV1.ObjectMeta{Name: "web", Namespace: "nsA"},
+				Subsets: []coreV1.EndpointSubset{{
+					Addresses: addresses,
+					Ports:     []coreV1.EndpointPort{{Name: portName, Port: portNum}},
+				}},
+			}
+			if _, err := controller.client.CoreV1().Endpoints("nsA").Create(context.TODO(), endpoints, metaV1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			slice := &discovery.EndpointSlice{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name:      "web-abcde",
+					Namespace: "nsA",
+					Labels:    map[string]string{discovery.LabelServiceName: "web", endpointSliceManagedByLabel: endpointSliceControllerName},
+				},
+				Endpoints: sliceEndpoints,
+				Ports:     []discovery.EndpointPort{{Name: &portName, Port: &portNum}},
+			}
+			if _, err := controller.client.DiscoveryV1beta1().EndpointSlices("nsA").Create(context.TODO(), slice, metaV1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			ev := fx.Wait("eds")
+			if ev == nil {
+				t.Fatal("Timeout incremental eds")
+			}
+			if len(ev.Endpoints) != len(hostnames) {
+				t.Fatalf("expected %d endpoints, got %d", len(hostnames), len(ev.Endpoints))
+			}
+			for _, ep := range ev.Endpoints {
+				want, f := hostnames[ep.Address]
+				if !f {
+					t.Fatalf("unexpected endpoint address %s", ep.Address)
+				}
+				if ep.HostName != want {
+					t.Errorf("endpoint %s: expected hostname %q, got %q", ep.Address, want, ep.HostName)
+				}
+				wantSubDomain := ""
+				if want != "" {
+					wantSubDomain = "web"
+				}
+				if ep.SubDomain != wantSubDomain {
+					t.Errorf("endpoint %s: expected subdomain %q, got %q", ep.Address, wantSubDomain, ep.SubDomain)
+				}
+			}
+		})
+	}
+}
+
+func TestExcludedPodPhases(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{
+				Mode:              mode,
+				ExcludedPodPhases: []coreV1.PodPhase{coreV1.PodFailed},
+			})
+			defer controller.Stop()
+
+			pod1 := generatePod("128.0.0.1", "pod1", "nsA", "", "node1", map[string]string{"app": "a"}, map[string]string{})
+			pod2 := generatePod("128.0.0.2", "pod2", "nsA", "", "node1", map[string]string{"app": "a"}, map[string]string{})
+			addPods(t, controller, fx, pod1, pod2)
+
+			createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "a"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			refs := []*coreV1.ObjectReference{
+				{Kind: "Pod", Name: "pod1", Namespace: "nsA"},
+				{Kind: "Pod", Name: "pod2", Namespace: "nsA"},
+			}
+			createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1", "128.0.0.2"}, refs, t)
+			ev := fx.Wait("eds")
+			if ev == nil {
+				t.Fatal("Timeout incremental eds")
+			}
+			if len(ev.Endpoints) != 2 {
+				t.Fatalf("expected 2 endpoints, got %d", len(ev.Endpoints))
+			}
+
+			// Kubernetes may still list the failed pod, but it must no longer be an endpoint.
+			failed, err := controller.client.CoreV1().Pods("nsA").Get(context.TODO(), "pod2", metaV1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			failed.Status.Phase = coreV1.PodFailed
+			if _, err := controller.client.CoreV1().Pods("nsA").UpdateStatus(context.TODO(), failed, metaV1.UpdateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			ev = fx.Wait("eds")
+			if ev == nil {
+				t.Fatal("Timeout incremental eds")
+			}
+			if len(ev.Endpoints) != 1 || ev.Endpoints[0].Address != "128.0.0.1" {
+				t.Fatalf("expected only endpoint 128.0.0.1, got %v", ev.Endpoints)
+			}
+		})
+	}
+}
+
+func TestRequireInjectedSidecar(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{
+				Mode:                   mode,
+				RequireInjectedSidecar: true,
+			})
+			defer controller.Stop()
+
+			injected := generatePod("128.0.0.1", "pod1", "nsA", "", "node1", map[string]string{"app": "a"},
+				map[string]string{annotation.SidecarStatus.Name: `{"version":"1"}`})
+			plain := generatePod("128.0.0.2", "pod2", "nsA", "", "node1", map[string]string{"app": "a"}, map[string]string{})
+			addPods(t, controller, fx, injected, plain)
+
+			createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "a"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1", "128.0.0.2"}, nil, t)
+			ev := fx.Wait("eds")
+			if ev == nil {
+				t.Fatal("Timeout incremental eds")
+			}
+			if len(ev.Endpoints) != 1 || ev.Endpoints[0].Address != "128.0.0.1" {
+				t.Fatalf("expected only endpoint 128.0.0.1, got %v", ev.Endpoints)
+			}
+		})
+	}
+}
+
+func TestDisableNodePortGatewayDiscovery(t *testing.T) {
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{DisableNodePortGatewayDiscovery: true})
+	defer controller.Stop()
+
+	svc := &coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:        "gateway",
+			Namespace:   "istio-system",
+			Annotations: map[string]string{kube.NodeSelectorAnnotation: "{}"},
+		},
+		Spec: coreV1.ServiceSpec{
+			ClusterIP: "10.0.0.1",
+			Ports:     []coreV1.ServicePort{{Name: "tls", Port: 15443, NodePort: 31443}},
+			Type:      coreV1.ServiceTypeNodePort,
+		},
+	}
+	if _, err := controller.client.CoreV1().Services("istio-system").Create(context.TODO(), svc, metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	fx.Clear()
+
+	node := generateNode("node1", map[string]string{})
+	node.Status.Addresses = []coreV1.NodeAddress{{Type: coreV1.NodeExternalIP, Address: "1.2.3.4"}}
+	if _, err := controller.client.CoreV1().Nodes().Create(context.TODO(), node, metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitForNode(controller, "node1"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case ev := <-fx.Events:
+		t.Fatalf("unexpected event %s for node add", ev.Type)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	controller.RLock()
+	defer controller.RUnlock()
+	if len(controller.nodeInfoMap) != 0 {
+		t.Errorf("expected no tracked nodes, got %v", controller.nodeInfoMap)
+	}
+	if len(controller.nodeSelectorsForServices) != 0 {
+		t.Errorf("expected no node selectors, got %v", controller.nodeSelectorsForServices)
+	}
+}
+
+func TestServiceDeleteGracePeriod(t *testing.T) {
+	gracePeriod := 300 * time.Millisecond
+	hostname := kube.ServiceHostname("svc1", "nsA", defaultFakeDomainSuffix)
+	deleteService := func(controller *FakeController) {
+		if err := controller.client.CoreV1().Services("nsA").Delete(context.TODO(), "svc1", metaV1.DeleteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	getService := func(controller *FakeController) *model.Service {
+		svc, _ := controller.GetService(hostname)
+		return svc
+	}
+
+	t.Run("recreated within grace period", func(t *testing.T) {
+		controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{ServiceDeleteGracePeriod: gracePeriod})
+		defer controller.Stop()
+		createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+		if ev := fx.Wait("service"); ev == nil {
+			t.Fatal("Timeout creating service")
+		}
+
+		deleteService(controller)
+		createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+		if ev := fx.Wait("service"); ev == nil {
+			t.Fatal("Timeout recreating service")
+		}
+		time.Sleep(2 * gracePeriod)
+		if getService(controller) == nil {
+			t.Fatal("expected service recreated within the grace period to be kept")
+		}
+		select {
+		case ev := <-fx.Events:
+			t.Fatalf("unexpected event %s for %s", ev.Type, ev.ID)
+		default:
+		}
+	})
+
+	t.Run("recreated after grace period", func(t *testing.T) {
+		controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{ServiceDeleteGracePeriod: gracePeriod})
+		defer controller.Stop()
+		createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+		if ev := fx.Wait("service"); ev == nil {
+			t.Fatal("Timeout creating service")
+		}
+
+		deleteService(controller)
+		start := time.Now()
+		if ev := fx.Wait("service"); ev == nil {
+			t.Fatal("Timeout deleting service")
+		}
+		if elapsed := time.Since(start); elapsed < gracePeriod {
+			t.Fatalf("expected service to be deleted after the grace period, deleted after %v", elapsed)
+		}
+		if getService(controller) != nil {
+			t.Fatal("expected service to be deleted")
+		}
+
+		createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+		if ev := fx.Wait("service"); ev == nil {
+			t.Fatal("Timeout recreating service")
+		}
+		if getService(controller) == nil {
+			t.Fatal("expected service to be recreated")
+		}
+	})
+}
+
+func TestNamespaceTerminationGracePeriod(t *testing.T) {
+	gracePeriod := 300 * time.Millisecond
+	hostname := kube.ServiceHostname("svc1", "nsA", defaultFakeDomainSuffix)
+	cases := []struct {
+		name        string
+		gracePeriod time.Duration
+		phase       coreV1.NamespacePhase
+		draining    bool
+	}{
+		{name: "terminating namespace with grace period", gracePeriod: gracePeriod, phase: coreV1.NamespaceTerminating, draining: true},
+		{name: "terminating namespace without grace period", phase: coreV1.NamespaceTerminating},
+		{name: "active namespace with grace period", gracePeriod: gracePeriod, phase: coreV1.NamespaceActive},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var drainingUpdates int32
+			controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{
+				NamespaceTerminationGracePeriod: tc.gracePeriod,
+				ServiceHandler: func(svc *model.Service, ev model.Event) {
+					svc.Mutex.RLock()
+					draining := svc.Attributes.Draining
+					svc.Mutex.RUnlock()
+					if ev == model.EventUpdate && draining {
+						atomic.AddInt32(&drainingUpdates, 1)
+					}
+				},
+			})
+			defer controller.Stop()
+
+			ns := &coreV1.Namespace{
+				ObjectMeta: metaV1.ObjectMeta{Name: "nsA"},
+				Status:     coreV1.NamespaceStatus{Phase: tc.phase},
+			}
+			if _, err := controller.client.CoreV1().Namespaces().Create(context.TODO(), ns, metaV1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if controller.namespaceLister != nil {
+				retry.UntilSuccessOrFail(t, func() error {
+					_, err := controller.namespaceLister.Get("nsA")
+					return err
+				}, retry.Timeout(5*time.Second))
+			}
+			createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+
+			if err := controller.client.CoreV1().Services("nsA").Delete(context.TODO(), "svc1", metaV1.DeleteOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			if tc.draining {
+				retry.UntilSuccessOrFail(t, func() error {
+					svc, _ := controller.GetService(hostname)
+					if svc == nil {
+						return fmt.Errorf("expected service to be retained")
+					}
+					svc.Mutex.RLock()
+					draining := svc.Attributes.Draining
+					svc.Mutex.RUnlock()
+					if !draining {
+						return fmt.Errorf("expected service to be draining")
+					}
+					return nil
+				}, retry.Timeout(gracePeriod/2))
+			}
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout deleting service")
+			}
+			elapsed := time.Since(start)
+			if tc.draining && elapsed < gracePeriod {
+				t.Fatalf("expected service to be deleted after the grace period, deleted after %v", elapsed)
+			}
+			if !tc.draining && elapsed >= gracePeriod {
+				t.Fatalf("expected service to be deleted immediately, deleted after %v", elapsed)
+			}
+			if svc, _ := controller.GetService(hostname); svc != nil {
+				t.Fatal("expected service to be deleted")
+			}
+			expectedUpdates := int32(0)
+			if tc.draining {
+				expectedUpdates = 1
+			}
+			if got := atomic.LoadInt32(&drainingUpdates); got != expectedUpdates {
+				t.Fatalf("expected %d update of the draining service, got %d", expectedUpdates, got)
+			}
+		})
+	}
+}
+
+func TestConfigClusterServices(t *testing.T) {
+	for _, configCluster := range []bool{true, false} {
+		configCluster := configCluster
+		t.Run(fmt.Sprint(configCluster), func(t *testing.T) {
+			controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{ConfigCluster: configCluster})
+			defer controller.Stop()
+
+			hostname := kube.ServiceHostname("svc1", "nsA", defaultFakeDomainSuffix)
+			createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			svc, _ := controller.GetService(hostname)
+			if svc == nil || svc.Attributes.FromConfigCluster != configCluster {
+				t.Fatalf("expected service with FromConfigCluster %v, got %v", configCluster, svc)
+			}
+
+			// the flag must be kept across updates
+			k8sSvc, err := controller.client.CoreV1().Services("nsA").Get(context.TODO(), "svc1", metaV1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			k8sSvc.Annotations = map[string]string{"foo": "bar"}
+			k8sSvc.ResourceVersion = "2"
+			if _, err := controller.client.CoreV1().Services("nsA").Update(context.TODO(), k8sSvc, metaV1.UpdateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout updating service")
+			}
+			svc, _ = controller.GetService(hostname)
+			if svc == nil || svc.Attributes.FromConfigCluster != configCluster {
+				t.Fatalf("expected updated service with FromConfigCluster %v, got %v", configCluster, svc)
+			}
+		})
+	}
+}
+
+func TestLoadBalancerGatewayAddresses(t *testing.T) {
+	cases := []struct {
+		name     string
+		ingress  []coreV1.LoadBalancerIngress
+		expected []string
+	}{
+		{
+			name:     "multiple ips",
+			ingress:  []coreV1.LoadBalancerIngress{{IP: "1.1.1.1"}, {IP: "2.2.2.2"}},
+			expected: []string{"1.1.1.1", "2.2.2.2"},
+		},
+		{
+			name:     "hostname",
+			ingress:  []coreV1.LoadBalancerIngress{{Hostname: "gw.example.com"}},
+			expected: []string{"gw.example.com"},
+		},
+		{
+			name:     "ipv6",
+			ingress:  []coreV1.LoadBalancerIngress{{IP: "2001:0DB8::0001"}, {IP: "1.1.1.1"}},
+			expected: []string{"1.1.1.1", "2001:db8::1"},
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{})
+			defer controller.Stop()
+
+			svc := &coreV1.Service{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name:      "gateway",
+					Namespace: "istio-system",
+					Labels:    map[string]string{label.IstioNetwork: "network1"},
+				},
+				Spec: coreV1.ServiceSpec{
+					ClusterIP: "10.0.0.1",
+					Ports:     []coreV1.ServicePort{{Name: "tls", Port: 15443}},
+					Type:      coreV1.ServiceTypeLoadBalancer,
+				},
+				Status: coreV1.ServiceStatus{
+					LoadBalancer: coreV1.LoadBalancerStatus{Ingress: tc.ingress},
+				},
+			}
+			if _, err := controller.client.CoreV1().Services("istio-system").Create(context.TODO(), svc, metaV1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+
+			var got []string
+			for _, gw := range controller.NetworkGateways()["network1"] {
+				if gw.Port != 15443 {
+					t.Errorf("expected gateway port 15443, got %d", gw.Port)
+				}
+				got = append(got, gw.Addr)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected gateways %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestIPv6NodePortGatewayAddresses(t *testing.T) {
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{})
+	defer controller.Stop()
+
+	node := generateNode("node1", map[string]string{})
+	node.Status.Addresses = []coreV1.NodeAddress{{Type: coreV1.NodeExternalIP, Address: "2001:db8:0:0::2"}}
+	addNodes(t, controller, node)
+
+	svc := &coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:        "gateway",
+			Namespace:   "istio-system",
+			Labels:      map[string]string{label.IstioNetwork: "network1"},
+			Annotations: map[string]string{kube.NodeSelectorAnnotation: "{}"},
+		},
+		Spec: coreV1.ServiceSpec{
+			ClusterIP: "10.0.0.1",
+			Ports:     []coreV1.ServicePort{{Name: "tls", Port: 15443, NodePort: 31443}},
+			Type:      coreV1.ServiceTypeNodePort,
+		},
+	}
+	if _, err := controller.client.CoreV1().Services("istio-system").Create(context.TODO(), svc, metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+
+	expected := []*model.Gateway{{Addr: "2001:db8::2", Port: 31443}}
+	retry.UntilSuccessOrFail(t, func() error {
+		if got := controller.NetworkGateways()["network1"]; !reflect.DeepEqual(got, expected) {
+			return fmt.Errorf("expected gateways %v, got %v", expected, got)
+		}
+		return nil
+	}, retry.Timeout(5*time.Second))
+}
+
+func TestSkipUnschedulableGatewayNodes(t *testing.T) {
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{SkipUnschedulableGatewayNodes: true})
+	defer controller.Stop()
+
+	svc := &coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:        "gateway",
+			Namespace:   "istio-system",
+			Annotations: map[string]string{kube.NodeSelectorAnnotation: "{}"},
+		},
+		Spec: coreV1.ServiceSpec{
+			ClusterIP: "10.0.0.1",
+			Ports:     []coreV1.ServicePort{{Name: "tls", Port: 15443, NodePort: 31443}},
+			Type:      coreV1.ServiceTypeNodePort,
+		},
+	}
+	if _, err := controller.client.CoreV1().Services("istio-system").Create(context.TODO(), svc, metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+
+	node1 := generateNode("node1", map[string]string{})
+	node1.ResourceVersion = "1"
+	node1.Status.Addresses = []coreV1.NodeAddress{{Type: coreV1.NodeExternalIP, Address: "1.1.1.1"}}
+	node2 := generateNode("node2", map[string]string{})
+	node2.ResourceVersion = "1"
+	node2.Spec.Taints = []coreV1.Taint{{Key: coreV1.TaintNodeUnschedulable, Effect: coreV1.TaintEffectNoSchedule}}
+	node2.Status.Addresses = []coreV1.NodeAddress{{Type: coreV1.NodeExternalIP, Address: "2.2.2.2"}}
+	addNodes(t, controller, node1, node2)
+
+	hostname := kube.ServiceHostname("gateway", "istio-system", defaultFakeDomainSuffix)
+	expectAddresses := func(expected []string) {
+		t.Helper()
+		retry.UntilSuccessOrFail(t, func() error {
+			svc, _ := controller.GetService(hostname)
+			if svc == nil {
+				return fmt.Errorf("service %s not found", hostname)
+			}
+			svc.Mutex.RLock()
+			addrs := append([]string{}, svc.Attributes.ClusterExternalAddresses[controller.clusterID]...)
+			svc.Mutex.RUnlock()
+			sort.Strings(addrs)
+			if !reflect.DeepEqual(addrs, expected) {
+				return fmt.Errorf("expected external addresses %v, got %v", expected, addrs)
+			}
+			return nil
+		}, retry.Timeout(5*time.Second))
+	}
+	expectAddresses([]string{"1.1.1.1"})
+
+	// cordon node1, and make node2 schedulable again
+	node1 = node1.DeepCopy()
+	node1.ResourceVersion = "2"
+	node1.Spec.Unschedulable = true
+	node2 = node2.DeepCopy()
+	node2.ResourceVersion = "2"
+	node2.Spec.Taints = nil
+	for _, node := range []*coreV1.Node{node1, node2} {
+		if _, err := controller.client.CoreV1().Nodes().Update(context.TODO(), node, metaV1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectAddresses([]string{"2.2.2.2"})
+}
+
+func TestNodeLabelChangePush(t *testing.T) {
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{})
+	defer controller.Stop()
+
+	svc := &coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:        "gateway",
+			Namespace:   "istio-system",
+			Annotations: map[string]string{kube.NodeSelectorAnnotation: `{"gateway": "true"}`},
+		},
+		Spec: coreV1.ServiceSpec{
+			ClusterIP: "10.0.0.1",
+			Ports:     []coreV1.ServicePort{{Name: "tls", Port: 15443, NodePort: 31443}},
+			Type:      coreV1.ServiceTypeNodePort,
+		},
+	}
+	if _, err := controller.client.CoreV1().Services("istio-system").Create(context.TODO(), svc, metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+
+	node := generateNode("node1", map[string]string{"gateway": "true"})
+	node.ResourceVersion = "1"
+	node.Status.Addresses = []coreV1.NodeAddress{{Type: coreV1.NodeExternalIP, Address: "1.1.1.1"}}
+	addNodes(t, controller, node)
+	if ev := fx.Wait("xds"); ev == nil {
+		t.Fatal("Timeout waiting for push on node add")
+	}
+	fx.Clear()
+
+	updateNode := func(version string, nodeLabels map[string]string) {
+		t.Helper()
+		node := node.DeepCopy()
+		node.ResourceVersion = version
+		node.Labels = nodeLabels
+		if _, err := controller.client.CoreV1().Nodes().Update(context.TODO(), node, metaV1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		retry.UntilSuccessOrFail(t, func() error {
+			controller.RLock()
+			defer controller.RUnlock()
+			if !controller.nodeInfoMap["node1"].labels.Equals(nodeLabels) {
+				return fmt.Errorf("node labels not updated")
+			}
+			return nil
+		}, retry.Timeout(5*time.Second))
+	}
+
+	// the label change does not affect which nodes the gateway selects
+	updateNode("2", map[string]string{"gateway": "true", "autoscaler": "scale-down"})
+	select {
+	case ev := <-fx.Events:
+		t.Fatalf("unexpected event %s for unrelated node label change", ev.Type)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// the node is no longer selected by the gateway
+	updateNode("3", map[string]string{"autoscaler": "scale-down"})
+	if ev := fx.Wait("xds"); ev == nil {
+		t.Fatal("Timeout waiting for push on node selector change")
+	}
+}
+
+func TestGatewayExternalAddressAnnotation(t *testing.T) {
+	cases := []struct {
+		name        string
+		annotations map[string]string
+		expected    []string
+	}{
+		{
+			name:        "node addresses",
+			annotations: map[string]string{kube.NodeSelectorAnnotation: "{}"},
+			expected:    []string{"1.1.1.1"},
+		},
+		{
+			name: "annotated addresses",
+			annotations: map[string]string{
+				kube.NodeSelectorAnnotation:           "{}",
+				kube.GatewayExternalAddressAnnotation: "5.5.5.5, 6.6.6.6",
+			},
+			expected: []string{"5.5.5.5", "6.6.6.6"},
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			controller, _ := NewFakeControllerWithOptions(FakeControllerOptions{})
+			defer controller.Stop()
+
+			node := generateNode("node1", map[string]string{})
+			node.Status.Addresses = []coreV1.NodeAddress{{Type: coreV1.NodeExternalIP, Address: "1.1.1.1"}}
+			addNodes(t, controller, node)
+
+			svc := &coreV1.Service{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name:        "gateway",
+					Namespace:   "istio-system",
+					Annotations: tc.annotations,
+				},
+				Spec: coreV1.ServiceSpec{
+					ClusterIP: "10.0.0.1",
+					Ports:     []coreV1.ServicePort{{Name: "tls", Port: 15443, NodePort: 31443}},
+					Type:      coreV1.ServiceTypeNodePort,
 				},
-				{
-					Hostname: kube.ServiceHostname("svc3", "nsA", defaultFakeDomainSuffix),
-					Address:  "10.0.0.1",
-					Ports: model.PortList{
-						&model.Port{
-							Name:     "tcp-port",
-							Port:     8082,
-							Protocol: protocol.TCP,
-						},
+			}
+			if _, err := controller.client.CoreV1().Services("istio-system").Create(context.TODO(), svc, metaV1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			hostname := kube.ServiceHostname("gateway", "istio-system", defaultFakeDomainSuffix)
+			retry.UntilSuccessOrFail(t, func() error {
+				svc, _ := controller.GetService(hostname)
+				if svc == nil {
+					return fmt.Errorf("service %s not found", hostname)
+				}
+				svc.Mutex.RLock()
+				addrs := append([]string{}, svc.Attributes.ClusterExternalAddresses[controller.clusterID]...)
+				svc.Mutex.RUnlock()
+				sort.Strings(addrs)
+				if !reflect.DeepEqual(addrs, tc.expected) {
+					return fmt.Errorf("expected external addresses %v, got %v", tc.expected, addrs)
+				}
+				return nil
+			}, retry.Timeout(time.Second*5))
+		})
+	}
+}
+
+func TestNodePortGatewayExternalTrafficPolicy(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		for _, policy := range []coreV1.ServiceExternalTrafficPolicyType{
+			coreV1.ServiceExternalTrafficPolicyTypeLocal, coreV1.ServiceExternalTrafficPolicyTypeCluster,
+		} {
+			mode, policy := mode, policy
+			t.Run(name+"/"+string(policy), func(t *testing.T) {
+				controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{Mode: mode})
+				defer controller.Stop()
+
+				node1 := generateNode("node1", map[string]string{})
+				node1.Status.Addresses = []coreV1.NodeAddress{{Type: coreV1.NodeExternalIP, Address: "1.1.1.1"}}
+				node2 := generateNode("node2", map[string]string{})
+				node2.Status.Addresses = []coreV1.NodeAddress{{Type: coreV1.NodeExternalIP, Address: "2.2.2.2"}}
+				addNodes(t, controller, node1, node2)
+				// both pods are selected, but only the endpoints of the service decide where traffic is forwarded
+				addPods(t, controller, fx,
+					generatePod("128.0.0.1", "gw1", "istio-system", "", "node1", map[string]string{"app": "gw"}, nil),
+					generatePod("128.0.0.2", "gw2", "istio-system", "", "node2", map[string]string{"app": "gw"}, nil))
+
+				svc := &coreV1.Service{
+					ObjectMeta: metaV1.ObjectMeta{
+						Name:        "gateway",
+						Namespace:   "istio-system",
+						Annotations: map[string]string{kube.NodeSelectorAnnotation: "{}"},
 					},
-				},
-				{
-					Hostname: kube.ServiceHostname("svc4", "nsA", defaultFakeDomainSuffix),
-					Address:  "10.0.0.1",
-					Ports: model.PortList{
-						&model.Port{
-							Name:     "tcp-port",
-							Port:     8083,
-							Protocol: protocol.TCP,
-						},
+					Spec: coreV1.ServiceSpec{
+						ClusterIP:             "10.0.0.1",
+						Ports:                 []coreV1.ServicePort{{Name: "tls", Port: 15443, NodePort: 31443}},
+						Selector:              map[string]string{"app": "gw"},
+						Type:                  coreV1.ServiceTypeNodePort,
+						ExternalTrafficPolicy: policy,
 					},
-				},
-			}
+				}
+				if _, err := controller.client.CoreV1().Services("istio-system").Create(context.TODO(), svc, metaV1.CreateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+				createEndpoints(controller, "gateway", "istio-system", []string{"tls"}, []string{"128.0.0.1"}, nil, t)
 
-			svcList, _ := controller.Services()
-			if len(svcList) != len(expectedSvcList) {
-				t.Fatalf("Expecting %d service but got %d\r\n", len(expectedSvcList), len(svcList))
-			}
-			for i, exp := range expectedSvcList {
-				if exp.Hostname != svcList[i].Hostname {
-					t.Fatalf("got hostname of %dst service, got:\n%#v\nwanted:\n%#v\n", i, svcList[i].Hostname, exp.Hostname)
+				hostname := kube.ServiceHostname("gateway", "istio-system", defaultFakeDomainSuffix)
+				expectAddresses := func(expected ...string) {
+					t.Helper()
+					retry.UntilSuccessOrFail(t, func() error {
+						svc, _ := controller.GetService(hostname)
+						if svc == nil {
+							return fmt.Errorf("service %s not found", hostname)
+						}
+						svc.Mutex.RLock()
+						addrs := append([]string{}, svc.Attributes.ClusterExternalAddresses[controller.clusterID]...)
+						svc.Mutex.RUnlock()
+						sort.Strings(addrs)
+						if !reflect.DeepEqual(addrs, expected) {
+							return fmt.Errorf("expected external addresses %v, got %v", expected, addrs)
+						}
+						return nil
+					}, retry.Timeout(time.Second*5))
 				}
-				if exp.Address != svcList[i].Address {
-					t.Fatalf("got address of %dst service, got:\n%#v\nwanted:\n%#v\n", i, svcList[i].Address, exp.Address)
+				if policy != coreV1.ServiceExternalTrafficPolicyTypeLocal {
+					expectAddresses("1.1.1.1", "2.2.2.2")
+					return
 				}
-				if !reflect.DeepEqual(exp.Ports, svcList[i].Ports) {
-					t.Fatalf("got ports of %dst service, got:\n%#v\nwanted:\n%#v\n", i, svcList[i].Ports, exp.Ports)
+				expectAddresses("1.1.1.1")
+
+				// an endpoint change that keeps the nodes of the gateway does not push
+				fx.Clear()
+				updateEndpoints(controller, "gateway", "istio-system", []string{"tls", "http"}, []string{"128.0.0.1"}, t)
+				if ev := fx.Wait("eds"); ev == nil {
+					t.Fatal("Timeout incremental eds")
 				}
-			}
-		})
+				timeout := time.After(300 * time.Millisecond)
+			drain:
+				for {
+					select {
+					case ev := <-fx.Events:
+						if ev.Type == "xds" {
+							t.Fatalf("unexpected full push for unchanged gateway addresses")
+						}
+					case <-timeout:
+						break drain
+					}
+				}
+
+				// the gateway moving to another node does
+				fx.Clear()
+				updateEndpoints(controller, "gateway", "istio-system", []string{"tls"}, []string{"128.0.0.2"}, t)
+				if ev := fx.Wait("xds"); ev == nil {
+					t.Fatal("Timeout waiting for full push")
+				}
+				expectAddresses("2.2.2.2")
+			})
+		}
 	}
 }
 
-//
 func TestExternalNameServiceInstances(t *testing.T) {
 	for mode, name := range EndpointModeNames {
 		mode := mode
@@ -901,6 +3815,44 @@ func TestExternalNameServiceInstances(t *testing.T) {
 	}
 }
 
+func TestJitter(t *testing.T) {
+	period := 10 * time.Second
+	for _, factor := range []float64{0.1, 0.5} {
+		min := time.Duration(float64(period) * (1 - factor))
+		max := time.Duration(float64(period) * (1 + factor))
+		for i := 0; i < 1000; i++ {
+			if got := jitter(period, factor); got < min || got > max {
+				t.Fatalf("jitter(%v, %v) = %v, expected within [%v, %v]", period, factor, got, min, max)
+			}
+		}
+	}
+	if got := jitter(period, -1); got != period {
+		t.Fatalf("expected no jitter for negative factor, got %v", got)
+	}
+}
+
+func TestController_ExternalNameInstances(t *testing.T) {
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{})
+	defer controller.Stop()
+	svc := createExternalNameService(controller, "svc1", "nsA", []int32{8080}, "foo.co", t, fx.Events)
+	createService(controller, "svc2", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+
+	instances := controller.ExternalNameInstances(kube.ServiceHostname("svc1", "nsA", defaultFakeDomainSuffix))
+	if len(instances) != 1 {
+		t.Fatalf("expected 1 instance, got %v", instances)
+	}
+	if instances[0].Endpoint.Address != svc.Spec.ExternalName {
+		t.Fatalf("expected address %s, got %s", svc.Spec.ExternalName, instances[0].Endpoint.Address)
+	}
+
+	if instances := controller.ExternalNameInstances(kube.ServiceHostname("svc2", "nsA", defaultFakeDomainSuffix)); instances != nil {
+		t.Fatalf("expected no instances for a ClusterIP service, got %v", instances)
+	}
+}
+
 func TestController_ExternalNameService(t *testing.T) {
 	for mode, name := range EndpointModeNames {
 		mode := mode
@@ -1078,7 +4030,8 @@ func createEndpoints(controller *FakeController, name, namespace string, portNam
 			Name:      name,
 			Namespace: namespace,
 			Labels: map[string]string{
-				discovery.LabelServiceName: name,
+				discovery.LabelServiceName:  name,
+				endpointSliceManagedByLabel: endpointSliceControllerName,
 			},
 		},
 		Endpoints: sliceEndpoint,
@@ -1130,7 +4083,8 @@ func updateEndpoints(controller *FakeController, name, namespace string, portNam
 			Name:      name,
 			Namespace: namespace,
 			Labels: map[string]string{
-				discovery.LabelServiceName: name,
+				discovery.LabelServiceName:  name,
+				endpointSliceManagedByLabel: endpointSliceControllerName,
 			},
 		},
 		Endpoints: []discovery.Endpoint{
@@ -1296,6 +4250,7 @@ func addPods(t *testing.T, controller *FakeController, fx *FakeXdsUpdater, pods
 			// Apiserver doesn't allow Create/Update to modify the pod status. Creating doesn't result in
 			// events - since PodIP will be "".
 			newPod.Status.PodIP = pod.Status.PodIP
+			newPod.Status.HostIP = pod.Status.HostIP
 			newPod.Status.Phase = coreV1.PodRunning
 			_, _ = controller.client.CoreV1().Pods(pod.Namespace).UpdateStatus(context.TODO(), newPod, metaV1.UpdateOptions{})
 			if err := waitForPod(controller, pod.Status.PodIP); err != nil {
@@ -1587,6 +4542,253 @@ func TestEndpointUpdateBeforePodUpdate(t *testing.T) {
 	}
 }
 
+func TestEDSDeduplication(t *testing.T) {
+	clusterID := "eds-dedup-cluster"
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{ClusterID: clusterID})
+	defer controller.Stop()
+
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "a"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"10.0.0.1", "10.0.0.2"}, nil, t)
+	if ev := fx.Wait("eds"); ev == nil {
+		t.Fatal("Timeout incremental eds")
+	}
+	fx.Clear()
+	cacheUpdates := getEDSUpdates(t, clusterID, "cache")
+
+	// a service update leaving the endpoints unchanged does not send them again
+	svc, err := controller.client.CoreV1().Services("nsA").Get(context.TODO(), "svc1", metaV1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.Annotations = map[string]string{"foo": "bar"}
+	if _, err := controller.client.CoreV1().Services("nsA").Update(context.TODO(), svc, metaV1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout updating service")
+	}
+	if got := getSumValue(t, "pilot_k8s_eds_deduped", clusterID); got != 1 {
+		t.Fatalf("expected 1 deduplicated update, got %v", got)
+	}
+	if got := getEDSUpdates(t, clusterID, "cache"); got != cacheUpdates {
+		t.Fatalf("expected no eds cache update, got %v", got-cacheUpdates)
+	}
+
+	// the endpoints of a re-created service are sent again
+	if err := controller.client.CoreV1().Services("nsA").Delete(context.TODO(), "svc1", metaV1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout deleting service")
+	}
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "a"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	if got := getEDSUpdates(t, clusterID, "cache"); got != cacheUpdates+1 {
+		t.Fatalf("expected 1 eds cache update, got %v", got-cacheUpdates)
+	}
+	if got := getSumValue(t, "pilot_k8s_eds_deduped", clusterID); got != 1 {
+		t.Fatalf("expected 1 deduplicated update, got %v", got)
+	}
+
+	// endpoint events are always sent, even if unchanged
+	updateEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"10.0.0.2", "10.0.0.1"}, t)
+	if ev := fx.Wait("eds"); ev == nil {
+		t.Fatal("Timeout incremental eds")
+	}
+}
+
+func TestWorkloadInstanceEDSDeduplication(t *testing.T) {
+	clusterID := "workload-dedup-cluster"
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{ClusterID: clusterID})
+	defer controller.Stop()
+
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	fx.Clear()
+
+	wi := &model.WorkloadInstance{
+		Name:      "workload",
+		Namespace: "nsA",
+		Endpoint: &model.IstioEndpoint{
+			Labels:       labels.Instance{"app": "prod-app"},
+			Address:      "2.2.2.2",
+			EndpointPort: 8080,
+		},
+	}
+	controller.WorkloadInstanceHandler(wi, model.EventAdd)
+	if ev := fx.Wait("eds"); ev == nil {
+		t.Fatal("Did not get eds event when workload entry was added")
+	}
+	deduped := getSumValue(t, "pilot_k8s_eds_deduped", clusterID)
+
+	// re-adding the same workload entry leaves the endpoints unchanged
+	controller.WorkloadInstanceHandler(wi, model.EventAdd)
+	select {
+	case ev := <-fx.Events:
+		if ev.Type == "eds" {
+			t.Fatalf("unexpected eds event for unchanged workload entry: %v", ev)
+		}
+	default:
+	}
+	if got := getSumValue(t, "pilot_k8s_eds_deduped", clusterID); got != deduped+1 {
+		t.Fatalf("expected 1 deduplicated update, got %v", got-deduped)
+	}
+
+	// a changed workload entry is pushed
+	controller.WorkloadInstanceHandler(&model.WorkloadInstance{
+		Name:      "workload",
+		Namespace: "nsA",
+		Endpoint: &model.IstioEndpoint{
+			Labels:       labels.Instance{"app": "prod-app", "version": "v2"},
+			Address:      "2.2.2.2",
+			EndpointPort: 8080,
+		},
+	}, model.EventUpdate)
+	if ev := fx.Wait("eds"); ev == nil {
+		t.Fatal("Did not get eds event when workload entry was updated")
+	}
+}
+
+func TestEndpointsPendingPodByNamespace(t *testing.T) {
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{})
+	defer controller.Stop()
+
+	addEndpoint := func(ns string, ips ...string) {
+		refs := make([]*coreV1.ObjectReference, 0, len(ips))
+		for i := range ips {
+			refs = append(refs, &coreV1.ObjectReference{Kind: "Pod", Namespace: ns, Name: fmt.Sprintf("pod%d", i)})
+		}
+		createEndpoints(controller, "svc", ns, []string{"tcp-port"}, ips, refs, t)
+	}
+	assertPending := func(expected map[string]float64) {
+		t.Helper()
+		retry.UntilSuccessOrFail(t, func() error {
+			for ns, want := range expected {
+				if got := getTaggedGaugeValue(t, "pilot_k8s_endpoints_pending_pod_by_namespace", "namespace", ns); got != want {
+					return fmt.Errorf("namespace %s: expected %v pending endpoints, got %v", ns, want, got)
+				}
+			}
+			return nil
+		}, retry.Timeout(5*time.Second))
+	}
+
+	// none of the pods exist yet
+	addEndpoint("pendingA", "172.0.2.1", "172.0.2.2")
+	addEndpoint("pendingB", "172.0.3.1")
+	assertPending(map[string]float64{"pendingA": 2, "pendingB": 1})
+
+	// the arrival of a pod only resolves its own namespace
+	addPods(t, controller, fx, generatePod("172.0.2.1", "pod0", "pendingA", "", "", nil, nil))
+	assertPending(map[string]float64{"pendingA": 1, "pendingB": 1})
+
+	// deleting the endpoints resets the namespace
+	if err := controller.client.CoreV1().Endpoints("pendingB").Delete(context.TODO(), "svc", metaV1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	assertPending(map[string]float64{"pendingA": 1, "pendingB": 0})
+
+	// an IP counts once per namespace, however many endpoints of the namespace wait for it
+	pc := controller.pods
+	pc.queueEndpointEventOnPodArrival("pendingC/svc1", "172.0.4.1")
+	pc.queueEndpointEventOnPodArrival("pendingC/svc2", "172.0.4.1")
+	pc.queueEndpointEventOnPodArrival("pendingC/svc2", "172.0.4.1")
+	pc.queueEndpointEventOnPodArrival("pendingD/svc1", "172.0.4.1")
+	assertPending(map[string]float64{"pendingC": 1, "pendingD": 1})
+	pc.endpointDeleted("pendingC/svc1", "172.0.4.1")
+	assertPending(map[string]float64{"pendingC": 1, "pendingD": 1})
+	pc.endpointDeleted("pendingC/svc2", "172.0.4.1")
+	assertPending(map[string]float64{"pendingC": 0, "pendingD": 1})
+	pc.endpointDeleted("pendingD/svc1", "172.0.4.1")
+	assertPending(map[string]float64{"pendingC": 0, "pendingD": 0})
+}
+
+type fakeHealthChecker map[string]bool
+
+func (f fakeHealthChecker) Healthy(ip string, _ int) bool {
+	return !f[ip]
+}
+
+func TestEndpointHealthChecker(t *testing.T) {
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{
+		EndpointHealthChecker: fakeHealthChecker{"2.2.2.2": true},
+	})
+	defer controller.Stop()
+
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	for _, ip := range []string{"2.2.2.2", "3.3.3.3"} {
+		controller.WorkloadInstanceHandler(&model.WorkloadInstance{
+			Name:      "workload-" + ip,
+			Namespace: "nsA",
+			Endpoint: &model.IstioEndpoint{
+				Labels:       labels.Instance{"app": "prod-app"},
+				Address:      ip,
+				EndpointPort: 8080,
+			},
+		}, model.EventAdd)
+	}
+
+	svc, _ := controller.GetService(kube.ServiceHostname("svc1", "nsA", defaultFakeDomainSuffix))
+	if svc == nil {
+		t.Fatal("service not found")
+	}
+	instances := controller.InstancesByPort(svc, 8080, labels.Collection{})
+	if len(instances) != 1 || instances[0].Endpoint.Address != "3.3.3.3" {
+		t.Fatalf("expected only the healthy workload instance 3.3.3.3, got %v", instances)
+	}
+}
+
+func TestEndpointHealthChanged(t *testing.T) {
+	checker := fakeHealthChecker{"2.2.2.2": true}
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{
+		EndpointHealthChecker: checker,
+	})
+	defer controller.Stop()
+
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	for _, ip := range []string{"2.2.2.2", "3.3.3.3"} {
+		controller.WorkloadInstanceHandler(&model.WorkloadInstance{
+			Name:      "workload-" + ip,
+			Namespace: "nsA",
+			Endpoint: &model.IstioEndpoint{
+				Labels:       labels.Instance{"app": "prod-app"},
+				Address:      ip,
+				EndpointPort: 8080,
+			},
+		}, model.EventAdd)
+	}
+	fx.Clear()
+
+	// unknown addresses are ignored
+	controller.EndpointHealthChanged("4.4.4.4")
+	delete(checker, "2.2.2.2")
+	controller.EndpointHealthChanged("2.2.2.2")
+	ev := fx.Wait("eds")
+	if ev == nil {
+		t.Fatal("Timeout incremental eds")
+	}
+	var got []string
+	for _, ep := range ev.Endpoints {
+		got = append(got, ep.Address)
+	}
+	sort.Strings(got)
+	if expected := []string{"2.2.2.2", "3.3.3.3"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected endpoints %v once 2.2.2.2 is healthy, got %v", expected, got)
+	}
+}
+
 func TestWorkloadInstanceHandlerMultipleEndpoints(t *testing.T) {
 	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{})
 	defer controller.Stop()
@@ -1678,3 +4880,154 @@ func TestWorkloadInstanceHandlerMultipleEndpoints(t *testing.T) {
 		}
 	}
 }
+
+func BenchmarkServiceInstancesFromWorkloadInstances(b *testing.B) {
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{})
+	defer controller.Stop()
+
+	service := &coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{Name: "svc", Namespace: "ns0"},
+		Spec: coreV1.ServiceSpec{
+			ClusterIP: "10.0.0.1",
+			Ports:     []coreV1.ServicePort{{Name: "http", Port: 80}},
+			Selector:  map[string]string{"app": "a"},
+			Type:      coreV1.ServiceTypeClusterIP,
+		},
+	}
+	if _, err := controller.client.CoreV1().Services("ns0").Create(context.TODO(), service, metaV1.CreateOptions{}); err != nil {
+		b.Fatal(err)
+	}
+	if ev := fx.Wait("service"); ev == nil {
+		b.Fatal("Timeout creating service")
+	}
+	svc, err := controller.GetService(kube.ServiceHostname("svc", "ns0", defaultFakeDomainSuffix))
+	if err != nil || svc == nil {
+		b.Fatalf("service not found: %v", err)
+	}
+
+	// 100 workload entries in each of 100 namespaces, only one of which the service selects from.
+	controller.Lock()
+	for n := 0; n < 100; n++ {
+		for i := 0; i < 100; i++ {
+			controller.addWorkloadInstanceLocked(&model.WorkloadInstance{
+				Name:      fmt.Sprintf("we-%d", i),
+				Namespace: fmt.Sprintf("ns%d", n),
+				Endpoint: &model.IstioEndpoint{
+					Address: fmt.Sprintf("10.%d.%d.%d", n, i/256, i%256),
+					Labels:  labels.Instance{"app": "a"},
+				},
+			})
+		}
+	}
+	controller.Unlock()
+
+	b.Run("partitioned", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			if got := controller.serviceInstancesFromWorkloadInstances(svc, 80); len(got) != 100 {
+				b.Fatalf("expected 100 instances, got %d", len(got))
+			}
+		}
+	})
+	b.Run("full scan", func(b *testing.B) {
+		selector := labels.Instance(svc.Attributes.LabelSelectors)
+		for n := 0; n < b.N; n++ {
+			out := make([]*model.ServiceInstance, 0)
+			controller.RLock()
+			for _, wi := range controller.workloadInstancesByIP {
+				if wi.Namespace == svc.Attributes.Namespace && selector.SubsetOf(wi.Endpoint.Labels) {
+					istioEndpoint := *wi.Endpoint
+					istioEndpoint.EndpointPort = 80
+					out = append(out, &model.ServiceInstance{Service: svc, ServicePort: svc.Ports[0], Endpoint: &istioEndpoint})
+				}
+			}
+			controller.RUnlock()
+			if len(out) != 100 {
+				b.Fatalf("expected 100 instances, got %d", len(out))
+			}
+		}
+	})
+}
+
+// generateLargeEndpoints returns Endpoints with n addresses split over two subsets, as a large headless service has.
+func generateLargeEndpoints(name, namespace string, n int) *coreV1.Endpoints {
+	ep := &coreV1.Endpoints{
+		ObjectMeta: metaV1.ObjectMeta{Name: name, Namespace: namespace},
+		Subsets: []coreV1.EndpointSubset{
+			{Ports: []coreV1.EndpointPort{{Name: "tcp-port", Port: 8080}}},
+			{Ports: []coreV1.EndpointPort{{Name: "tcp-port", Port: 8080}, {Name: "http-port", Port: 9090}}},
+		},
+	}
+	for i := 0; i < n; i++ {
+		ss := &ep.Subsets[i%2]
+		ss.Addresses = append(ss.Addresses, coreV1.EndpointAddress{
+			IP:       fmt.Sprintf("10.%d.%d.%d", i/65536, (i/256)%256, i%256),
+			Hostname: fmt.Sprintf("pod-%d", i),
+		})
+	}
+	return ep
+}
+
+func TestParallelEndpointBuild(t *testing.T) {
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{
+		Mode:                           EndpointsOnly,
+		EndpointBuildWorkers:           4,
+		EndpointBuildParallelThreshold: 10,
+	})
+	defer controller.Stop()
+
+	createServiceWithoutClusterIP(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "a"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	if err := controller.endpoints.getInformer().GetStore().Add(generateLargeEndpoints("svc1", "nsA", 101)); err != nil {
+		t.Fatal(err)
+	}
+
+	hostname := kube.ServiceHostname("svc1", "nsA", defaultFakeDomainSuffix)
+	parallel := controller.endpoints.buildIstioEndpointsWithService("svc1", "nsA", hostname)
+	controller.endpointBuildWorkers = 0
+	serial := controller.endpoints.buildIstioEndpointsWithService("svc1", "nsA", hostname)
+	// 51 addresses with one port and 50 with two
+	if len(parallel) != 151 {
+		t.Fatalf("expected 151 endpoints, got %d", len(parallel))
+	}
+	if !reflect.DeepEqual(parallel, serial) {
+		t.Fatal("endpoints built in parallel differ from the endpoints built serially")
+	}
+}
+
+func BenchmarkBuildLargeHeadlessServiceEndpoints(b *testing.B) {
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{Mode: EndpointsOnly})
+	defer controller.Stop()
+
+	service := &coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{Name: "svc", Namespace: "nsA"},
+		Spec: coreV1.ServiceSpec{
+			ClusterIP: coreV1.ClusterIPNone,
+			Ports:     []coreV1.ServicePort{{Name: "tcp-port", Port: 8080}},
+			Selector:  map[string]string{"app": "a"},
+			Type:      coreV1.ServiceTypeClusterIP,
+		},
+	}
+	if _, err := controller.client.CoreV1().Services("nsA").Create(context.TODO(), service, metaV1.CreateOptions{}); err != nil {
+		b.Fatal(err)
+	}
+	if ev := fx.Wait("service"); ev == nil {
+		b.Fatal("Timeout creating service")
+	}
+	if err := controller.endpoints.getInformer().GetStore().Add(generateLargeEndpoints("svc", "nsA", 20000)); err != nil {
+		b.Fatal(err)
+	}
+	hostname := kube.ServiceHostname("svc", "nsA", defaultFakeDomainSuffix)
+
+	for _, workers := range []int{1, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			controller.endpointBuildWorkers = workers
+			for n := 0; n < b.N; n++ {
+				if got := controller.endpoints.buildIstioEndpointsWithService("svc", "nsA", hostname); len(got) != 30000 {
+					b.Fatalf("expected 30000 endpoints, got %d", len(got))
+				}
+			}
+		})
+	}
+}
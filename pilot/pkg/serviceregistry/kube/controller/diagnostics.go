@@ -0,0 +1,144 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/labels"
+	kubelib "istio.io/istio/pkg/kube"
+)
+
+// ControllerDiagnostics is a snapshot of the state of a Controller, intended for support bundles.
+type ControllerDiagnostics struct {
+	ClusterID    string
+	EndpointMode EndpointMode
+	// Synced is true once the initial sync of all resources has completed.
+	Synced bool
+	// QueueDepth is the number of events waiting to be processed.
+	QueueDepth int
+
+	// Services is the number of services known to the registry, including aliases.
+	Services int
+	// PendingServiceDeletes is the number of deleted services retained for a grace period.
+	PendingServiceDeletes int
+	// Endpoints is hostname => number of endpoints, for services with endpoints.
+	Endpoints map[host.Name]int
+
+	// Nodes is node name => address, for nodes used by nodePort gateway services.
+	Nodes map[string]string
+
+	// Network is the default network of the cluster.
+	Network string
+	// ServiceNetworks is hostname => network forced by the service annotation.
+	ServiceNetworks map[host.Name]string
+	// ObservedNetworks are the distinct networks of the endpoints built, sorted.
+	ObservedNetworks []string
+	// NetworkGateways is network => number of gateways.
+	NetworkGateways map[string]int
+}
+
+// Describe returns a snapshot of the state of the controller. The state of the registry is read under a
+// single read lock, while endpoints are built from the informer caches afterwards, so the two may differ
+// slightly if events are processed concurrently.
+func (c *Controller) Describe() ControllerDiagnostics {
+	out := ControllerDiagnostics{
+		ClusterID:       c.clusterID,
+		EndpointMode:    c.endpointMode,
+		QueueDepth:      c.queue.Len(),
+		Endpoints:       make(map[host.Name]int),
+		Nodes:           make(map[string]string),
+		ServiceNetworks: make(map[host.Name]string),
+		NetworkGateways: make(map[string]int),
+	}
+
+	c.RLock()
+	out.Synced = c.initialSyncDone
+	out.Services = len(c.servicesMap)
+	out.PendingServiceDeletes = len(c.pendingServiceDeletes)
+	for name, node := range c.nodeInfoMap {
+		out.Nodes[name] = node.address
+	}
+	out.Network = c.network
+	for hostname, nw := range c.serviceNetworks {
+		out.ServiceNetworks[hostname] = nw
+	}
+	out.ObservedNetworks = make([]string, 0, len(c.networkServices))
+	for nw := range c.networkServices {
+		out.ObservedNetworks = append(out.ObservedNetworks, nw)
+	}
+	for _, netGws := range c.networkGateways {
+		for nw, gws := range netGws {
+			out.NetworkGateways[nw] += len(gws)
+		}
+	}
+	c.RUnlock()
+	sort.Strings(out.ObservedNetworks)
+
+	for hostname, endpoints := range c.AllEndpoints() {
+		out.Endpoints[hostname] = len(endpoints)
+	}
+	return out
+}
+
+// ExplainPodEndpoint returns a human readable diagnosis of why the pod is, or is not, an endpoint of the
+// service. Conditions are checked in the order endpoints are built, and the first failing one is reported.
+func (c *Controller) ExplainPodEndpoint(namespace, podName string, hostname host.Name) string {
+	c.RLock()
+	svc := c.servicesMap[hostname]
+	c.RUnlock()
+	if svc == nil {
+		return fmt.Sprintf("service %s not found", hostname)
+	}
+
+	item, exists, err := c.pods.informer.GetStore().GetByKey(kube.KeyFunc(podName, namespace))
+	pod, ok := item.(*v1.Pod)
+	if err != nil || !exists || !ok {
+		return fmt.Sprintf("pod %s/%s not found", namespace, podName)
+	}
+	if !c.podNamespaceDiscovered(namespace) {
+		return fmt.Sprintf("pods of namespace %s are excluded from discovery", namespace)
+	}
+	// services without a selector have manually managed endpoints, which may still list the pod
+	if selector := labels.Instance(svc.Attributes.LabelSelectors); len(selector) > 0 &&
+		(namespace != svc.Attributes.Namespace || !selector.SubsetOf(pod.Labels)) {
+		return fmt.Sprintf("pod %s/%s is not selected by service %s", namespace, podName, hostname)
+	}
+	if c.podPhaseExcluded(pod) {
+		return fmt.Sprintf("pod %s/%s is in excluded phase %s", namespace, podName, pod.Status.Phase)
+	}
+	if c.podSidecarMissing(pod) {
+		return fmt.Sprintf("pod %s/%s has no sidecar injected", namespace, podName)
+	}
+	if pod.Status.PodIP == "" {
+		return fmt.Sprintf("pod %s/%s has no IP", namespace, podName)
+	}
+	if err := kubelib.CheckPodReady(pod); err != nil {
+		return fmt.Sprintf("pod %s/%s is not ready: %v", namespace, podName, err)
+	}
+
+	address := c.rewriteEndpointAddress(pod.Status.PodIP, pod)
+	for _, ep := range c.endpoints.snapshotIstioEndpoints(svc.Attributes.Name, svc.Attributes.Namespace, hostname) {
+		if ep.Address == address {
+			return fmt.Sprintf("pod %s/%s is an endpoint of service %s", namespace, podName, hostname)
+		}
+	}
+	return fmt.Sprintf("pod %s/%s is not in the ready endpoints of service %s", namespace, podName, hostname)
+}
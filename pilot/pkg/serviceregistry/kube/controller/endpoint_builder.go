@@ -31,9 +31,12 @@ import (
 // A stateful IstioEndpoint builder with metadata used to build IstioEndpoint
 type EndpointBuilder struct {
 	controller controllerInterface
+	// pod the endpoints are built for, if any
+	pod *v1.Pod
 
 	labels         labels.Instance
 	metaNetwork    string
+	serviceNetwork string
 	serviceAccount string
 	locality       model.Locality
 	tlsMode        string
@@ -43,11 +46,9 @@ type EndpointBuilder struct {
 
 func NewEndpointBuilder(c controllerInterface, pod *v1.Pod) *EndpointBuilder {
 	locality, sa, wn, namespace := "", "", "", ""
-	var podLabels labels.Instance
 	if pod != nil {
 		locality = c.getPodLocality(pod)
 		sa = kube.SecureNamingSAN(pod)
-		podLabels = pod.Labels
 		namespace = pod.Namespace
 	}
 	dm, _ := kubeUtil.GetDeployMetaFromPod(pod)
@@ -57,7 +58,8 @@ func NewEndpointBuilder(c controllerInterface, pod *v1.Pod) *EndpointBuilder {
 
 	return &EndpointBuilder{
 		controller:     c,
-		labels:         augmentLabels(podLabels, c.Cluster(), locality),
+		pod:            pod,
+		labels:         podEndpointLabels(c, pod, locality, c.endpointLabelAllowlist()),
 		serviceAccount: sa,
 		locality: model.Locality{
 			Label:     locality,
@@ -74,7 +76,7 @@ func NewEndpointBuilderFromMetadata(c controllerInterface, proxy *model.Proxy) *
 	return &EndpointBuilder{
 		controller:     c,
 		metaNetwork:    proxy.Metadata.Network,
-		labels:         augmentLabels(proxy.Metadata.Labels, c.Cluster(), locality),
+		labels:         augmentLabels(filterLabels(proxy.Metadata.Labels, c.endpointLabelAllowlist()), c.Cluster(), locality),
 		serviceAccount: proxy.Metadata.ServiceAccount,
 		locality: model.Locality{
 			Label:     locality,
@@ -84,6 +86,62 @@ func NewEndpointBuilderFromMetadata(c controllerInterface, proxy *model.Proxy) *
 	}
 }
 
+// podEndpointLabels returns the labels of endpoints of the pod, keeping the pod labels in allowlist.
+func podEndpointLabels(c controllerInterface, pod *v1.Pod, locality string, allowlist map[string]struct{}) labels.Instance {
+	var podLabels labels.Instance
+	if pod != nil {
+		podLabels = pod.Labels
+	}
+	epLabels := augmentLabels(filterLabels(podLabels, allowlist), c.Cluster(), locality)
+	for k, v := range c.spreadTopologyLabels(pod) {
+		if _, f := epLabels[k]; !f {
+			epLabels[k] = v
+		}
+	}
+	return epLabels
+}
+
+// withUnfilteredLabels keeps all the labels of the pod, ignoring the endpoint label allowlist, which only
+// applies to the endpoints sent over EDS. Workload instances are matched against workload selectors, so
+// they need the full set of labels.
+func (b *EndpointBuilder) withUnfilteredLabels() *EndpointBuilder {
+	b.labels = podEndpointLabels(b.controller, b.pod, b.locality.Label, nil)
+	return b
+}
+
+// withServiceNetwork sets the network forced by the service of the endpoints being built, if any.
+func (b *EndpointBuilder) withServiceNetwork(network string) *EndpointBuilder {
+	b.serviceNetwork = network
+	return b
+}
+
+// mandatoryEndpointLabels are labels kept on endpoints regardless of the configured allowlist.
+var mandatoryEndpointLabels = map[string]struct{}{
+	NodeRegionLabelGA:  {},
+	NodeZoneLabelGA:    {},
+	label.IstioSubZone: {},
+	label.IstioCluster: {},
+	label.IstioNetwork: {},
+	label.TLSMode:      {},
+}
+
+// filterLabels returns the labels whose keys are in allowlist or mandatoryEndpointLabels.
+// All labels are returned when allowlist is nil.
+func filterLabels(in labels.Instance, allowlist map[string]struct{}) labels.Instance {
+	if allowlist == nil {
+		return in
+	}
+	out := make(labels.Instance, len(in))
+	for k, v := range in {
+		_, allowed := allowlist[k]
+		_, mandatory := mandatoryEndpointLabels[k]
+		if allowed || mandatory {
+			out[k] = v
+		}
+	}
+	return out
+}
+
 // augmentLabels adds additional labels to the those provided.
 func augmentLabels(in labels.Instance, clusterID, locality string) labels.Instance {
 	// Copy the original labels to a new map.
@@ -116,6 +174,7 @@ func (b *EndpointBuilder) buildIstioEndpoint(
 	if b == nil {
 		return nil
 	}
+	endpointAddress = b.controller.rewriteEndpointAddress(endpointAddress, b.pod)
 
 	return &model.IstioEndpoint{
 		Labels:          b.labels,
@@ -133,6 +192,14 @@ func (b *EndpointBuilder) buildIstioEndpoint(
 
 // return the mesh network for the endpoint IP. Empty string if not found.
 func (b *EndpointBuilder) endpointNetwork(endpointIP string) string {
+	// A network forced by the service takes precedence over the CIDR lookup, but not over the pod label.
+	if b.serviceNetwork != "" {
+		if nw := b.labels[label.IstioNetwork]; nw != "" {
+			return nw
+		}
+		return b.serviceNetwork
+	}
+
 	// Try to determine the network by checking whether the endpoint IP belongs
 	// to any of the configure networks' CIDR ranges
 	if b.controller.cidrRanger() != nil {
@@ -141,11 +208,8 @@ func (b *EndpointBuilder) endpointNetwork(endpointIP string) string {
 			log.Errora(err)
 			return ""
 		}
-		if len(entries) > 1 {
-			log.Warnf("Found multiple networks CIDRs matching the endpoint IP: %s. Using the first match.", endpointIP)
-		}
-		if len(entries) > 0 {
-			return (entries[0].(namedRangerEntry)).name
+		if nw := selectNetwork(entries, b.controller.multiNetworkMatchPolicy(), endpointIP, b.controller.Cluster()); nw != "" {
+			return nw
 		}
 	}
 
@@ -90,6 +90,29 @@ func TestNewEndpointBuilderTopologyLabels(t *testing.T) {
 				label.IstioNetwork: "mynetwork",
 			},
 		},
+		{
+			name: "label allowlist",
+			ctl: testController{
+				locality:       "myregion/myzone",
+				cluster:        "mycluster",
+				labelAllowlist: map[string]struct{}{"app": {}},
+			},
+			podLabels: labels.Instance{
+				"app":                 "myapp",
+				"pod-template-hash":   "abcdef",
+				label.IstioNetwork:    "mynetwork",
+				label.TLSMode:         model.IstioMutualTLSModeLabel,
+				"controller-revision": "1",
+			},
+			expected: labels.Instance{
+				"app":              "myapp",
+				NodeRegionLabelGA:  "myregion",
+				NodeZoneLabelGA:    "myzone",
+				label.IstioCluster: "mycluster",
+				label.IstioNetwork: "mynetwork",
+				label.TLSMode:      model.IstioMutualTLSModeLabel,
+			},
+		},
 	}
 
 	for _, c := range cases {
@@ -109,6 +132,33 @@ func TestNewEndpointBuilderTopologyLabels(t *testing.T) {
 	}
 }
 
+func TestNewEndpointBuilderUnfilteredLabels(t *testing.T) {
+	ctl := testController{
+		locality:       "myregion/myzone",
+		cluster:        "mycluster",
+		labelAllowlist: map[string]struct{}{"app": {}},
+	}
+	pod := v1.Pod{}
+	pod.Name = "testpod"
+	pod.Namespace = "testns"
+	pod.Labels = labels.Instance{
+		"app":               "myapp",
+		"version":           "v1",
+		"pod-template-hash": "abcdef",
+	}
+
+	g := NewGomegaWithT(t)
+	g.Expect(NewEndpointBuilder(ctl, &pod).labels).ShouldNot(HaveKey("version"))
+	g.Expect(NewEndpointBuilder(ctl, &pod).withUnfilteredLabels().labels).Should(Equal(labels.Instance{
+		"app":               "myapp",
+		"version":           "v1",
+		"pod-template-hash": "abcdef",
+		NodeRegionLabelGA:   "myregion",
+		NodeZoneLabelGA:     "myzone",
+		label.IstioCluster:  "mycluster",
+	}))
+}
+
 func TestNewEndpointBuilderFromMetadataTopologyLabels(t *testing.T) {
 	cases := []struct {
 		name     string
@@ -209,8 +259,9 @@ func TestNewEndpointBuilderFromMetadataTopologyLabels(t *testing.T) {
 var _ controllerInterface = testController{}
 
 type testController struct {
-	locality string
-	cluster  string
+	locality       string
+	cluster        string
+	labelAllowlist map[string]struct{}
 }
 
 func (c testController) getPodLocality(*v1.Pod) string {
@@ -221,6 +272,22 @@ func (c testController) cidrRanger() cidranger.Ranger {
 	return nil
 }
 
+func (c testController) multiNetworkMatchPolicy() MultiNetworkMatchPolicy {
+	return LongestPrefix
+}
+
+func (c testController) endpointLabelAllowlist() map[string]struct{} {
+	return c.labelAllowlist
+}
+
+func (c testController) spreadTopologyLabels(*v1.Pod) labels.Instance {
+	return nil
+}
+
+func (c testController) rewriteEndpointAddress(address string, _ *v1.Pod) string {
+	return address
+}
+
 func (c testController) defaultNetwork() string {
 	return ""
 }
@@ -15,10 +15,17 @@
 package controller
 
 import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/tools/cache"
 
+	"istio.io/api/annotation"
 	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/serviceregistry/kube"
@@ -40,6 +47,11 @@ type kubeEndpointsController interface {
 	GetProxyServiceInstances(c *Controller, proxy *model.Proxy) []*model.ServiceInstance
 	buildIstioEndpoints(ep interface{}, host host.Name) []*model.IstioEndpoint
 	buildIstioEndpointsWithService(name, namespace string, host host.Name) []*model.IstioEndpoint
+	// snapshotIstioEndpoints builds the endpoints of the service like buildIstioEndpointsWithService, without
+	// updating any state of the controller, so it is safe to call outside of the event queue.
+	snapshotIstioEndpoints(name, namespace string, host host.Name) []*model.IstioEndpoint
+	// readyEndpointNodes returns the names of the nodes hosting the ready endpoints of the service.
+	readyEndpointNodes(name, namespace string) map[string]struct{}
 	// forgetEndpoint does internal bookkeeping on a deleted endpoint
 	forgetEndpoint(endpoint interface{})
 	getServiceInfo(ep interface{}) (host.Name, string, string)
@@ -61,15 +73,19 @@ func (e *kubeEndpoints) Run(stopCh <-chan struct{}) {
 
 // processEndpointEvent triggers the config update.
 func processEndpointEvent(c *Controller, epc kubeEndpointsController, name string, namespace string, event model.Event, ep interface{}) error {
+	if c.namespaceExcluded(namespace) {
+		return nil
+	}
 	// Update internal endpoint cache no matter what kind of service, even headless service.
 	// As for gateways, the cluster discovery type is `EDS` for headless service.
 	updateEDS(c, epc, ep, event)
+	c.updateLocalNodePortGatewayAddresses(name, namespace)
 	if features.EnableHeadlessService {
 		if svc, _ := c.serviceLister.Services(namespace).Get(name); svc != nil {
 			// if the service is headless service, trigger a full push.
 			if svc.Spec.ClusterIP == v1.ClusterIPNone {
 				hostname := kube.ServiceHostname(svc.Name, svc.Namespace, c.domainSuffix)
-				c.xdsUpdater.ConfigUpdate(&model.PushRequest{
+				c.fullPush(&model.PushRequest{
 					Full: true,
 					// TODO: extend and set service instance type, so no need to re-init push context
 					ConfigsUpdated: map[model.ConfigKey]struct{}{{
@@ -109,8 +125,255 @@ func updateEDS(c *Controller, epc kubeEndpointsController, ep interface{}, event
 			log.Infof("Handle EDS endpoint: skip collecting workload entry endpoints, service %s/%s has not been populated", svcName, ns)
 		}
 	}
+	// endpoints merged from several slices or workload entries come in no particular order
+	endpoints = sortEndpoints(endpoints)
+	c.updateEndpointsWithoutLocality(host, endpoints)
+	c.updateObservedNetworks(host, endpoints)
+
+	c.edsUpdate(host, ns, endpoints)
+	for _, alias := range c.aliasHostnames(svcName, ns) {
+		c.edsUpdate(alias, ns, endpoints)
+	}
+}
+
+// podExcluded returns true if the endpoints of the pod are skipped, because of its phase or because it has
+// no sidecar while one is required. Endpoints without a pod are never excluded.
+func (c *Controller) podExcluded(pod *v1.Pod) bool {
+	return c.podPhaseExcluded(pod) || c.podSidecarMissing(pod)
+}
+
+// podSidecarMissing returns true if sidecars are required and the pod was not injected.
+func (c *Controller) podSidecarMissing(pod *v1.Pod) bool {
+	if pod == nil || !c.requireInjectedSidecar {
+		return false
+	}
+	_, f := pod.Annotations[annotation.SidecarStatus.Name]
+	return !f
+}
+
+// podPhaseExcluded returns true if the endpoints of the pod are skipped because of its phase.
+func (c *Controller) podPhaseExcluded(pod *v1.Pod) bool {
+	if pod == nil || len(c.excludedPodPhases) == 0 {
+		return false
+	}
+	_, f := c.excludedPodPhases[pod.Status.Phase]
+	return f
+}
+
+// updateEDSForPod rebuilds the endpoints of the services selecting the pod.
+func (c *Controller) updateEDSForPod(pod *v1.Pod) error {
+	services, err := getPodServices(c.serviceLister, pod)
+	if err != nil {
+		return err
+	}
+	for _, svc := range services {
+		hostname := kube.ServiceHostname(svc.Name, svc.Namespace, c.domainSuffix)
+		endpoints := c.endpoints.buildIstioEndpointsWithService(svc.Name, svc.Namespace, hostname)
+		if features.EnableK8SServiceSelectWorkloadEntries {
+			c.RLock()
+			svcConv := c.servicesMap[hostname]
+			c.RUnlock()
+			if svcConv != nil {
+				endpoints = append(endpoints, c.collectWorkloadInstanceEndpoints(svcConv)...)
+			}
+		}
+		c.updateEndpointsWithoutLocality(hostname, endpoints)
+		c.updateObservedNetworks(hostname, endpoints)
+		c.edsUpdate(hostname, svc.Namespace, endpoints)
+	}
+	return nil
+}
+
+// updateEndpointsWithoutLocality recomputes the number of endpoints of the service that are missing
+// a locality, and records the total for the cluster.
+func (c *Controller) updateEndpointsWithoutLocality(hostname host.Name, endpoints []*model.IstioEndpoint) {
+	missing := 0
+	for _, ep := range endpoints {
+		if ep.Locality.Label == "" {
+			missing++
+		}
+	}
+	c.Lock()
+	c.endpointsNoLocalityTotal += missing - c.endpointsNoLocality[hostname]
+	if missing == 0 {
+		delete(c.endpointsNoLocality, hostname)
+	} else {
+		c.endpointsNoLocality[hostname] = missing
+	}
+	total := c.endpointsNoLocalityTotal
+	c.Unlock()
+	endpointsWithNoLocality.With(clusterTag.Value(c.clusterID)).Record(float64(total))
+}
+
+// updateObservedNetworks recomputes the networks of the endpoints of the service, and records the number of
+// distinct networks across services for the cluster. Endpoints without a network are not counted.
+func (c *Controller) updateObservedNetworks(hostname host.Name, endpoints []*model.IstioEndpoint) {
+	networks := make(map[string]struct{})
+	for _, ep := range endpoints {
+		if ep.Network != "" {
+			networks[ep.Network] = struct{}{}
+		}
+	}
+	c.Lock()
+	for nw := range c.endpointNetworks[hostname] {
+		if c.networkServices[nw]--; c.networkServices[nw] == 0 {
+			delete(c.networkServices, nw)
+		}
+	}
+	for nw := range networks {
+		c.networkServices[nw]++
+	}
+	if len(networks) == 0 {
+		delete(c.endpointNetworks, hostname)
+	} else {
+		c.endpointNetworks[hostname] = networks
+	}
+	total := len(c.networkServices)
+	c.Unlock()
+	observedNetworks.With(clusterTag.Value(c.clusterID)).Record(float64(total))
+}
 
-	c.xdsUpdater.EDSUpdate(c.clusterID, string(host), ns, endpoints)
+// edsUnchanged returns true if the endpoints are the same as the ones last sent for the hostname, in which
+// case a cache update can be skipped.
+func (c *Controller) edsUnchanged(hostname host.Name, endpoints []*model.IstioEndpoint) bool {
+	c.RLock()
+	prev, f := c.edsHashes[hostname]
+	c.RUnlock()
+	return c.edsDeduped(prev, f, endpoints)
+}
+
+// edsPushUnchanged returns true if the endpoints are the same as the ones last pushed for the hostname, in
+// which case a push can be skipped.
+func (c *Controller) edsPushUnchanged(hostname host.Name, endpoints []*model.IstioEndpoint) bool {
+	c.RLock()
+	prev, f := c.edsPushedHashes[hostname]
+	c.RUnlock()
+	return c.edsDeduped(prev, f, endpoints)
+}
+
+// edsDeduped compares the endpoints with the previous hash, if any, and counts the update as deduplicated
+// if they match.
+func (c *Controller) edsDeduped(prev uint64, found bool, endpoints []*model.IstioEndpoint) bool {
+	if !found {
+		return false
+	}
+	hash := endpointsHash(endpoints)
+	if prev == hash {
+		edsDeduped.With(clusterTag.Value(c.clusterID)).Increment()
+		return true
+	}
+	return false
+}
+
+// recordEDS stores the hash of the endpoints sent for the hostname. The hash of the last push is only
+// kept while the cache holds the pushed endpoints, so that a later push is never skipped for endpoints
+// that differ from the cached ones.
+func (c *Controller) recordEDS(hostname host.Name, hash uint64, pushed bool) {
+	c.Lock()
+	c.edsHashes[hostname] = hash
+	if pushed {
+		c.edsPushedHashes[hostname] = hash
+	} else if prev, f := c.edsPushedHashes[hostname]; f && prev != hash {
+		delete(c.edsPushedHashes, hostname)
+	}
+	c.Unlock()
+}
+
+// buildEndpointsInParallel calls build for each of the n addresses, and returns the endpoints in address order.
+// Addresses are split across endpointBuildWorkers goroutines if there are at least endpointBuildThreshold.
+func (c *Controller) buildEndpointsInParallel(n int, build func(i int) []*model.IstioEndpoint) []*model.IstioEndpoint {
+	workers := c.endpointBuildWorkers
+	if workers <= 1 || n < c.endpointBuildThreshold {
+		out := make([]*model.IstioEndpoint, 0, n)
+		for i := 0; i < n; i++ {
+			out = append(out, build(i)...)
+		}
+		return out
+	}
+
+	results := make([][]*model.IstioEndpoint, n)
+	chunk := (n + workers - 1) / workers
+	var wg sync.WaitGroup
+	for start := 0; start < n; start += chunk {
+		end := start + chunk
+		if end > n {
+			end = n
+		}
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				results[i] = build(i)
+			}
+		}(start, end)
+	}
+	wg.Wait()
+
+	total := 0
+	for _, r := range results {
+		total += len(r)
+	}
+	out := make([]*model.IstioEndpoint, 0, total)
+	for _, r := range results {
+		out = append(out, r...)
+	}
+	return out
+}
+
+// edsUpdate sends the endpoints of the hostname, triggering a push.
+func (c *Controller) edsUpdate(hostname host.Name, namespace string, endpoints []*model.IstioEndpoint) {
+	// hashed before sending, as the endpoints are shared with the xDS server afterwards
+	hash := endpointsHash(endpoints)
+	edsUpdates.With(clusterTag.Value(c.clusterID), edsKindTag.Value("full")).Increment()
+	c.xdsUpdater.EDSUpdate(c.clusterID, string(hostname), namespace, endpoints)
+	c.recordEDS(hostname, hash, true)
+}
+
+// edsCacheUpdate updates the cached endpoints of the hostname, without triggering a push.
+func (c *Controller) edsCacheUpdate(hostname host.Name, namespace string, endpoints []*model.IstioEndpoint) {
+	hash := endpointsHash(endpoints)
+	edsUpdates.With(clusterTag.Value(c.clusterID), edsKindTag.Value("cache")).Increment()
+	c.xdsUpdater.EDSCacheUpdate(c.clusterID, string(hostname), namespace, endpoints)
+	c.recordEDS(hostname, hash, false)
+}
+
+// sortEndpoints sorts the endpoints in place by IP and port, unless disabled by PILOT_ENABLE_ENDPOINT_SORTING.
+func sortEndpoints(endpoints []*model.IstioEndpoint) []*model.IstioEndpoint {
+	if !features.EnableEndpointSorting {
+		return endpoints
+	}
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		if endpoints[i].Address != endpoints[j].Address {
+			return endpoints[i].Address < endpoints[j].Address
+		}
+		if endpoints[i].EndpointPort != endpoints[j].EndpointPort {
+			return endpoints[i].EndpointPort < endpoints[j].EndpointPort
+		}
+		return endpoints[i].ServicePortName < endpoints[j].ServicePortName
+	})
+	return endpoints
+}
+
+// endpointsHash returns a hash of the endpoints, independent of their order. Every field is hashed, except for
+// the cached Envoy endpoint which is derived from the others.
+func endpointsHash(endpoints []*model.IstioEndpoint) uint64 {
+	hashes := make([]uint64, 0, len(endpoints))
+	for _, ep := range endpoints {
+		h := fnv.New64a()
+		cp := *ep
+		cp.EnvoyEndpoint = nil
+		// maps are printed with sorted keys
+		_, _ = fmt.Fprintf(h, "%#v", cp)
+		hashes = append(hashes, h.Sum64())
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+	h := fnv.New64a()
+	b := make([]byte, 8)
+	for _, v := range hashes {
+		binary.LittleEndian.PutUint64(b, v)
+		_, _ = h.Write(b)
+	}
+	return h.Sum64()
 }
 
 // getPod fetches a pod by IP address.
@@ -120,7 +383,9 @@ func updateEDS(c *Controller, epc kubeEndpointsController, ep interface{}, event
 //   this may happen due to eventually consistency issues, out of order events, etc. In this case, the caller
 //   should not precede with the endpoint, or inaccurate information would be sent which may have impacts on
 //   correctness and security.
-func getPod(c *Controller, ip string, ep *metav1.ObjectMeta, targetRef *v1.ObjectReference, host host.Name) (rpod *v1.Pod, expectPod bool) {
+// A missing pod is only counted and queued for the endpoint event when record is set.
+func getPod(c *Controller, ip string, ep *metav1.ObjectMeta, targetRef *v1.ObjectReference, host host.Name,
+	record bool) (rpod *v1.Pod, expectPod bool) {
 	pod := c.pods.getPodByIP(ip)
 	if pod != nil {
 		return pod, false
@@ -133,6 +398,9 @@ func getPod(c *Controller, ip string, ep *metav1.ObjectMeta, targetRef *v1.Objec
 		// made its way to the PodCache yet as it a shared queue.
 		podFromInformer, f, err := c.pods.informer.GetStore().GetByKey(key)
 		if err != nil || !f {
+			if !record {
+				return nil, true
+			}
 			log.Debugf("Endpoint without pod %s %s.%s error: %v", ip, ep.Name, ep.Namespace, err)
 			endpointsWithNoPods.Increment()
 			if c.metrics != nil {
@@ -72,7 +72,7 @@ func endpointServiceInstances(c *Controller, endpoints *v1.Endpoints, proxy *mod
 	if svc != nil {
 		podIP := proxy.IPAddresses[0]
 		pod := c.pods.getPodByIP(podIP)
-		builder := NewEndpointBuilder(c, pod)
+		builder := NewEndpointBuilder(c, pod).withServiceNetwork(c.serviceNetwork(hostname))
 
 		for _, ss := range endpoints.Subsets {
 			for _, port := range ss.Ports {
@@ -124,18 +124,24 @@ func (e *endpointsController) InstancesByPort(c *Controller, svc *model.Service,
 	var out []*model.ServiceInstance
 	for _, ss := range ep.Subsets {
 		for _, ea := range ss.Addresses {
+			if c.podFilteredOut(ea.TargetRef) {
+				continue
+			}
 			var podLabels labels.Instance
 			pod := c.pods.getPodByIP(ea.IP)
 			if pod != nil {
 				podLabels = pod.Labels
 			}
+			if c.podExcluded(pod) {
+				continue
+			}
 
 			// check that one of the input labels is a subset of the labels
 			if !labelsList.HasSubsetOf(podLabels) {
 				continue
 			}
 
-			builder := NewEndpointBuilder(c, pod)
+			builder := NewEndpointBuilder(c, pod).withServiceNetwork(c.serviceNetwork(svc.Hostname))
 
 			// identify the port by name. K8S EndpointPort uses the service port name
 			for _, port := range ss.Ports {
@@ -188,24 +194,51 @@ func (e *endpointsController) forgetEndpoint(endpoint interface{}) {
 }
 
 func (e *endpointsController) buildIstioEndpoints(endpoint interface{}, host host.Name) []*model.IstioEndpoint {
-	endpoints := make([]*model.IstioEndpoint, 0)
-	ep := endpoint.(*v1.Endpoints)
-	for _, ss := range ep.Subsets {
-		for _, ea := range ss.Addresses {
-			pod, expectedPod := getPod(e.c, ea.IP, &metav1.ObjectMeta{Name: ep.Name, Namespace: ep.Namespace}, ea.TargetRef, host)
-			if pod == nil && expectedPod {
-				continue
-			}
-			builder := NewEndpointBuilder(e.c, pod)
+	return e.buildEndpoints(endpoint.(*v1.Endpoints), host, true)
+}
 
-			// EDS and ServiceEntry use name for service port - ADS will need to map to numbers.
-			for _, port := range ss.Ports {
-				istioEndpoint := builder.buildIstioEndpoint(ea.IP, port.Port, port.Name)
-				endpoints = append(endpoints, istioEndpoint)
-			}
+// buildEndpoints builds the endpoints of ep. Pods missing from the cache are recorded only if record is set.
+func (e *endpointsController) buildEndpoints(ep *v1.Endpoints, host host.Name, record bool) []*model.IstioEndpoint {
+	skipPodLookup := e.c.skipPodLookupByIP(host)
+	type subsetAddress struct {
+		subset  *v1.EndpointSubset
+		address *v1.EndpointAddress
+	}
+	addresses := make([]subsetAddress, 0)
+	for i := range ep.Subsets {
+		ss := &ep.Subsets[i]
+		for j := range ss.Addresses {
+			addresses = append(addresses, subsetAddress{subset: ss, address: &ss.Addresses[j]})
 		}
 	}
-	return endpoints
+
+	return e.c.buildEndpointsInParallel(len(addresses), func(i int) []*model.IstioEndpoint {
+		ss, ea := addresses[i].subset, addresses[i].address
+		if e.c.podFilteredOut(ea.TargetRef) {
+			return nil
+		}
+		var pod *v1.Pod
+		var expectedPod bool
+		if !skipPodLookup || ea.TargetRef != nil {
+			pod, expectedPod = getPod(e.c, ea.IP, &metav1.ObjectMeta{Name: ep.Name, Namespace: ep.Namespace}, ea.TargetRef, host, record)
+		}
+		if (pod == nil && expectedPod) || e.c.podExcluded(pod) {
+			return nil
+		}
+		builder := NewEndpointBuilder(e.c, pod).withServiceNetwork(e.c.serviceNetwork(host))
+
+		// EDS and ServiceEntry use name for service port - ADS will need to map to numbers.
+		endpoints := make([]*model.IstioEndpoint, 0, len(ss.Ports))
+		for _, port := range ss.Ports {
+			istioEndpoint := builder.buildIstioEndpoint(ea.IP, port.Port, port.Name)
+			if ea.Hostname != "" {
+				istioEndpoint.HostName = ea.Hostname
+				istioEndpoint.SubDomain = ep.Name
+			}
+			endpoints = append(endpoints, istioEndpoint)
+		}
+		return endpoints
+	})
 }
 
 func (e *endpointsController) buildIstioEndpointsWithService(name, namespace string, host host.Name) []*model.IstioEndpoint {
@@ -215,7 +248,32 @@ func (e *endpointsController) buildIstioEndpointsWithService(name, namespace str
 		return nil
 	}
 
-	return e.buildIstioEndpoints(ep, host)
+	return sortEndpoints(e.buildIstioEndpoints(ep, host))
+}
+
+func (e *endpointsController) snapshotIstioEndpoints(name, namespace string, host host.Name) []*model.IstioEndpoint {
+	ep, err := listerv1.NewEndpointsLister(e.informer.GetIndexer()).Endpoints(namespace).Get(name)
+	if err != nil || ep == nil {
+		return nil
+	}
+
+	return sortEndpoints(e.buildEndpoints(ep, host, false))
+}
+
+func (e *endpointsController) readyEndpointNodes(name, namespace string) map[string]struct{} {
+	out := map[string]struct{}{}
+	ep, err := listerv1.NewEndpointsLister(e.informer.GetIndexer()).Endpoints(namespace).Get(name)
+	if err != nil || ep == nil {
+		return out
+	}
+	for _, ss := range ep.Subsets {
+		for _, ea := range ss.Addresses {
+			if node := e.c.endpointNode(ptrValueOrEmpty(ea.NodeName), ea.IP); node != "" {
+				out[node] = struct{}{}
+			}
+		}
+	}
+	return out
 }
 
 func (e *endpointsController) getServiceInfo(ep interface{}) (host.Name, string, string) {
@@ -108,7 +108,7 @@ func sliceServiceInstances(c *Controller, ep *discovery.EndpointSlice, proxy *mo
 
 	podIP := proxy.IPAddresses[0]
 	pod := c.pods.getPodByIP(podIP)
-	builder := NewEndpointBuilder(c, pod)
+	builder := NewEndpointBuilder(c, pod).withServiceNetwork(c.serviceNetwork(hostname))
 
 	for _, port := range ep.Ports {
 		if port.Name == nil || port.Port == nil {
@@ -158,18 +158,43 @@ func (esc *endpointSliceController) forgetEndpoint(endpoint interface{}) {
 
 func (esc *endpointSliceController) buildIstioEndpoints(es interface{}, host host.Name) []*model.IstioEndpoint {
 	slice := es.(*discovery.EndpointSlice)
+	esc.endpointCache.Update(host, slice.Name, esc.buildSliceEndpoints(slice, host, true))
+	return esc.endpointCache.Get(host)
+}
+
+// buildSliceEndpoints builds the endpoints of a single slice, without updating the endpoint cache. Pods missing
+// from the cache are recorded only if record is set.
+func (esc *endpointSliceController) buildSliceEndpoints(slice *discovery.EndpointSlice, host host.Name,
+	record bool) []*model.IstioEndpoint {
+	skipPodLookup := esc.c.skipPodLookupByIP(host)
 	endpoints := make([]*model.IstioEndpoint, 0)
 	for _, e := range slice.Endpoints {
 		if e.Conditions.Ready != nil && !*e.Conditions.Ready {
 			// Ignore not ready endpoints
 			continue
 		}
+		if esc.c.podFilteredOut(e.TargetRef) {
+			continue
+		}
 		for _, a := range e.Addresses {
-			pod, expectedPod := getPod(esc.c, a, &metav1.ObjectMeta{Name: slice.Name, Namespace: slice.Namespace}, e.TargetRef, host)
-			if pod == nil && expectedPod {
+			var pod *v1.Pod
+			var expectedPod bool
+			if !skipPodLookup || e.TargetRef != nil {
+				pod, expectedPod = getPod(esc.c, a, &metav1.ObjectMeta{Name: slice.Name, Namespace: slice.Namespace}, e.TargetRef, host, record)
+			}
+			if esc.c.podExcluded(pod) {
 				continue
 			}
-			builder := esc.newEndpointBuilder(pod, e)
+			var builder *EndpointBuilder
+			if pod == nil && expectedPod {
+				if !esc.c.sliceEndpointsWithoutPod {
+					continue
+				}
+				// The endpoint is rebuilt with the pod data once the pod arrives.
+				builder = esc.newEndpointBuilderFromSlice(e, host)
+			} else {
+				builder = esc.newEndpointBuilder(pod, e, host)
+			}
 			// EDS and ServiceEntry use name for service port - ADS will need to map to numbers.
 			for _, port := range slice.Ports {
 				var portNum int32
@@ -182,12 +207,15 @@ func (esc *endpointSliceController) buildIstioEndpoints(es interface{}, host hos
 				}
 
 				istioEndpoint := builder.buildIstioEndpoint(a, portNum, portName)
+				if e.Hostname != nil && *e.Hostname != "" {
+					istioEndpoint.HostName = *e.Hostname
+					istioEndpoint.SubDomain = slice.Labels[discovery.LabelServiceName]
+				}
 				endpoints = append(endpoints, istioEndpoint)
 			}
 		}
 	}
-	esc.endpointCache.Update(host, slice.Name, endpoints)
-	return esc.endpointCache.Get(host)
+	return endpoints
 }
 
 func (esc *endpointSliceController) buildIstioEndpointsWithService(name, namespace string, host host.Name) []*model.IstioEndpoint {
@@ -203,7 +231,44 @@ func (esc *endpointSliceController) buildIstioEndpointsWithService(name, namespa
 		endpoints = append(endpoints, esc.buildIstioEndpoints(es, host)...)
 	}
 
-	return endpoints
+	return sortEndpoints(endpoints)
+}
+
+func (esc *endpointSliceController) snapshotIstioEndpoints(name, namespace string, host host.Name) []*model.IstioEndpoint {
+	esLabelSelector := klabels.Set(map[string]string{discovery.LabelServiceName: name}).AsSelectorPreValidated()
+	slices, err := discoverylister.NewEndpointSliceLister(esc.informer.GetIndexer()).EndpointSlices(namespace).List(esLabelSelector)
+	if err != nil || len(slices) == 0 {
+		return nil
+	}
+
+	endpoints := make([]*model.IstioEndpoint, 0)
+	for _, slice := range slices {
+		endpoints = append(endpoints, esc.buildSliceEndpoints(slice, host, false)...)
+	}
+
+	return sortEndpoints(endpoints)
+}
+
+func (esc *endpointSliceController) readyEndpointNodes(name, namespace string) map[string]struct{} {
+	out := map[string]struct{}{}
+	esLabelSelector := klabels.Set(map[string]string{discovery.LabelServiceName: name}).AsSelectorPreValidated()
+	slices, err := discoverylister.NewEndpointSliceLister(esc.informer.GetIndexer()).EndpointSlices(namespace).List(esLabelSelector)
+	if err != nil {
+		return out
+	}
+	for _, slice := range slices {
+		for _, e := range slice.Endpoints {
+			if e.Conditions.Ready != nil && !*e.Conditions.Ready {
+				continue
+			}
+			for _, a := range e.Addresses {
+				if node := esc.c.endpointNode(e.Topology[v1.LabelHostname], a); node != "" {
+					out[node] = struct{}{}
+				}
+			}
+		}
+	}
+	return out
 }
 
 func (esc *endpointSliceController) getServiceInfo(es interface{}) (host.Name, string, string) {
@@ -232,19 +297,30 @@ func (esc *endpointSliceController) InstancesByPort(c *Controller, svc *model.Se
 	var out []*model.ServiceInstance
 	for _, slice := range slices {
 		for _, e := range slice.Endpoints {
+			if c.podFilteredOut(e.TargetRef) {
+				continue
+			}
 			for _, a := range e.Addresses {
 				var podLabels labels.Instance
 				pod := c.pods.getPodByIP(a)
 				if pod != nil {
 					podLabels = pod.Labels
 				}
+				if c.podExcluded(pod) {
+					continue
+				}
 
 				// check that one of the input labels is a subset of the labels
 				if !labelsList.HasSubsetOf(podLabels) {
 					continue
 				}
 
-				builder := esc.newEndpointBuilder(pod, e)
+				var builder *EndpointBuilder
+				if pod == nil && esc.c.sliceEndpointsWithoutPod {
+					builder = esc.newEndpointBuilderFromSlice(e, svc.Hostname)
+				} else {
+					builder = esc.newEndpointBuilder(pod, e, svc.Hostname)
+				}
 				// identify the port by name. K8S EndpointPort uses the service port name
 				for _, port := range slice.Ports {
 					var portNum int32
@@ -268,7 +344,7 @@ func (esc *endpointSliceController) InstancesByPort(c *Controller, svc *model.Se
 	return out
 }
 
-func (esc *endpointSliceController) newEndpointBuilder(pod *v1.Pod, endpoint discovery.Endpoint) *EndpointBuilder {
+func (esc *endpointSliceController) newEndpointBuilder(pod *v1.Pod, endpoint discovery.Endpoint, host host.Name) *EndpointBuilder {
 	if pod != nil {
 		// Respect pod "istio-locality" label
 		if pod.Labels[model.LocalityLabel] == "" {
@@ -278,7 +354,20 @@ func (esc *endpointSliceController) newEndpointBuilder(pod *v1.Pod, endpoint dis
 		}
 	}
 
-	return NewEndpointBuilder(esc.c, pod)
+	return NewEndpointBuilder(esc.c, pod).withServiceNetwork(esc.c.serviceNetwork(host))
+}
+
+// newEndpointBuilderFromSlice returns an EndpointBuilder using only the data carried by the slice endpoint,
+// for when its pod is not known. Pod derived data such as labels and service account are not set.
+func (esc *endpointSliceController) newEndpointBuilderFromSlice(endpoint discovery.Endpoint, host host.Name) *EndpointBuilder {
+	builder := NewEndpointBuilder(esc.c, nil).withServiceNetwork(esc.c.serviceNetwork(host))
+	locality := getLocalityFromTopology(endpoint.Topology)
+	builder.locality.Label = locality
+	builder.labels = augmentLabels(nil, esc.c.Cluster(), locality)
+	if endpoint.TargetRef != nil {
+		builder.namespace = endpoint.TargetRef.Namespace
+	}
+	return builder
 }
 
 func getLocalityFromTopology(topology map[string]string) string {
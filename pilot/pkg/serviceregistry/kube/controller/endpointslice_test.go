@@ -15,9 +15,14 @@
 package controller
 
 import (
+	"context"
 	"reflect"
 	"testing"
 
+	coreV1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
 	"istio.io/api/label"
 )
 
@@ -61,3 +66,57 @@ func TestGetLocalityFromTopology(t *testing.T) {
 		})
 	}
 }
+
+func TestBuildSliceEndpointsWithoutPod(t *testing.T) {
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{
+		Mode:                          EndpointSliceOnly,
+		BuildSliceEndpointsWithoutPod: true,
+	})
+	defer controller.Stop()
+
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "a"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+
+	portName := "tcp-port"
+	var portNum int32 = 8080
+	slice := &discovery.EndpointSlice{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:      "svc1-abcde",
+			Namespace: "nsA",
+			Labels:    map[string]string{discovery.LabelServiceName: "svc1"},
+		},
+		Endpoints: []discovery.Endpoint{{
+			Addresses: []string{"10.0.0.1"},
+			// the pod is not in the pod cache
+			TargetRef: &coreV1.ObjectReference{Kind: "Pod", Name: "missing", Namespace: "nsA"},
+			Topology:  map[string]string{NodeRegionLabelGA: "region1", NodeZoneLabelGA: "zone1"},
+		}},
+		Ports: []discovery.EndpointPort{{Name: &portName, Port: &portNum}},
+	}
+	if _, err := controller.client.DiscoveryV1beta1().EndpointSlices("nsA").Create(context.TODO(), slice, metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	ev := fx.Wait("eds")
+	if ev == nil {
+		t.Fatal("Timeout incremental eds")
+	}
+	if len(ev.Endpoints) != 1 {
+		t.Fatalf("expected 1 endpoint, got %d", len(ev.Endpoints))
+	}
+	ep := ev.Endpoints[0]
+	if ep.Address != "10.0.0.1" || ep.EndpointPort != uint32(portNum) {
+		t.Errorf("unexpected endpoint %s:%d", ep.Address, ep.EndpointPort)
+	}
+	if ep.Locality.Label != "region1/zone1" {
+		t.Errorf("expected locality region1/zone1, got %q", ep.Locality.Label)
+	}
+	if ep.Namespace != "nsA" {
+		t.Errorf("expected namespace nsA, got %q", ep.Namespace)
+	}
+	if ep.Labels[NodeZoneLabelGA] != "zone1" {
+		t.Errorf("expected zone label zone1, got %q", ep.Labels[NodeZoneLabelGA])
+	}
+}
@@ -17,11 +17,13 @@ package controller
 import (
 	"time"
 
+	v1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/tools/cache"
 
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pkg/config/mesh"
 	kubelib "istio.io/istio/pkg/kube"
+	"istio.io/istio/pkg/queue"
 )
 
 const (
@@ -131,8 +133,38 @@ type FakeControllerOptions struct {
 	Mode              EndpointMode
 	ClusterID         string
 	WatchedNamespaces string
+	SystemNamespace   string
 	DomainSuffix      string
 	XDSUpdater        model.XDSUpdater
+	FullResyncPeriod  time.Duration
+
+	BuildSliceEndpointsWithoutPod   bool
+	DisableNodePortGatewayDiscovery bool
+	AdditionalDomainSuffixes        []string
+	ExcludedPodPhases               []v1.PodPhase
+	ExcludedNamespaces              []string
+	RequireInjectedSidecar          bool
+	EndpointBuildWorkers            int
+	EndpointBuildParallelThreshold  int
+	InitialSyncHandler              func()
+	ConfigCluster                   bool
+	EndpointHealthChecker           EndpointHealthChecker
+	ServiceDeleteGracePeriod        time.Duration
+	NamespaceTerminationGracePeriod time.Duration
+	LocalitySource                  LocalitySource
+	StrictServiceValidation         bool
+	ServicesWithoutPortsPolicy      ServicesWithoutPortsPolicy
+	EndpointAddressRewriter         func(original string, pod *v1.Pod) string
+	PodDiscoveryFilter              func(namespace string) bool
+	CrossNamespaceWorkloadInstances bool
+	QueueFactory                    func(id string) queue.Instance
+	DetectOverlappingSelectors      bool
+	AdvertiseHostNetworkNodeIP      bool
+	FullPushCoalesceWindow          time.Duration
+	SkipUnschedulableGatewayNodes   bool
+	EvictStaleServices              bool
+	SpreadConstraintTopologyLabels  bool
+	ManualEndpointsOnly             bool
 }
 
 type FakeController struct {
@@ -154,17 +186,49 @@ func NewFakeControllerWithOptions(opts FakeControllerOptions) (*FakeController,
 	}
 	options := Options{
 		WatchedNamespaces: opts.WatchedNamespaces, // default is all namespaces
+		SystemNamespace:   opts.SystemNamespace,
 		DomainSuffix:      domainSuffix,
 		XDSUpdater:        xdsUpdater,
 		Metrics:           &model.Environment{},
 		NetworksWatcher:   opts.NetworksWatcher,
 		EndpointMode:      opts.Mode,
 		ClusterID:         opts.ClusterID,
+		FullResyncPeriod:  opts.FullResyncPeriod,
+
+		BuildSliceEndpointsWithoutPod:   opts.BuildSliceEndpointsWithoutPod,
+		DisableNodePortGatewayDiscovery: opts.DisableNodePortGatewayDiscovery,
+		AdditionalDomainSuffixes:        opts.AdditionalDomainSuffixes,
+		ExcludedPodPhases:               opts.ExcludedPodPhases,
+		ExcludedNamespaces:              opts.ExcludedNamespaces,
+		RequireInjectedSidecar:          opts.RequireInjectedSidecar,
+		EndpointBuildWorkers:            opts.EndpointBuildWorkers,
+		EndpointBuildParallelThreshold:  opts.EndpointBuildParallelThreshold,
+		ConfigCluster:                   opts.ConfigCluster,
+		EndpointHealthChecker:           opts.EndpointHealthChecker,
+		ServiceDeleteGracePeriod:        opts.ServiceDeleteGracePeriod,
+		NamespaceTerminationGracePeriod: opts.NamespaceTerminationGracePeriod,
+		LocalitySource:                  opts.LocalitySource,
+		StrictServiceValidation:         opts.StrictServiceValidation,
+		ServicesWithoutPortsPolicy:      opts.ServicesWithoutPortsPolicy,
+		EndpointAddressRewriter:         opts.EndpointAddressRewriter,
+		PodDiscoveryFilter:              opts.PodDiscoveryFilter,
+		CrossNamespaceWorkloadInstances: opts.CrossNamespaceWorkloadInstances,
+		QueueFactory:                    opts.QueueFactory,
+		DetectOverlappingSelectors:      opts.DetectOverlappingSelectors,
+		AdvertiseHostNetworkNodeIP:      opts.AdvertiseHostNetworkNodeIP,
+		FullPushCoalesceWindow:          opts.FullPushCoalesceWindow,
+		SkipUnschedulableGatewayNodes:   opts.SkipUnschedulableGatewayNodes,
+		EvictStaleServices:              opts.EvictStaleServices,
+		SpreadConstraintTopologyLabels:  opts.SpreadConstraintTopologyLabels,
+		ManualEndpointsOnly:             opts.ManualEndpointsOnly,
 	}
 	c := NewController(opts.Client, options)
 	if opts.ServiceHandler != nil {
 		_ = c.AppendServiceHandler(opts.ServiceHandler)
 	}
+	if opts.InitialSyncHandler != nil {
+		c.AppendInitialSyncHandler(opts.InitialSyncHandler)
+	}
 	c.stop = make(chan struct{})
 	// Run in initiation to prevent calling each test
 	// TODO: fix it, so we can remove `stop` channel
@@ -0,0 +1,260 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
+	klabels "k8s.io/apimachinery/pkg/labels"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	discoveryinformer "k8s.io/client-go/informers/discovery/v1beta1"
+	discoverylister "k8s.io/client-go/listers/discovery/v1beta1"
+	"k8s.io/client-go/tools/cache"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/labels"
+	"istio.io/pkg/log"
+)
+
+const (
+	// endpointSliceManagedByLabel identifies the controller managing an EndpointSlice.
+	endpointSliceManagedByLabel = "endpointslice.kubernetes.io/managed-by"
+	// endpointSliceControllerName manages the EndpointSlices of services with selectors.
+	endpointSliceControllerName = "endpointslice-controller.k8s.io"
+	// endpointSliceMirroringControllerName manages the EndpointSlices mirroring user-authored Endpoints.
+	endpointSliceMirroringControllerName = "endpointslicemirroring-controller.k8s.io"
+)
+
+// mergedEndpointsController merges the Kubernetes Endpoints of a service with its user-authored EndpointSlices.
+// EndpointSlices managed by Kubernetes duplicate the Endpoints, so they are ignored. Endpoints found in both
+// sources, by IP and port, are deduplicated in favor of the one with the more detailed locality.
+type mergedEndpointsController struct {
+	c         *Controller
+	endpoints *endpointsController
+	slices    *endpointSliceController
+}
+
+var _ kubeEndpointsController = &mergedEndpointsController{}
+
+func newMergedEndpointsController(c *Controller, epInformer coreinformers.EndpointsInformer,
+	sliceInformer discoveryinformer.EndpointSliceInformer) *mergedEndpointsController {
+	out := &mergedEndpointsController{
+		c: c,
+		endpoints: &endpointsController{
+			kubeEndpoints: kubeEndpoints{
+				c:        c,
+				informer: epInformer.Informer(),
+			},
+		},
+		slices: &endpointSliceController{
+			kubeEndpoints: kubeEndpoints{
+				c:        c,
+				informer: sliceInformer.Informer(),
+			},
+			endpointCache: newEndpointSliceCache(),
+		},
+	}
+	registerHandlers(epInformer.Informer(), c.queue, "Endpoints", out.onEvent, endpointsEqual)
+	registerHandlers(sliceInformer.Informer(), c.queue, "EndpointSlice", out.onEvent, nil)
+	return out
+}
+
+// isManualEndpointSlice returns true if the slice was authored by users rather than Kubernetes.
+func isManualEndpointSlice(slice *discovery.EndpointSlice) bool {
+	managedBy := slice.Labels[endpointSliceManagedByLabel]
+	return managedBy != endpointSliceControllerName && managedBy != endpointSliceMirroringControllerName
+}
+
+func (m *mergedEndpointsController) HasSynced() bool {
+	return m.endpoints.HasSynced() && m.slices.HasSynced()
+}
+
+func (m *mergedEndpointsController) Run(stopCh <-chan struct{}) {
+	go m.slices.Run(stopCh)
+	m.endpoints.Run(stopCh)
+}
+
+// getInformer returns the Endpoints informer, which holds the endpoints of every service with a selector.
+func (m *mergedEndpointsController) getInformer() cache.SharedIndexInformer {
+	return m.endpoints.informer
+}
+
+func (m *mergedEndpointsController) onEvent(curr interface{}, event model.Event) error {
+	obj := curr
+	if tombstone, ok := curr.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	var name, namespace string
+	switch ep := obj.(type) {
+	case *v1.Endpoints:
+		name, namespace = ep.Name, ep.Namespace
+	case *discovery.EndpointSlice:
+		if !isManualEndpointSlice(ep) {
+			return nil
+		}
+		name, namespace = ep.Labels[discovery.LabelServiceName], ep.Namespace
+	default:
+		log.Errorf("Couldn't get endpoints or endpoint slice from object %#v", curr)
+		return nil
+	}
+
+	// The service may still have endpoints from the other source, so a delete of one source is an
+	// update of the merged endpoints.
+	if event == model.EventDelete {
+		m.forgetEndpoint(obj)
+		event = model.EventUpdate
+	}
+	return processEndpointEvent(m.c, m, name, namespace, event, obj)
+}
+
+func (m *mergedEndpointsController) forgetEndpoint(endpoint interface{}) {
+	switch endpoint.(type) {
+	case *v1.Endpoints:
+		m.endpoints.forgetEndpoint(endpoint)
+	case *discovery.EndpointSlice:
+		m.slices.forgetEndpoint(endpoint)
+	}
+}
+
+func (m *mergedEndpointsController) getServiceInfo(ep interface{}) (host.Name, string, string) {
+	if _, ok := ep.(*discovery.EndpointSlice); ok {
+		return m.slices.getServiceInfo(ep)
+	}
+	return m.endpoints.getServiceInfo(ep)
+}
+
+// buildIstioEndpoints rebuilds the merged endpoints of the service owning ep from both sources.
+func (m *mergedEndpointsController) buildIstioEndpoints(ep interface{}, host host.Name) []*model.IstioEndpoint {
+	_, name, namespace := m.getServiceInfo(ep)
+	return m.buildIstioEndpointsWithService(name, namespace, host)
+}
+
+func (m *mergedEndpointsController) buildIstioEndpointsWithService(name, namespace string, host host.Name) []*model.IstioEndpoint {
+	endpoints := m.endpoints.buildIstioEndpointsWithService(name, namespace, host)
+	for _, slice := range m.manualSlices(name, namespace) {
+		m.slices.buildIstioEndpoints(slice, host)
+	}
+	return sortEndpoints(mergeEndpoints(endpoints, m.slices.endpointCache.Get(host)))
+}
+
+func (m *mergedEndpointsController) snapshotIstioEndpoints(name, namespace string, host host.Name) []*model.IstioEndpoint {
+	endpoints := m.endpoints.snapshotIstioEndpoints(name, namespace, host)
+	var manual []*model.IstioEndpoint
+	for _, slice := range m.manualSlices(name, namespace) {
+		manual = append(manual, m.slices.buildSliceEndpoints(slice, host, false)...)
+	}
+	return sortEndpoints(mergeEndpoints(endpoints, manual))
+}
+
+func (m *mergedEndpointsController) readyEndpointNodes(name, namespace string) map[string]struct{} {
+	out := m.endpoints.readyEndpointNodes(name, namespace)
+	for node := range m.slices.readyEndpointNodes(name, namespace) {
+		out[node] = struct{}{}
+	}
+	return out
+}
+
+// manualSlices returns the user-authored EndpointSlices of the service.
+func (m *mergedEndpointsController) manualSlices(name, namespace string) []*discovery.EndpointSlice {
+	selector := klabels.Set(map[string]string{discovery.LabelServiceName: name}).AsSelectorPreValidated()
+	slices, err := discoverylister.NewEndpointSliceLister(m.slices.informer.GetIndexer()).EndpointSlices(namespace).List(selector)
+	if err != nil {
+		log.Debugf("endpoint slices of (%s, %s) not found => error %v", name, namespace, err)
+		return nil
+	}
+	out := make([]*discovery.EndpointSlice, 0, len(slices))
+	for _, slice := range slices {
+		if isManualEndpointSlice(slice) {
+			out = append(out, slice)
+		}
+	}
+	return out
+}
+
+func (m *mergedEndpointsController) InstancesByPort(c *Controller, svc *model.Service, reqSvcPort int,
+	labelsList labels.Collection) []*model.ServiceInstance {
+	return mergeServiceInstances(m.endpoints.InstancesByPort(c, svc, reqSvcPort, labelsList),
+		m.slices.InstancesByPort(c, svc, reqSvcPort, labelsList))
+}
+
+func (m *mergedEndpointsController) GetProxyServiceInstances(c *Controller, proxy *model.Proxy) []*model.ServiceInstance {
+	return mergeServiceInstances(m.endpoints.GetProxyServiceInstances(c, proxy),
+		m.slices.GetProxyServiceInstances(c, proxy))
+}
+
+// localityDepth returns the number of locality levels, from region to subzone, known for the endpoint.
+func localityDepth(ep *model.IstioEndpoint) int {
+	depth := 0
+	for _, l := range strings.Split(ep.Locality.Label, "/") {
+		if l != "" {
+			depth++
+		}
+	}
+	return depth
+}
+
+// mergeEndpoints returns the endpoints of both lists, deduplicated by IP and port. On conflict, the endpoint
+// with the more detailed locality is kept, or the one of primary if they are equally detailed.
+func mergeEndpoints(primary, secondary []*model.IstioEndpoint) []*model.IstioEndpoint {
+	if len(secondary) == 0 {
+		return primary
+	}
+	out := make([]*model.IstioEndpoint, 0, len(primary)+len(secondary))
+	index := make(map[endpointKey]int, len(primary)+len(secondary))
+	for _, eps := range [][]*model.IstioEndpoint{primary, secondary} {
+		for _, ep := range eps {
+			key := endpointKey{ep.Address, ep.ServicePortName}
+			if i, f := index[key]; f {
+				if localityDepth(ep) > localityDepth(out[i]) {
+					out[i] = ep
+				}
+				continue
+			}
+			index[key] = len(out)
+			out = append(out, ep)
+		}
+	}
+	return out
+}
+
+// mergeServiceInstances deduplicates the instances of both lists as mergeEndpoints does.
+func mergeServiceInstances(primary, secondary []*model.ServiceInstance) []*model.ServiceInstance {
+	if len(secondary) == 0 {
+		return primary
+	}
+	type instanceKey struct {
+		hostname host.Name
+		endpointKey
+	}
+	out := make([]*model.ServiceInstance, 0, len(primary)+len(secondary))
+	index := make(map[instanceKey]int, len(primary)+len(secondary))
+	for _, instances := range [][]*model.ServiceInstance{primary, secondary} {
+		for _, si := range instances {
+			key := instanceKey{si.Service.Hostname, endpointKey{si.Endpoint.Address, si.ServicePort.Name}}
+			if i, f := index[key]; f {
+				if localityDepth(si.Endpoint) > localityDepth(out[i].Endpoint) {
+					out[i] = si
+				}
+				continue
+			}
+			index[key] = len(out)
+			out = append(out, si)
+		}
+	}
+	return out
+}
@@ -0,0 +1,144 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	discovery "k8s.io/api/discovery/v1beta1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/labels"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+func TestIsManualEndpointSlice(t *testing.T) {
+	cases := map[string]bool{
+		"":                                   true,
+		"my-controller":                      true,
+		endpointSliceControllerName:          false,
+		endpointSliceMirroringControllerName: false,
+	}
+	for managedBy, expected := range cases {
+		slice := &discovery.EndpointSlice{}
+		if managedBy != "" {
+			slice.Labels = map[string]string{endpointSliceManagedByLabel: managedBy}
+		}
+		if got := isManualEndpointSlice(slice); got != expected {
+			t.Errorf("managed by %q: expected manual %v, got %v", managedBy, expected, got)
+		}
+	}
+}
+
+func TestMergeEndpoints(t *testing.T) {
+	primary := []*model.IstioEndpoint{
+		{Address: "10.0.0.1", ServicePortName: "http"},
+		{Address: "10.0.0.2", ServicePortName: "http"},
+		{Address: "10.0.0.3", ServicePortName: "http", Locality: model.Locality{Label: "region/zone"}},
+	}
+	secondary := []*model.IstioEndpoint{
+		{Address: "10.0.0.2", ServicePortName: "http", Locality: model.Locality{Label: "region/zone"}},
+		{Address: "10.0.0.3", ServicePortName: "http", Locality: model.Locality{Label: "region"}},
+		{Address: "10.0.0.3", ServicePortName: "grpc"},
+		{Address: "10.0.0.4", ServicePortName: "http"},
+	}
+	expected := map[endpointKey]string{
+		{"10.0.0.1", "http"}: "",
+		{"10.0.0.2", "http"}: "region/zone",
+		{"10.0.0.3", "http"}: "region/zone",
+		{"10.0.0.3", "grpc"}: "",
+		{"10.0.0.4", "http"}: "",
+	}
+
+	got := mergeEndpoints(primary, secondary)
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d endpoints, got %d", len(expected), len(got))
+	}
+	for _, ep := range got {
+		locality, f := expected[endpointKey{ep.Address, ep.ServicePortName}]
+		if !f {
+			t.Fatalf("unexpected endpoint %s:%s", ep.Address, ep.ServicePortName)
+		}
+		if ep.Locality.Label != locality {
+			t.Errorf("endpoint %s:%s: expected locality %q, got %q", ep.Address, ep.ServicePortName, locality, ep.Locality.Label)
+		}
+	}
+}
+
+func TestMergedEndpointsWithManualSlice(t *testing.T) {
+	controller, fx := NewFakeControllerWithOptions(FakeControllerOptions{Mode: EndpointsAndManualEndpointSlices})
+	defer controller.Stop()
+
+	// the pod node is unknown, so only the slice topology gives it a locality
+	addPods(t, controller, fx, generatePod("10.0.0.2", "pod2", "nsA", "", "missing", map[string]string{"app": "prod-app"}, nil))
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"10.0.0.1", "10.0.0.2"}, nil, t)
+
+	portName := "tcp-port"
+	var portNum int32 = 1001
+	slice := &discovery.EndpointSlice{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:      "svc1-manual",
+			Namespace: "nsA",
+			Labels:    map[string]string{discovery.LabelServiceName: "svc1"},
+		},
+		Endpoints: []discovery.Endpoint{
+			{Addresses: []string{"10.0.0.2"}, Topology: map[string]string{NodeRegionLabelGA: "region1", NodeZoneLabelGA: "zone1"}},
+			{Addresses: []string{"10.0.0.3"}},
+		},
+		Ports: []discovery.EndpointPort{{Name: &portName, Port: &portNum}},
+	}
+	if _, err := controller.client.DiscoveryV1beta1().EndpointSlices("nsA").Create(context.TODO(), slice, metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectEndpoints := func(expected map[string]string) {
+		t.Helper()
+		retry.UntilSuccessOrFail(t, func() error {
+			svc, _ := controller.GetService("svc1.nsA.svc.company.com")
+			if svc == nil {
+				return fmt.Errorf("service not found")
+			}
+			instances := controller.InstancesByPort(svc, 8080, labels.Collection{})
+			endpoints := controller.endpoints.buildIstioEndpointsWithService("svc1", "nsA", svc.Hostname)
+			if len(instances) != len(expected) || len(endpoints) != len(expected) {
+				return fmt.Errorf("expected %d endpoints, got %d instances and %d endpoints", len(expected), len(instances), len(endpoints))
+			}
+			for _, ep := range endpoints {
+				locality, f := expected[ep.Address]
+				if !f {
+					return fmt.Errorf("unexpected endpoint %s", ep.Address)
+				}
+				if ep.Locality.Label != locality {
+					return fmt.Errorf("endpoint %s: expected locality %q, got %q", ep.Address, locality, ep.Locality.Label)
+				}
+			}
+			return nil
+		}, retry.Timeout(5*time.Second))
+	}
+	expectEndpoints(map[string]string{"10.0.0.1": "", "10.0.0.2": "region1/zone1", "10.0.0.3": ""})
+
+	if err := controller.client.DiscoveryV1beta1().EndpointSlices("nsA").Delete(context.TODO(), "svc1-manual", metaV1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expectEndpoints(map[string]string{"10.0.0.1": "", "10.0.0.2": ""})
+}
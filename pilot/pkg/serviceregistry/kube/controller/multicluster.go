@@ -58,6 +58,8 @@ type Multicluster struct {
 	XDSUpdater        model.XDSUpdater
 	metrics           model.Metrics
 	endpointMode      EndpointMode
+	fullResyncPeriod  time.Duration
+	fullResyncJitter  float64
 
 	m                     sync.Mutex // protects remoteKubeControllers
 	remoteKubeControllers map[string]*kubeController
@@ -96,6 +98,8 @@ func NewMulticluster(kc kubernetes.Interface, secretNamespace string, opts Optio
 		systemNamespace:       opts.SystemNamespace,
 		secretNamespace:       secretNamespace,
 		endpointMode:          opts.EndpointMode,
+		fullResyncPeriod:      opts.FullResyncPeriod,
+		fullResyncJitter:      opts.FullResyncJitter,
 	}
 	mc.initSecretController(kc)
 
@@ -121,6 +125,8 @@ func (m *Multicluster) AddMemberCluster(clients kubelib.Client, clusterID string
 		NetworksWatcher:   m.networksWatcher,
 		Metrics:           m.metrics,
 		EndpointMode:      m.endpointMode,
+		FullResyncPeriod:  m.fullResyncPeriod,
+		FullResyncJitter:  m.fullResyncJitter,
 	}
 	log.Infof("Initializing Kubernetes service registry %q", options.ClusterID)
 	kubectl := NewController(clients, options)
@@ -116,3 +116,33 @@ func Test_KubeSecretController(t *testing.T) {
 	verifyControllers(t, mc, 0, "delete remote controller")
 
 }
+
+func TestAddMemberClusterFullResync(t *testing.T) {
+	mc, err := NewMulticluster(fake.NewSimpleClientset(),
+		testSecretNameSpace,
+		Options{
+			WatchedNamespaces: WatchedNamespaces,
+			DomainSuffix:      DomainSuffix,
+			ResyncPeriod:      ResyncPeriod,
+			FullResyncPeriod:  time.Hour,
+			FullResyncJitter:  0.5,
+		},
+		mockserviceController, nil, nil)
+	if err != nil {
+		t.Fatalf("error creating Multicluster object: %v", err)
+	}
+	if err := mc.AddMemberCluster(kube.NewFakeClient(), "remote"); err != nil {
+		t.Fatalf("error adding remote cluster: %v", err)
+	}
+	defer func() {
+		_ = mc.DeleteMemberCluster("remote")
+	}()
+
+	mc.m.Lock()
+	remote := mc.remoteKubeControllers["remote"]
+	mc.m.Unlock()
+	if remote.fullResyncPeriod != time.Hour || remote.fullResyncJitter != 0.5 {
+		t.Fatalf("expected the full resync options to be passed to the remote controller, got period %v and jitter %v",
+			remote.fullResyncPeriod, remote.fullResyncJitter)
+	}
+}
@@ -16,16 +16,69 @@ package controller
 
 import (
 	"net"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/yl2chen/cidranger"
+	v1 "k8s.io/api/core/v1"
 
 	"istio.io/api/label"
 	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
 	"istio.io/istio/pkg/config/host"
 	"istio.io/pkg/log"
 )
 
+// MultiNetworkMatchPolicy decides which network an endpoint belongs to when its IP is contained
+// in the CIDRs of multiple networks.
+type MultiNetworkMatchPolicy int
+
+const (
+	// LongestPrefix picks the network with the most specific CIDR containing the IP.
+	LongestPrefix MultiNetworkMatchPolicy = iota
+	// FirstMatch picks the first matching network returned by the CIDR lookup.
+	FirstMatch
+	// ErrorOnMultipleMatch assigns no network to the endpoint.
+	ErrorOnMultipleMatch
+)
+
+// selectNetwork picks the network for ip among the entries containing it according to policy.
+// Returns an empty string if no network can be picked.
+func selectNetwork(entries []cidranger.RangerEntry, policy MultiNetworkMatchPolicy, ip, clusterID string) string {
+	if len(entries) == 0 {
+		return ""
+	}
+	if len(entries) == 1 {
+		return entries[0].(namedRangerEntry).name
+	}
+
+	ambiguousNetworkMatches.With(clusterTag.Value(clusterID)).Increment()
+	switch policy {
+	case FirstMatch:
+		log.Warnf("Found multiple networks CIDRs matching the endpoint IP: %s. Using the first match.", ip)
+		return entries[0].(namedRangerEntry).name
+	case ErrorOnMultipleMatch:
+		log.Warnf("Found multiple networks CIDRs matching the endpoint IP: %s. Not assigning a network.", ip)
+		return ""
+	default:
+		var best namedRangerEntry
+		bestOnes := -1
+		for _, e := range entries {
+			entry := e.(namedRangerEntry)
+			ones, _ := entry.network.Mask.Size()
+			// break ties on the network name so the result does not depend on lookup order
+			if ones > bestOnes || (ones == bestOnes && entry.name < best.name) {
+				best, bestOnes = entry, ones
+			}
+		}
+		log.Debugf("Found multiple networks CIDRs matching the endpoint IP: %s. Using the most specific match %s.",
+			ip, best.network.String())
+		return best.name
+	}
+}
+
 // namedRangerEntry for holding network's CIDR and name
 type namedRangerEntry struct {
 	name    string
@@ -40,10 +93,10 @@ func (n namedRangerEntry) Network() net.IPNet {
 func (c *Controller) onNetworkChanged() {
 	// the network for endpoints are computed when we process the events; this will fix the cache
 	// NOTE: this must run before the other network watcher handler that creates a force push
-	if err := c.syncPods(); err != nil {
+	if err := c.syncPods(false); err != nil {
 		log.Errorf("one or more errors force-syncing pods: %v", err)
 	}
-	if err := c.syncEndpoints(); err != nil {
+	if err := c.syncEndpoints(false); err != nil {
 		log.Errorf("one or more errors force-syncing endpoints: %v", err)
 	}
 	c.reloadNetworkGateways()
@@ -127,6 +180,14 @@ func (c *Controller) NetworkGateways() map[string][]*model.Gateway {
 	return gws
 }
 
+// SystemNamespaceNetwork returns the network set by the label of the system namespace, or an empty string
+// if the label is not set.
+func (c *Controller) SystemNamespaceNetwork() string {
+	c.RLock()
+	defer c.RUnlock()
+	return c.network
+}
+
 // extractGatewaysFromService checks if the service is a cross-network gateway
 // and if it is, updates the controller's gateways.
 func (c *Controller) extractGatewaysFromService(svc *model.Service) {
@@ -176,12 +237,22 @@ func (c *Controller) extractGatewaysInner(svc *model.Service) {
 		}
 		ips := svc.Attributes.ClusterExternalAddresses[c.clusterID]
 		for _, ip := range ips {
-			gws = append(gws, &model.Gateway{Addr: ip, Port: gwPort})
+			gws = append(gws, &model.Gateway{Addr: gatewayAddress(ip), Port: gwPort})
 		}
 	}
 	c.networkGateways[svc.Hostname][network] = gws
 }
 
+// gatewayAddress returns the canonical form of a gateway address, without the brackets an IPv6 address may
+// be written with. Hostnames are returned as is.
+func gatewayAddress(addr string) string {
+	ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"))
+	if ip == nil {
+		return addr
+	}
+	return ip.String()
+}
+
 // getGatewayDetails finds the port and network to use for cross-network traffic on the given service.
 // Zero values are returned if the service is not a cross-network gateway.
 func (c *Controller) getGatewayDetails(svc *model.Service) (uint32, string) {
@@ -219,17 +290,46 @@ func (c *Controller) updateServiceNodePortAddresses(svcs ...*model.Service) bool
 		c.RLock()
 		nodeSelector := c.nodeSelectorsForServices[svc.Hostname]
 		c.RUnlock()
+		k8sSvc, _ := c.serviceLister.Services(svc.Attributes.Namespace).Get(svc.Attributes.Name)
+		if overrides := gatewayExternalAddresses(k8sSvc); len(overrides) > 0 {
+			svc.Mutex.Lock()
+			svc.Attributes.ClusterExternalAddresses = map[string][]string{c.clusterID: overrides}
+			svc.Mutex.Unlock()
+			c.extractGatewaysFromService(svc)
+			continue
+		}
+		// with a Local external traffic policy, only nodes running the gateway can serve traffic
+		var localNodes map[string]struct{}
+		if k8sSvc != nil && k8sSvc.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal {
+			localNodes = c.gatewayNodes(k8sSvc)
+		}
 		// update external address
 		svc.Mutex.Lock()
 		if nodeSelector == nil {
 			var extAddresses []string
-			for _, n := range c.nodeInfoMap {
+			for name, n := range c.nodeInfoMap {
+				if c.skipUnschedulableNodes && n.unschedulable {
+					continue
+				}
+				if localNodes != nil {
+					if _, f := localNodes[name]; !f {
+						continue
+					}
+				}
 				extAddresses = append(extAddresses, n.address)
 			}
 			svc.Attributes.ClusterExternalAddresses = map[string][]string{c.clusterID: extAddresses}
 		} else {
 			var nodeAddresses []string
-			for _, n := range c.nodeInfoMap {
+			for name, n := range c.nodeInfoMap {
+				if c.skipUnschedulableNodes && n.unschedulable {
+					continue
+				}
+				if localNodes != nil {
+					if _, f := localNodes[name]; !f {
+						continue
+					}
+				}
 				if nodeSelector.SubsetOf(n.labels) {
 					nodeAddresses = append(nodeAddresses, n.address)
 				}
@@ -243,6 +343,68 @@ func (c *Controller) updateServiceNodePortAddresses(svcs ...*model.Service) bool
 	return true
 }
 
+// gatewayExternalAddresses returns the addresses set by the GatewayExternalAddressAnnotation of the service, if any.
+func gatewayExternalAddresses(svc *v1.Service) []string {
+	if svc == nil || svc.Annotations[kube.GatewayExternalAddressAnnotation] == "" {
+		return nil
+	}
+	var out []string
+	for _, addr := range strings.Split(svc.Annotations[kube.GatewayExternalAddressAnnotation], ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			out = append(out, addr)
+		}
+	}
+	return out
+}
+
+// gatewayNodes returns the names of the nodes hosting the ready endpoints of the service, which are the
+// nodes kube-proxy forwards node port traffic from with a Local external traffic policy.
+func (c *Controller) gatewayNodes(svc *v1.Service) map[string]struct{} {
+	return c.endpoints.readyEndpointNodes(svc.Name, svc.Namespace)
+}
+
+// endpointNode returns the node of an endpoint address, falling back to the node of the pod with the IP when
+// the endpoint does not record it.
+func (c *Controller) endpointNode(nodeName, ip string) string {
+	if nodeName != "" {
+		return nodeName
+	}
+	if pod := c.pods.getPodByIP(ip); pod != nil {
+		return pod.Spec.NodeName
+	}
+	return ""
+}
+
+// updateLocalNodePortGatewayAddresses refreshes the addresses of a NodePort gateway service with a Local
+// external traffic policy, as they depend on which nodes run its endpoints.
+func (c *Controller) updateLocalNodePortGatewayAddresses(name, namespace string) {
+	svc, _ := c.serviceLister.Services(namespace).Get(name)
+	if svc == nil || svc.Spec.ExternalTrafficPolicy != v1.ServiceExternalTrafficPolicyTypeLocal {
+		return
+	}
+	hostname := kube.ServiceHostname(name, namespace, c.domainSuffix)
+	c.RLock()
+	_, isNodePortGateway := c.nodeSelectorsForServices[hostname]
+	svcConv := c.servicesMap[hostname]
+	c.RUnlock()
+	if !isNodePortGateway || svcConv == nil {
+		return
+	}
+	svcConv.Mutex.RLock()
+	prev := append([]string{}, svcConv.Attributes.ClusterExternalAddresses[c.clusterID]...)
+	svcConv.Mutex.RUnlock()
+	c.updateServiceNodePortAddresses(svcConv)
+	svcConv.Mutex.RLock()
+	curr := append([]string{}, svcConv.Attributes.ClusterExternalAddresses[c.clusterID]...)
+	svcConv.Mutex.RUnlock()
+	// the addresses are built from a map of nodes, so their order is not stable
+	sort.Strings(prev)
+	sort.Strings(curr)
+	if !reflect.DeepEqual(prev, curr) {
+		c.fullPush(&model.PushRequest{Full: true})
+	}
+}
+
 // getNodePortServices returns nodePort type gateway service
 func (c *Controller) getNodePortGatewayServices() []*model.Service {
 	c.RLock()
@@ -16,15 +16,18 @@ package controller
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
 	coreinformers "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/tools/cache"
 
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/serviceregistry/kube"
 	"istio.io/istio/pilot/pkg/util/sets"
+	"istio.io/pkg/log"
 )
 
 // PodCache is an eventually consistent pod cache
@@ -45,6 +48,12 @@ type PodCache struct {
 	// in podCache when endpoint event comes.
 	needResync         map[string]sets.Set
 	queueEndpointEvent func(string)
+	// pendingByNamespace is the number of IPs in needResync with endpoints of each namespace, kept up to
+	// date as endpoints are added to or removed from needResync.
+	pendingByNamespace map[string]int
+
+	// excludedPods is the set of pod keys currently in a phase excluded from endpoints.
+	excludedPods map[string]struct{}
 
 	c *Controller
 }
@@ -56,7 +65,9 @@ func newPodCache(c *Controller, informer coreinformers.PodInformer, queueEndpoin
 		podsByIP:           make(map[string]string),
 		IPByPods:           make(map[string]string),
 		needResync:         make(map[string]sets.Set),
+		pendingByNamespace: make(map[string]int),
 		queueEndpointEvent: queueEndpointEvent,
+		excludedPods:       make(map[string]struct{}),
 	}
 
 	return out
@@ -80,6 +91,18 @@ func (pc *PodCache) onEvent(curr interface{}, ev model.Event) error {
 		}
 	}
 
+	if !pc.c.podNamespaceDiscovered(pod.Namespace) {
+		return nil
+	}
+
+	// container ports cannot change, so the pod is only checked once
+	if ev == model.EventAdd {
+		if names := duplicatePortNames(pod); len(names) > 0 {
+			log.Warnf("pod %s/%s declares ports %v multiple times, the port of the first container is used",
+				pod.Namespace, pod.Name, names)
+		}
+	}
+
 	ip := pod.Status.PodIP
 
 	// PodIP will be empty when pod is just created, but before the IP is assigned
@@ -122,9 +145,10 @@ func (pc *PodCache) onEvent(curr interface{}, ev model.Event) error {
 				pc.deleteIP(ip)
 			}
 		}
+		pc.trackExcludedPhase(key, pod, ev)
 		// fire instance handles for workload
 		for _, handler := range pc.c.workloadHandlers {
-			ep := NewEndpointBuilder(pc.c, pod).buildIstioEndpoint(ip, 0, "")
+			ep := NewEndpointBuilder(pc.c, pod).withUnfilteredLabels().buildIstioEndpoint(ip, 0, "")
 			handler(&model.WorkloadInstance{
 				Name:      pod.Name,
 				Namespace: pod.Namespace,
@@ -133,9 +157,36 @@ func (pc *PodCache) onEvent(curr interface{}, ev model.Event) error {
 			}, ev)
 		}
 	}
+	for _, handler := range pc.c.podHandlers {
+		handler(pod, ev)
+	}
 	return nil
 }
 
+// trackExcludedPhase records whether the pod is in a phase excluded from endpoints, and rebuilds the
+// endpoints of its services when that changes. Must be called with the lock held.
+func (pc *PodCache) trackExcludedPhase(key string, pod *v1.Pod, ev model.Event) {
+	if len(pc.c.excludedPodPhases) == 0 {
+		return
+	}
+	_, wasExcluded := pc.excludedPods[key]
+	excluded := ev != model.EventDelete && pc.c.podPhaseExcluded(pod)
+	if excluded == wasExcluded {
+		return
+	}
+	if excluded {
+		pc.excludedPods[key] = struct{}{}
+	} else {
+		delete(pc.excludedPods, key)
+	}
+	if ev == model.EventDelete {
+		return
+	}
+	pc.c.queue.Push(func() error {
+		return pc.c.updateEDSForPod(pod)
+	})
+}
+
 func getPortMap(pod *v1.Pod) map[string]uint32 {
 	pmap := map[string]uint32{}
 	for _, c := range pod.Spec.Containers {
@@ -168,6 +219,9 @@ func (pc *PodCache) update(ip, key string) {
 
 	if endpointsToUpdate, f := pc.needResync[ip]; f {
 		delete(pc.needResync, ip)
+		for ns := range endpointNamespaces(endpointsToUpdate) {
+			pc.adjustPendingEndpoints(ns, -1)
+		}
 		for ep := range endpointsToUpdate {
 			pc.queueEndpointEvent(ep)
 		}
@@ -182,11 +236,19 @@ func (pc *PodCache) update(ip, key string) {
 func (pc *PodCache) queueEndpointEventOnPodArrival(key, ip string) {
 	pc.Lock()
 	defer pc.Unlock()
-	if _, f := pc.needResync[ip]; !f {
-		pc.needResync[ip] = sets.NewSet(key)
-	} else {
-		pc.needResync[ip].Insert(key)
+	keys, f := pc.needResync[ip]
+	if !f {
+		keys = sets.NewSet()
+		pc.needResync[ip] = keys
+	}
+	if keys.Contains(key) {
+		return
+	}
+	ns := endpointNamespace(key)
+	if !endpointNamespaces(keys).Contains(ns) {
+		pc.adjustPendingEndpoints(ns, 1)
 	}
+	keys.Insert(key)
 	endpointsPendingPodUpdate.Record(float64(len(pc.needResync)))
 }
 
@@ -194,13 +256,48 @@ func (pc *PodCache) queueEndpointEventOnPodArrival(key, ip string) {
 func (pc *PodCache) endpointDeleted(key string, ip string) {
 	pc.Lock()
 	defer pc.Unlock()
-	delete(pc.needResync[ip], key)
-	if len(pc.needResync[ip]) == 0 {
+	keys := pc.needResync[ip]
+	if !keys.Contains(key) {
+		return
+	}
+	delete(keys, key)
+	if ns := endpointNamespace(key); !endpointNamespaces(keys).Contains(ns) {
+		pc.adjustPendingEndpoints(ns, -1)
+	}
+	if len(keys) == 0 {
 		delete(pc.needResync, ip)
 	}
 	endpointsPendingPodUpdate.Record(float64(len(pc.needResync)))
 }
 
+// adjustPendingEndpoints adds delta to the number of endpoint IPs of the namespace waiting for their pod, and
+// records it. Must be called with the lock held.
+func (pc *PodCache) adjustPendingEndpoints(ns string, delta int) {
+	count := pc.pendingByNamespace[ns] + delta
+	if count <= 0 {
+		delete(pc.pendingByNamespace, ns)
+		count = 0
+	} else {
+		pc.pendingByNamespace[ns] = count
+	}
+	endpointsPendingPodByNamespace.With(namespaceTag.Value(ns)).Record(float64(count))
+}
+
+// endpointNamespaces returns the namespaces of the endpoint keys.
+func endpointNamespaces(keys sets.Set) sets.Set {
+	out := sets.NewSet()
+	for key := range keys {
+		out.Insert(endpointNamespace(key))
+	}
+	return out
+}
+
+// endpointNamespace returns the namespace of the endpoint key, empty if it is malformed.
+func endpointNamespace(key string) string {
+	ns, _, _ := cache.SplitMetaNamespaceKey(key)
+	return ns
+}
+
 func (pc *PodCache) proxyUpdates(ip string) {
 	if pc.c != nil && pc.c.xdsUpdater != nil {
 		pc.c.xdsUpdater.ProxyUpdate(pc.c.clusterID, ip)
@@ -215,6 +312,22 @@ func (pc *PodCache) getPodKey(addr string) (string, bool) {
 	return key, exists
 }
 
+// cachedPods returns the pods of the namespace indexed by IP, sorted by name.
+func (pc *PodCache) cachedPods(namespace string) []types.NamespacedName {
+	pc.RLock()
+	defer pc.RUnlock()
+	out := make([]types.NamespacedName, 0)
+	for key := range pc.IPByPods {
+		ns, name, err := cache.SplitMetaNamespaceKey(key)
+		if err != nil || ns != namespace {
+			continue
+		}
+		out = append(out, types.NamespacedName{Namespace: ns, Name: name})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
 // getPodByIp returns the pod or nil if pod not found or an error occurred
 func (pc *PodCache) getPodByIP(addr string) *v1.Pod {
 	key, exists := pc.getPodKey(addr)
@@ -227,3 +340,12 @@ func (pc *PodCache) getPodByIP(addr string) *v1.Pod {
 	}
 	return item.(*v1.Pod)
 }
+
+// getPodByProxy returns the pod matching the first IP address of the proxy, or nil if there is none.
+func (pc *PodCache) getPodByProxy(proxy *model.Proxy) *v1.Pod {
+	if len(proxy.IPAddresses) == 0 {
+		return nil
+	}
+	// multiple IPs belong to the same pod, so the first one is enough
+	return pc.getPodByIP(proxy.IPAddresses[0])
+}
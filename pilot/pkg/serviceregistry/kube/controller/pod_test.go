@@ -22,6 +22,7 @@ import (
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 
@@ -278,3 +279,21 @@ func TestPodCacheEvents(t *testing.T) {
 		t.Errorf("getPodKey => got %s, want none", pod)
 	}
 }
+
+func TestCachedPods(t *testing.T) {
+	c, fx := NewFakeControllerWithOptions(FakeControllerOptions{})
+	defer c.Stop()
+
+	addPods(t, c, fx,
+		generatePod("128.0.0.2", "pod2", "nsA", "", "", map[string]string{"app": "a"}, nil),
+		generatePod("128.0.0.1", "pod1", "nsA", "", "", map[string]string{"app": "a"}, nil),
+		generatePod("128.0.0.3", "pod3", "nsB", "", "", map[string]string{"app": "a"}, nil))
+
+	expected := []types.NamespacedName{{Namespace: "nsA", Name: "pod1"}, {Namespace: "nsA", Name: "pod2"}}
+	if got := c.CachedPods("nsA"); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected cached pods %v, got %v", expected, got)
+	}
+	if got := c.CachedPods("nsC"); len(got) != 0 {
+		t.Fatalf("expected no cached pods, got %v", got)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	klabels "k8s.io/apimachinery/pkg/labels"
+	listerv1 "k8s.io/client-go/listers/core/v1"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/pkg/log"
+)
+
+// OverlappingSelectors returns pod key => sorted names of the services selecting it, for pods selected by
+// more than one service. It is only populated with DetectOverlappingSelectors.
+func (c *Controller) OverlappingSelectors() map[string][]string {
+	c.overlapMutex.RLock()
+	defer c.overlapMutex.RUnlock()
+	out := make(map[string][]string, len(c.overlappingSelectors))
+	for key, services := range c.overlappingSelectors {
+		out[key] = append([]string(nil), services...)
+	}
+	return out
+}
+
+func (c *Controller) onPodSelectorOverlapEvent(pod *v1.Pod, event model.Event) {
+	c.updateSelectorOverlap(pod, event == model.EventDelete || pod.DeletionTimestamp != nil)
+}
+
+// recheckSelectorOverlaps updates the overlaps of the pods the service may select, or used to select.
+func (c *Controller) recheckSelectorOverlaps(svc *v1.Service) {
+	pods := make(map[string]*v1.Pod)
+	if svc.Spec.Selector != nil {
+		selected, err := listerv1.NewPodLister(c.pods.informer.GetIndexer()).Pods(svc.Namespace).
+			List(klabels.SelectorFromSet(svc.Spec.Selector))
+		if err != nil {
+			log.Debugf("pods selected by service %s/%s => error %v", svc.Namespace, svc.Name, err)
+		}
+		for _, pod := range selected {
+			pods[kube.KeyFunc(pod.Name, pod.Namespace)] = pod
+		}
+	}
+
+	// the selector of the service may have changed, so pods it overlapped on are checked too
+	var previous []string
+	c.overlapMutex.RLock()
+	for key := range c.overlappingSelectors {
+		if strings.HasPrefix(key, svc.Namespace+"/") {
+			if _, f := pods[key]; !f {
+				previous = append(previous, key)
+			}
+		}
+	}
+	c.overlapMutex.RUnlock()
+	for _, key := range previous {
+		item, exists, err := c.pods.informer.GetStore().GetByKey(key)
+		if err != nil || !exists {
+			c.setSelectorOverlap(key, nil)
+			continue
+		}
+		if pod, ok := item.(*v1.Pod); ok {
+			pods[key] = pod
+		}
+	}
+
+	for _, pod := range pods {
+		c.updateSelectorOverlap(pod, false)
+	}
+}
+
+// updateSelectorOverlap recomputes the services selecting the pod.
+func (c *Controller) updateSelectorOverlap(pod *v1.Pod, deleted bool) {
+	var names []string
+	if !deleted {
+		services, err := getPodServices(c.serviceLister, pod)
+		if err != nil {
+			log.Debugf("services selecting pod %s/%s => error %v", pod.Namespace, pod.Name, err)
+			return
+		}
+		for _, svc := range services {
+			names = append(names, svc.Name)
+		}
+	}
+	c.setSelectorOverlap(kube.KeyFunc(pod.Name, pod.Namespace), names)
+}
+
+func (c *Controller) setSelectorOverlap(key string, services []string) {
+	sort.Strings(services)
+	c.overlapMutex.Lock()
+	if len(services) > 1 {
+		if _, f := c.overlappingSelectors[key]; !f {
+			log.Warnf("pod %s is selected by multiple services: %v", key, services)
+		}
+		c.overlappingSelectors[key] = services
+	} else {
+		delete(c.overlappingSelectors, key)
+	}
+	total := len(c.overlappingSelectors)
+	c.overlapMutex.Unlock()
+	overlappingSelectorPods.With(clusterTag.Value(c.clusterID)).Record(float64(total))
+}
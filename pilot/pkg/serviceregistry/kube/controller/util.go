@@ -17,8 +17,11 @@ package controller
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strconv"
 
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	klabels "k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/intstr"
@@ -53,7 +56,8 @@ func getLabelValue(metadata metav1.Object, label string, fallBackLabel string) s
 // FindPort locates the container port for the given pod and portName.  If the
 // targetPort is a number, use that.  If the targetPort is a string, look that
 // string up in all named ports in all containers in the target pod.  If no
-// match is found, fail.
+// match is found, fail. If multiple containers declare the named port, the one
+// of the first container is used.
 func FindPort(pod *v1.Pod, svcPort *v1.ServicePort) (int, error) {
 	portName := svcPort.TargetPort
 	switch portName.Type {
@@ -73,6 +77,31 @@ func FindPort(pod *v1.Pod, svcPort *v1.ServicePort) (int, error) {
 	return 0, fmt.Errorf("no suitable port for manifest: %s", pod.UID)
 }
 
+// duplicatePortNames returns the names of the ports declared with different numbers by several containers of
+// the pod, for which FindPort uses the port of the first container.
+func duplicatePortNames(pod *v1.Pod) []string {
+	type portKey struct {
+		name     string
+		protocol v1.Protocol
+	}
+	ports := make(map[portKey]int32)
+	var duplicates []string
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			if port.Name == "" {
+				continue
+			}
+			key := portKey{port.Name, port.Protocol}
+			if prev, f := ports[key]; !f {
+				ports[key] = port.ContainerPort
+			} else if prev != port.ContainerPort {
+				duplicates = append(duplicates, port.Name)
+			}
+		}
+	}
+	return duplicates
+}
+
 // findPortFromMetadata resolves the TargetPort of a Service Port, by reading the Pod spec.
 func findPortFromMetadata(svcPort v1.ServicePort, podPorts []model.PodPort) (int, error) {
 	target := svcPort.TargetPort
@@ -81,10 +110,11 @@ func findPortFromMetadata(svcPort v1.ServicePort, podPorts []model.PodPort) (int
 	case intstr.String:
 		name := target.StrVal
 		for _, port := range podPorts {
-			if port.Name == name && port.Protocol == string(svcPort.Protocol) {
+			if port.Name == name && protocolOrDefault(port.Protocol) == protocolOrDefault(string(svcPort.Protocol)) {
 				return port.ContainerPort, nil
 			}
 		}
+		return 0, fmt.Errorf("no pod port named %q found for service port %q", name, svcPort.Name)
 	case intstr.Int:
 		// For a direct reference we can just return the port number
 		return target.IntValue(), nil
@@ -93,6 +123,14 @@ func findPortFromMetadata(svcPort v1.ServicePort, podPorts []model.PodPort) (int
 	return 0, fmt.Errorf("no matching port found for %+v", svcPort)
 }
 
+// protocolOrDefault returns the protocol, defaulting to TCP as Kubernetes does when it is unset.
+func protocolOrDefault(p string) string {
+	if p == "" {
+		return string(v1.ProtocolTCP)
+	}
+	return p
+}
+
 // get the target Port for this service port
 func findServiceTargetPort(servicePort *model.Port, k8sService *v1.Service) (int, string) {
 	targetPort := 0
@@ -111,6 +149,29 @@ func findServiceTargetPort(servicePort *model.Port, k8sService *v1.Service) (int
 	return targetPort, targetPortName
 }
 
+// validateTargetPortProtocols returns an error if multiple ports of the service map to the same target port
+// with different protocols. svcConv must be the conversion of svc, with its ports in the same order.
+func validateTargetPortProtocols(svc *v1.Service, svcConv *model.Service) error {
+	seen := make(map[string]*model.Port, len(svc.Spec.Ports))
+	for i, port := range svc.Spec.Ports {
+		if i >= len(svcConv.Ports) {
+			break
+		}
+		target := port.TargetPort.String()
+		if port.TargetPort.Type == intstr.Int && port.TargetPort.IntVal == 0 {
+			// Kubernetes defaults the target port to the service port
+			target = strconv.Itoa(int(port.Port))
+		}
+		curr := svcConv.Ports[i]
+		if prev, f := seen[target]; f && prev.Protocol != curr.Protocol {
+			return fmt.Errorf("ports %q (%s) and %q (%s) both target port %s",
+				prev.Name, prev.Protocol, curr.Name, curr.Protocol, target)
+		}
+		seen[target] = curr
+	}
+	return nil
+}
+
 func getPodServices(s listerv1.ServiceLister, pod *v1.Pod) ([]*v1.Service, error) {
 	allServices, err := s.Services(pod.Namespace).List(klabels.Everything())
 	if err != nil {
@@ -182,10 +243,58 @@ func getNodeSelectorsForService(svc *v1.Service) labels.Instance {
 }
 
 func nodeEquals(a, b kubernetesNode) bool {
-	return a.address == b.address && a.labels.Equals(b.labels)
+	return a.address == b.address && a.labels.Equals(b.labels) && a.unschedulable == b.unschedulable
+}
+
+// isNodeUnschedulable returns true if the node is cordoned, or tainted as unschedulable.
+func isNodeUnschedulable(node *v1.Node) bool {
+	if node.Spec.Unschedulable {
+		return true
+	}
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == v1.TaintNodeUnschedulable {
+			return true
+		}
+	}
+	return false
 }
 
 func isNodePortGatewayService(svc *v1.Service) bool {
 	_, ok := svc.Annotations[kube.NodeSelectorAnnotation]
 	return ok && svc.Spec.Type == v1.ServiceTypeNodePort
 }
+
+// interleaveByNamespace reorders objects so namespaces take turns, with up to batchSize objects of a namespace
+// at a time. Objects keep their relative order within a namespace.
+func interleaveByNamespace(objs []interface{}, batchSize int) []interface{} {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	byNamespace := make(map[string][]interface{})
+	namespaces := make([]string, 0)
+	for _, obj := range objs {
+		var ns string
+		if m, err := meta.Accessor(obj); err == nil {
+			ns = m.GetNamespace()
+		}
+		if _, f := byNamespace[ns]; !f {
+			namespaces = append(namespaces, ns)
+		}
+		byNamespace[ns] = append(byNamespace[ns], obj)
+	}
+	sort.Strings(namespaces)
+
+	out := make([]interface{}, 0, len(objs))
+	for len(out) < len(objs) {
+		for _, ns := range namespaces {
+			remaining := byNamespace[ns]
+			n := batchSize
+			if n > len(remaining) {
+				n = len(remaining)
+			}
+			out = append(out, remaining[:n]...)
+			byNamespace[ns] = remaining[n:]
+		}
+	}
+	return out
+}
@@ -15,10 +15,15 @@
 package controller
 
 import (
+	"fmt"
+	"reflect"
 	"testing"
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"istio.io/istio/pilot/pkg/model"
 )
 
 func TestHasProxyIP(t *testing.T) {
@@ -89,3 +94,70 @@ func TestGetLabelValue(t *testing.T) {
 		})
 	}
 }
+
+func TestFindPortDuplicateNames(t *testing.T) {
+	svcPort := v1.ServicePort{Name: "http", Port: 80, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromString("http")}
+	pod := &v1.Pod{
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{
+				{Name: "app", Ports: []v1.ContainerPort{{Name: "http", ContainerPort: 8080, Protocol: v1.ProtocolTCP}}},
+				{Name: "sidecar", Ports: []v1.ContainerPort{{Name: "http", ContainerPort: 9090, Protocol: v1.ProtocolTCP}}},
+			},
+		},
+	}
+	if port, err := FindPort(pod, &svcPort); err != nil || port != 8080 {
+		t.Fatalf("expected port 8080 of the first container, got %d (%v)", port, err)
+	}
+	if got := duplicatePortNames(pod); !reflect.DeepEqual(got, []string{"http"}) {
+		t.Fatalf("expected duplicate port http, got %v", got)
+	}
+	pod.Spec.Containers[1].Ports[0].ContainerPort = 8080
+	if got := duplicatePortNames(pod); len(got) != 0 {
+		t.Fatalf("expected no duplicate port when the numbers match, got %v", got)
+	}
+
+	podPorts := []model.PodPort{
+		{Name: "http", ContainerPort: 8080, Protocol: "TCP"},
+		{Name: "http", ContainerPort: 9090, Protocol: "TCP"},
+	}
+	if port, err := findPortFromMetadata(svcPort, podPorts); err != nil || port != 8080 {
+		t.Fatalf("expected port 8080 of the first declaration, got %d (%v)", port, err)
+	}
+}
+
+func TestInterleaveByNamespace(t *testing.T) {
+	var objs []interface{}
+	// the large namespace is listed first, as it would be if informers listed objects by namespace
+	for i := 0; i < 50; i++ {
+		objs = append(objs, &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i), Namespace: "large"}})
+	}
+	small := []string{"small1", "small2", "small3"}
+	for _, ns := range small {
+		for i := 0; i < 2; i++ {
+			objs = append(objs, &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i), Namespace: ns}})
+		}
+	}
+
+	for _, batchSize := range []int{0, 1, 2} {
+		out := interleaveByNamespace(objs, batchSize)
+		if len(out) != len(objs) {
+			t.Fatalf("batch size %d: expected %d objects, got %d", batchSize, len(objs), len(out))
+		}
+		// every small namespace is done after two objects of each namespace
+		last := map[string]int{}
+		next := map[string]int{}
+		for i, obj := range out {
+			pod := obj.(*v1.Pod)
+			if want := fmt.Sprintf("pod%d", next[pod.Namespace]); pod.Name != want {
+				t.Fatalf("batch size %d: expected %s/%s, got %s", batchSize, pod.Namespace, want, pod.Name)
+			}
+			next[pod.Namespace]++
+			last[pod.Namespace] = i
+		}
+		for _, ns := range small {
+			if last[ns] >= 2*(len(small)+1) {
+				t.Errorf("batch size %d: namespace %s finished at position %d", batchSize, ns, last[ns])
+			}
+		}
+	}
+}
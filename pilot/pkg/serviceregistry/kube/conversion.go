@@ -16,6 +16,7 @@ package kube
 
 import (
 	"sort"
+	"strconv"
 	"strings"
 
 	coreV1 "k8s.io/api/core/v1"
@@ -26,8 +27,10 @@ import (
 	"istio.io/istio/pkg/config/constants"
 	"istio.io/istio/pkg/config/host"
 	"istio.io/istio/pkg/config/kube"
+	"istio.io/istio/pkg/config/protocol"
 	"istio.io/istio/pkg/config/visibility"
 	"istio.io/istio/pkg/spiffe"
+	"istio.io/pkg/log"
 )
 
 const (
@@ -40,16 +43,70 @@ const (
 	// that can be used to select a subset of nodes from the pool of k8s nodes
 	// It is used for multi-cluster scenario, and with nodePort type gateway service.
 	NodeSelectorAnnotation = "traffic.istio.io/nodeSelector"
+
+	// TODO: move to API
+	// PortProtocolsAnnotation overrides the protocol inferred from the port name, for example
+	// "8080=HTTP,9090=GRPC". An explicit appProtocol on the port still takes precedence.
+	PortProtocolsAnnotation = "networking.istio.io/portProtocols"
+
+	// TODO: move to API
+	// ServiceNetworkAnnotation forces all endpoints of the service into the annotated network, unless an
+	// endpoint's pod sets its own network label.
+	ServiceNetworkAnnotation = "networking.istio.io/network"
+
+	// TODO: move to API
+	// GatewayExternalAddressAnnotation is a comma separated list of addresses replacing the node addresses
+	// of a nodePort type gateway service, for gateways exposed through a load balancer in front of the nodes.
+	GatewayExternalAddressAnnotation = "networking.istio.io/gatewayExternalAddress"
+
+	// TODO: move to API
+	// HeadlessAsEDSAnnotation, when "true", load balances a headless service over its endpoints (ClientSideLB)
+	// rather than passing traffic through to the requested address. It only applies to services with HTTP
+	// ports only, as TCP ports of headless services are served by a listener per endpoint address.
+	HeadlessAsEDSAnnotation = "networking.istio.io/headlessAsEDS"
 )
 
-func convertPort(port coreV1.ServicePort) *model.Port {
+func convertPort(port coreV1.ServicePort, protocolOverrides map[int32]protocol.Instance) *model.Port {
+	proto := kube.ConvertProtocol(port.Port, port.Name, port.Protocol, port.AppProtocol)
+	if override, f := protocolOverrides[port.Port]; f && port.AppProtocol == nil && proto != protocol.UDP {
+		proto = override
+	}
 	return &model.Port{
 		Name:     port.Name,
 		Port:     int(port.Port),
-		Protocol: kube.ConvertProtocol(port.Port, port.Name, port.Protocol, port.AppProtocol),
+		Protocol: proto,
 	}
 }
 
+// getPortProtocolOverrides parses the PortProtocolsAnnotation of the service. Malformed entries are
+// logged and ignored.
+func getPortProtocolOverrides(svc coreV1.Service) map[int32]protocol.Instance {
+	value := svc.Annotations[PortProtocolsAnnotation]
+	if value == "" {
+		return nil
+	}
+	out := make(map[int32]protocol.Instance)
+	for _, entry := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(kv) != 2 {
+			log.Warnf("ignoring malformed entry %q in %s for service %s/%s", entry, PortProtocolsAnnotation, svc.Namespace, svc.Name)
+			continue
+		}
+		port, err := strconv.ParseInt(strings.TrimSpace(kv[0]), 10, 32)
+		if err != nil {
+			log.Warnf("ignoring invalid port %q in %s for service %s/%s", kv[0], PortProtocolsAnnotation, svc.Namespace, svc.Name)
+			continue
+		}
+		proto := protocol.Parse(strings.TrimSpace(kv[1]))
+		if proto == protocol.Unsupported {
+			log.Warnf("ignoring unsupported protocol %q in %s for service %s/%s", kv[1], PortProtocolsAnnotation, svc.Namespace, svc.Name)
+			continue
+		}
+		out[int32(port)] = proto
+	}
+	return out
+}
+
 func ConvertService(svc coreV1.Service, domainSuffix string, clusterID string) *model.Service {
 	addr, external := constants.UnspecifiedIP, ""
 	if svc.Spec.ClusterIP != "" && svc.Spec.ClusterIP != coreV1.ClusterIPNone {
@@ -65,7 +122,14 @@ func ConvertService(svc coreV1.Service, domainSuffix string, clusterID string) *
 		meshExternal = true
 	}
 
-	if addr == constants.UnspecifiedIP && external == "" { // headless services should not be load balanced
+	protocolOverrides := getPortProtocolOverrides(svc)
+	ports := make([]*model.Port, 0, len(svc.Spec.Ports))
+	for _, port := range svc.Spec.Ports {
+		ports = append(ports, convertPort(port, protocolOverrides))
+	}
+
+	// headless services should not be load balanced, unless requested
+	if addr == constants.UnspecifiedIP && external == "" && !headlessAsEDS(svc, ports) {
 		resolution = model.Passthrough
 	}
 
@@ -74,11 +138,6 @@ func ConvertService(svc coreV1.Service, domainSuffix string, clusterID string) *
 		labelSelectors = svc.Spec.Selector
 	}
 
-	ports := make([]*model.Port, 0, len(svc.Spec.Ports))
-	for _, port := range svc.Spec.Ports {
-		ports = append(ports, convertPort(port))
-	}
-
 	var exportTo map[visibility.Instance]bool
 	serviceaccounts := make([]string, 0)
 	if svc.Annotations[annotation.AlphaCanonicalServiceAccounts.Name] != "" {
@@ -153,6 +212,21 @@ func ConvertService(svc coreV1.Service, domainSuffix string, clusterID string) *
 	return istioService
 }
 
+// headlessAsEDS returns true if the headless service requests load balancing with the HeadlessAsEDSAnnotation,
+// and all its ports are HTTP. The annotation is ignored otherwise.
+func headlessAsEDS(svc coreV1.Service, ports []*model.Port) bool {
+	if svc.Annotations[HeadlessAsEDSAnnotation] != "true" {
+		return false
+	}
+	for _, port := range ports {
+		if !port.Protocol.IsHTTP() {
+			log.Warnf("ignoring %s for service %s/%s, as port %d is not HTTP", HeadlessAsEDSAnnotation, svc.Namespace, svc.Name, port.Port)
+			return false
+		}
+	}
+	return true
+}
+
 func ExternalNameServiceInstances(k8sSvc *coreV1.Service, svc *model.Service) []*model.ServiceInstance {
 	if k8sSvc.Spec.Type != coreV1.ServiceTypeExternalName || k8sSvc.Spec.ExternalName == "" {
 		return nil
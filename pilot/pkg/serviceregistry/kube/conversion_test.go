@@ -25,6 +25,7 @@ import (
 	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"istio.io/api/annotation"
+	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pkg/config/kube"
 	"istio.io/istio/pkg/config/protocol"
 	"istio.io/istio/pkg/spiffe"
@@ -256,6 +257,45 @@ func TestServiceConversionWithEmptyServiceAccountsAnnotation(t *testing.T) {
 	}
 }
 
+func TestHeadlessServiceConversion(t *testing.T) {
+	cases := []struct {
+		name        string
+		annotations map[string]string
+		tcpPort     bool
+		want        model.Resolution
+	}{
+		{name: "without annotation", want: model.Passthrough},
+		{name: "with annotation", annotations: map[string]string{HeadlessAsEDSAnnotation: "true"}, want: model.ClientSideLB},
+		{name: "with annotation disabled", annotations: map[string]string{HeadlessAsEDSAnnotation: "false"}, want: model.Passthrough},
+		{name: "with annotation and a TCP port", annotations: map[string]string{HeadlessAsEDSAnnotation: "true"}, tcpPort: true, want: model.Passthrough},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := coreV1.Service{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name:        "service1",
+					Namespace:   "default",
+					Annotations: tt.annotations,
+				},
+				Spec: coreV1.ServiceSpec{
+					ClusterIP: coreV1.ClusterIPNone,
+					Ports: []coreV1.ServicePort{
+						{Name: "http", Port: 8080, Protocol: coreV1.ProtocolTCP},
+					},
+				},
+			}
+			if tt.tcpPort {
+				svc.Spec.Ports = append(svc.Spec.Ports, coreV1.ServicePort{Name: "tcp", Port: 9090, Protocol: coreV1.ProtocolTCP})
+			}
+
+			service := ConvertService(svc, domainSuffix, clusterID)
+			if service.Resolution != tt.want {
+				t.Fatalf("expected resolution %v, got %v", tt.want, service.Resolution)
+			}
+		})
+	}
+}
+
 func TestExternalServiceConversion(t *testing.T) {
 	serviceName := "service1"
 	namespace := "default"
@@ -406,6 +446,79 @@ func TestLBServiceConversion(t *testing.T) {
 	}
 }
 
+func TestServiceConversionWithPortProtocolsAnnotation(t *testing.T) {
+	grpc := "grpc"
+	cases := []struct {
+		name       string
+		annotation string
+		ports      []coreV1.ServicePort
+		want       []protocol.Instance
+	}{
+		{
+			name:       "override inferred protocol",
+			annotation: "8080=HTTP, 9090=grpc",
+			ports: []coreV1.ServicePort{
+				{Name: "tcp-web", Port: 8080, Protocol: coreV1.ProtocolTCP},
+				{Name: "api", Port: 9090, Protocol: coreV1.ProtocolTCP},
+				{Name: "http-other", Port: 7070, Protocol: coreV1.ProtocolTCP},
+			},
+			want: []protocol.Instance{protocol.HTTP, protocol.GRPC, protocol.HTTP},
+		},
+		{
+			name:       "appProtocol wins over annotation",
+			annotation: "8080=HTTP",
+			ports: []coreV1.ServicePort{
+				{Name: "tcp-web", Port: 8080, Protocol: coreV1.ProtocolTCP, AppProtocol: &grpc},
+			},
+			want: []protocol.Instance{protocol.GRPC},
+		},
+		{
+			name:       "UDP is never overridden",
+			annotation: "53=TCP",
+			ports: []coreV1.ServicePort{
+				{Name: "dns", Port: 53, Protocol: coreV1.ProtocolUDP},
+			},
+			want: []protocol.Instance{protocol.UDP},
+		},
+		{
+			name:       "malformed entries are ignored",
+			annotation: "8080,abc=HTTP,9090=notaprotocol,,7070=HTTP2",
+			ports: []coreV1.ServicePort{
+				{Name: "tcp-web", Port: 8080, Protocol: coreV1.ProtocolTCP},
+				{Name: "tcp-api", Port: 9090, Protocol: coreV1.ProtocolTCP},
+				{Name: "tcp-other", Port: 7070, Protocol: coreV1.ProtocolTCP},
+			},
+			want: []protocol.Instance{protocol.TCP, protocol.TCP, protocol.HTTP2},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := coreV1.Service{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name:        "service1",
+					Namespace:   "default",
+					Annotations: map[string]string{PortProtocolsAnnotation: tt.annotation},
+				},
+				Spec: coreV1.ServiceSpec{
+					ClusterIP: "10.0.0.1",
+					Ports:     tt.ports,
+				},
+			}
+
+			service := ConvertService(svc, domainSuffix, clusterID)
+			if len(service.Ports) != len(tt.want) {
+				t.Fatalf("expected %d ports, got %d", len(tt.want), len(service.Ports))
+			}
+			for i, want := range tt.want {
+				if service.Ports[i].Protocol != want {
+					t.Errorf("port %d: expected protocol %v, got %v", service.Ports[i].Port, want, service.Ports[i].Protocol)
+				}
+			}
+		})
+	}
+}
+
 func TestSecureNamingSAN(t *testing.T) {
 
 	pod := &coreV1.Pod{}
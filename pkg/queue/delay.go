@@ -146,6 +146,13 @@ func (d *delayQueue) Push(task Task) {
 	d.PushDelayed(task, 0)
 }
 
+// Len returns the number of tasks held in the heap awaiting execution.
+func (d *delayQueue) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.queue.Len()
+}
+
 func (d *delayQueue) Run(stop <-chan struct{}) {
 	for i := 0; i < d.workers; i++ {
 		go d.work(stop)
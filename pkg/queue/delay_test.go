@@ -119,3 +119,16 @@ func TestDelayQueuePushNonblockingWithFullBuffer(t *testing.T) {
 		t.Fatal("timed out waiting for enqueues")
 	}
 }
+
+func TestDelayQueueLen(t *testing.T) {
+	dq := NewDelayed(DelayQueueBuffer(0), DelayQueueWorkers(0))
+	if got := dq.Len(); got != 0 {
+		t.Fatalf("expected empty queue, got %d", got)
+	}
+	for i := 0; i < 3; i++ {
+		dq.PushDelayed(func() error { return nil }, time.Minute)
+	}
+	if got := dq.Len(); got != 3 {
+		t.Fatalf("expected 3 items in the queue, got %d", got)
+	}
+}
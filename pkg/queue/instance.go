@@ -30,6 +30,8 @@ type Instance interface {
 	Push(task Task)
 	// Run the loop until a signal on the channel
 	Run(<-chan struct{})
+	// Len returns the number of tasks waiting to be processed.
+	Len() int
 }
 
 type queueImpl struct {
@@ -58,6 +60,12 @@ func (q *queueImpl) Push(item Task) {
 	q.cond.Signal()
 }
 
+func (q *queueImpl) Len() int {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return len(q.tasks)
+}
+
 func (q *queueImpl) Run(stop <-chan struct{}) {
 	go func() {
 		<-stop
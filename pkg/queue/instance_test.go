@@ -113,3 +113,25 @@ func TestResourceFree(t *testing.T) {
 		t.Log("queue return.")
 	}
 }
+
+func TestLen(t *testing.T) {
+	q := NewQueue(1 * time.Microsecond)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	for i := 0; i < 3; i++ {
+		q.Push(func() error { return nil })
+	}
+	if got := q.Len(); got != 3 {
+		t.Fatalf("expected queue length 3, got %d", got)
+	}
+
+	go q.Run(stop)
+	deadline := time.Now().Add(5 * time.Second)
+	for q.Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected queue to drain, length is %d", q.Len())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}